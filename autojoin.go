@@ -0,0 +1,405 @@
+package irc
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultJoinRetry is how long the client waits before retrying a
+	// channel that refused it when Client.JoinRetry is zero.
+	DefaultJoinRetry = 30 * time.Second
+
+	// MaxJoinRetry caps the wait between retries, which doubles with each
+	// refusal.
+	MaxJoinRetry = 10 * time.Minute
+)
+
+// A JoinStatus is where the client stands with a channel given to
+// AddChannel.
+type JoinStatus int
+
+const (
+	// JoinWaiting channels are joined once registration completes, or when
+	// JoinChannels is called if Client.DeferJoin is set.
+	JoinWaiting JoinStatus = iota
+
+	// JoinSent channels have been sent a JOIN the server hasn't answered.
+	JoinSent
+
+	// Joined channels have the client in them.
+	Joined
+
+	// JoinRetrying channels refused the client, or kicked it with
+	// Client.RejoinOnKick set, and will be tried again.
+	JoinRetrying
+
+	// JoinFailed channels refused the client for good, or at least until
+	// JoinChannels is called again.
+	JoinFailed
+
+	// Kicked channels kicked the client, and aren't rejoined.
+	Kicked
+)
+
+var joinStatusNames = [...]string{"waiting", "sent", "joined", "retrying", "failed", "kicked"}
+
+func (s JoinStatus) String() string {
+	if s < 0 || int(s) >= len(joinStatusNames) {
+		return "JoinStatus(" + strconv.Itoa(int(s)) + ")"
+	}
+	return joinStatusNames[s]
+}
+
+// A JoinError is why the client isn't in a channel: the numeric the server
+// refused the JOIN with, or "KICK" if the client was kicked, and the reason
+// given.
+type JoinError struct {
+	Channel string
+	Code    string
+	Reason  string
+}
+
+func (e *JoinError) Error() string {
+	return "irc: " + e.Channel + ": " + e.Code + " " + e.Reason
+}
+
+// Retryable reports whether the refusal may not last: the channel is full
+// (471), invite only (473), the client is banned (474) or the key is wrong
+// (475).
+func (e *JoinError) Retryable() bool {
+	switch e.Code {
+	case "471", "473", "474", "475":
+		return true
+	}
+	return false
+}
+
+// A ChannelState reports where the client stands with a channel given to
+// AddChannel.
+type ChannelState struct {
+	Name     string
+	Key      string
+	Status   JoinStatus
+	Err      error     // why the client isn't in the channel, if it isn't
+	Attempts int       // refusals since the client was last in the channel
+	Retry    time.Time // when the client will try again, if JoinRetrying
+}
+
+// autojoin is a channel the client stays in.
+type autojoin struct {
+	ChannelState
+	timer *time.Timer
+}
+
+// joinState tracks the channels given to AddChannel. The set is kept across
+// connections.
+type joinState struct {
+	mu    sync.Mutex
+	chans map[string]*autojoin // by lower case name
+	ready bool                 // JOINs may be sent on this connection
+	limit int                  // channels per JOIN, or 0 for no limit
+	gen   int                  // bumped when the connection ends, to stop retries
+}
+
+// AddChannel adds channel to the set the client stays in, with key if it
+// needs one. The client joins it as soon as it may, and again on every
+// reconnect. Adding a channel again changes its key.
+func (c *Client) AddChannel(channel, key string) {
+	j := &c.joins
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.chans == nil {
+		j.chans = make(map[string]*autojoin)
+	}
+	a, ok := j.chans[strings.ToLower(channel)]
+	if !ok {
+		a = &autojoin{ChannelState: ChannelState{Name: channel}}
+		j.chans[strings.ToLower(channel)] = a
+	}
+	a.Key = key
+	if j.ready && (a.Status == JoinWaiting || a.Status == JoinFailed || a.Status == Kicked) {
+		c.sendJoins([]*autojoin{a})
+	}
+}
+
+// RemoveChannel takes channel out of the set the client stays in, and
+// leaves it if the client is in it.
+func (c *Client) RemoveChannel(channel string) {
+	j := &c.joins
+	j.mu.Lock()
+	a, ok := j.chans[strings.ToLower(channel)]
+	in := ok && a.Status == Joined
+	if ok {
+		a.stop()
+		delete(j.chans, strings.ToLower(channel))
+	}
+	j.mu.Unlock()
+
+	if in {
+		c.Command("PART", []string{a.Name})
+	}
+}
+
+// Channels returns the state of each channel given to AddChannel, by name.
+func (c *Client) Channels() []ChannelState {
+	j := &c.joins
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	states := make([]ChannelState, 0, len(j.chans))
+	for _, a := range j.chans {
+		states = append(states, a.ChannelState)
+	}
+	sort.Slice(states, func(i, k int) bool {
+		return strings.ToLower(states[i].Name) < strings.ToLower(states[k].Name)
+	})
+	return states
+}
+
+// ChannelStatus returns the state of a channel given to AddChannel, and
+// false if it wasn't.
+func (c *Client) ChannelStatus(channel string) (ChannelState, bool) {
+	j := &c.joins
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	a, ok := j.chans[strings.ToLower(channel)]
+	if !ok {
+		return ChannelState{}, false
+	}
+	return a.ChannelState, true
+}
+
+// JoinChannels joins the channels given to AddChannel that the client isn't
+// in, including ones that refused it for good, and lets channels added
+// later be joined straight away. The client calls it itself once
+// registration completes, unless DeferJoin is set. It may be called from a
+// Handler.
+func (c *Client) JoinChannels() {
+	j := &c.joins
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.ready = true
+
+	var pending []*autojoin
+	for _, a := range j.chans {
+		switch a.Status {
+		case JoinWaiting, JoinFailed, Kicked:
+			a.Attempts = 0
+			pending = append(pending, a)
+		}
+	}
+	sort.Slice(pending, func(i, k int) bool {
+		return strings.ToLower(pending[i].Name) < strings.ToLower(pending[k].Name)
+	})
+	c.sendJoins(pending)
+}
+
+// startJoins joins the channels once registration completes, and notes how
+// many the server takes in one JOIN, which is known by then.
+func (c *Client) startJoins() {
+	limit := c.targmax("JOIN")
+	c.joins.mu.Lock()
+	c.joins.limit = limit
+	c.joins.mu.Unlock()
+	if !c.DeferJoin {
+		c.JoinChannels()
+	}
+}
+
+// resetJoins forgets the state of the connection that is starting or has
+// ended: the client is in no channel, and no retry is due.
+func (c *Client) resetJoins() {
+	j := &c.joins
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.ready = false
+	j.limit = 0
+	j.gen++
+	for _, a := range j.chans {
+		a.stop()
+		a.Status = JoinWaiting
+		a.Err = nil
+		a.Attempts = 0
+	}
+}
+
+// sendJoins joins chans in as few lines as the server allows: as many
+// channels per JOIN as its TARGMAX says, keeping each line under
+// maxLineBudget bytes. Channels with keys go first, since keys are matched
+// to channels in order. c.joins.mu must be held.
+func (c *Client) sendJoins(chans []*autojoin) {
+	sort.SliceStable(chans, func(i, k int) bool {
+		return chans[i].Key != "" && chans[k].Key == ""
+	})
+	limit := c.joins.limit
+
+	var names, keys []string
+	size := 0
+	flush := func() {
+		if len(names) == 0 {
+			return
+		}
+		params := []string{strings.Join(names, ",")}
+		if len(keys) > 0 {
+			params = append(params, strings.Join(keys, ","))
+		}
+		c.Command("JOIN", params)
+		names, keys, size = nil, nil, 0
+	}
+	for _, a := range chans {
+		a.stop()
+		a.Status = JoinSent
+		n := len(a.Name) + len(a.Key) + 2
+		if len(names) > 0 && (limit > 0 && len(names) == limit || size+n > maxLineBudget) {
+			flush()
+		}
+		names = append(names, a.Name)
+		if a.Key != "" {
+			keys = append(keys, a.Key)
+		}
+		size += n
+	}
+	flush()
+}
+
+// targmax returns the most targets the server takes in one cmd, from the
+// TARGMAX token of RPL_ISUPPORT, or 0 if there's no limit.
+func (c *Client) targmax(cmd string) int {
+	for _, pair := range strings.Split(c.caps["TARGMAX"], ",") {
+		name, limit, _ := strings.Cut(pair, ":")
+		if strings.EqualFold(name, cmd) {
+			n, _ := strconv.Atoi(limit)
+			return n
+		}
+	}
+	return 0
+}
+
+// joined records that the client is in channel.
+func (c *Client) joined(channel string) {
+	j := &c.joins
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if a, ok := j.chans[strings.ToLower(channel)]; ok {
+		a.stop()
+		a.Status = Joined
+		a.Err = nil
+		a.Attempts = 0
+	}
+}
+
+// parted stops tracking a channel the client has left of its own accord.
+func (c *Client) parted(channel string) {
+	j := &c.joins
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if a, ok := j.chans[strings.ToLower(channel)]; ok {
+		a.stop()
+		delete(j.chans, strings.ToLower(channel))
+	}
+}
+
+// joinRefused handles the server refusing to let the client into a channel
+// it asked to join:
+//
+//	:server 403 <nick> <channel> :<reason>   ERR_NOSUCHCHANNEL
+//	:server 405 <nick> <channel> :<reason>   ERR_TOOMANYCHANNELS
+//	:server 471 <nick> <channel> :<reason>   ERR_CHANNELISFULL
+//	:server 473 <nick> <channel> :<reason>   ERR_INVITEONLYCHAN
+//	:server 474 <nick> <channel> :<reason>   ERR_BANNEDFROMCHAN
+//	:server 475 <nick> <channel> :<reason>   ERR_BADCHANNELKEY
+//	:server 476 <nick> <channel> :<reason>   ERR_BADCHANMASK
+//	:server 477 <nick> <channel> :<reason>   ERR_NEEDREGGEDNICK
+//
+// Retryable refusals are retried with backoff, after JoinRefused has had a
+// chance to do something about them.
+func (c *Client) joinRefused(m *Message) {
+	err := &JoinError{Channel: m.Param(1), Code: m.Command, Reason: m.LastParam()}
+	j := &c.joins
+	j.mu.Lock()
+	a, ok := j.chans[strings.ToLower(err.Channel)]
+	if !ok || a.Status != JoinSent {
+		j.mu.Unlock()
+		return
+	}
+	a.Err = err
+	a.Attempts++
+	retry := err.Retryable() && c.JoinRetry >= 0
+	if retry {
+		c.retryJoin(a)
+	} else {
+		a.Status = JoinFailed
+	}
+	j.mu.Unlock()
+
+	if retry && c.JoinRefused != nil {
+		c.JoinRefused(c, err)
+	}
+}
+
+// kicked handles the client being kicked from a channel:
+//
+//	:<source> KICK <channel> <nick> [:<reason>]
+func (c *Client) kicked(m *Message) {
+	channel := m.Param(0)
+	j := &c.joins
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	a, ok := j.chans[strings.ToLower(channel)]
+	if !ok {
+		return
+	}
+	reason := ""
+	if m.NumParams() > 2 {
+		reason = m.LastParam()
+	}
+	a.Err = &JoinError{Channel: a.Name, Code: "KICK", Reason: reason}
+	if !c.RejoinOnKick {
+		a.Status = Kicked
+		return
+	}
+	// kicked again straight away counts as a refusal, to back off
+	a.Attempts++
+	c.retryJoin(a)
+}
+
+// retryJoin schedules another JOIN of a, waiting twice as long as last
+// time. c.joins.mu must be held.
+func (c *Client) retryJoin(a *autojoin) {
+	delay := c.JoinRetry
+	if delay <= 0 {
+		delay = DefaultJoinRetry
+	}
+	for i := 1; i < a.Attempts && delay < MaxJoinRetry; i++ {
+		delay *= 2
+	}
+	if delay > MaxJoinRetry {
+		delay = MaxJoinRetry
+	}
+
+	a.stop()
+	a.Status = JoinRetrying
+	a.Retry = time.Now().Add(delay)
+	gen := c.joins.gen
+	a.timer = time.AfterFunc(delay, func() {
+		j := &c.joins
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if j.gen != gen || a.Status != JoinRetrying || j.chans[strings.ToLower(a.Name)] != a {
+			return
+		}
+		c.sendJoins([]*autojoin{a})
+	})
+}
+
+// stop cancels any retry due for a.
+func (a *autojoin) stop() {
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.Retry = time.Time{}
+}
@@ -0,0 +1,155 @@
+package irc
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// registerJoins completes registration with the given ISUPPORT tokens.
+func registerJoins(t *testing.T, c *Client, isupport string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c.Nick, c.User = "bot", "bot"
+	c.RegainInterval = -1
+	c.Flood = &FloodProfile{Window: time.Hour}
+	server, r := connectPipe(t, c)
+	t.Cleanup(func() { c.Close() })
+	io.WriteString(server, ":irc.test 001 bot :Welcome\r\n"+
+		":irc.test 005 bot "+isupport+" :are supported by this server\r\n"+
+		":irc.test 376 bot :End of /MOTD command.\r\n")
+	return server, r
+}
+
+// syncHandlers waits until the client has handled everything sent so far.
+func syncHandlers(t *testing.T, server net.Conn, r *bufio.Reader) {
+	t.Helper()
+	io.WriteString(server, "PING :sync\r\n")
+	if m := readMessage(t, r); m.Command != "PONG" {
+		t.Fatalf("expect PONG, got %q", m)
+	}
+}
+
+func expectStatus(t *testing.T, c *Client, channel string, exp JoinStatus) ChannelState {
+	t.Helper()
+	state, ok := c.ChannelStatus(channel)
+	if !ok || state.Status != exp {
+		t.Errorf("%s: expect %v, got %v (%v)", channel, exp, state.Status, ok)
+	}
+	return state
+}
+
+func TestAutoJoin(t *testing.T) {
+	c := new(Client)
+	c.AddChannel("#a", "")
+	c.AddChannel("#b", "")
+	c.AddChannel("#Keyed", "sekrit")
+	server, r := registerJoins(t, c, "TARGMAX=PRIVMSG:4,JOIN:2")
+
+	// keys first, two at a time
+	for _, exp := range []string{"JOIN #Keyed,#a sekrit", "JOIN #b"} {
+		if m := readMessage(t, r); m.String() != exp {
+			t.Errorf("expect %s, got %q", exp, m)
+		}
+	}
+	expectStatus(t, c, "#keyed", JoinSent)
+
+	io.WriteString(server, ":bot!bot@host JOIN #keyed\r\n:bot!bot@host JOIN #a\r\n")
+	syncHandlers(t, server, r)
+	expectStatus(t, c, "#Keyed", Joined)
+	expectStatus(t, c, "#b", JoinSent)
+
+	// added once registered, joined straight away
+	c.AddChannel("#c", "")
+	if m := readMessage(t, r); m.String() != "JOIN #c" {
+		t.Errorf("expect JOIN #c, got %q", m)
+	}
+
+	c.RemoveChannel("#a")
+	if m := readMessage(t, r); m.String() != "PART #a" {
+		t.Errorf("expect PART #a, got %q", m)
+	}
+	if _, ok := c.ChannelStatus("#a"); ok {
+		t.Error("expect #a forgotten")
+	}
+	if states := c.Channels(); len(states) != 3 || states[0].Name != "#b" || states[2].Name != "#Keyed" {
+		t.Errorf("expect #b, #c and #Keyed, got %+v", states)
+	}
+}
+
+func TestAutoJoinRetry(t *testing.T) {
+	c := &Client{JoinRetry: 20 * time.Millisecond}
+	refused := make(chan *JoinError, 1)
+	c.JoinRefused = func(c *Client, err *JoinError) {
+		refused <- err
+	}
+	c.AddChannel("#banned", "")
+	c.AddChannel("#nonesuch", "")
+	server, r := registerJoins(t, c, "NETWORK=test")
+	readMessage(t, r)
+
+	io.WriteString(server, ":irc.test 474 bot #banned :Cannot join channel (+b)\r\n"+
+		":irc.test 403 bot #nonesuch :No such channel\r\n")
+	if err := <-refused; err.Channel != "#banned" || err.Code != "474" {
+		t.Errorf("expect JoinRefused for 474 on #banned, got %v", err)
+	}
+	if m := readMessage(t, r); m.String() != "JOIN #banned" {
+		t.Errorf("expect JOIN #banned retried, got %q", m)
+	}
+	state := expectStatus(t, c, "#banned", JoinSent)
+	if state.Attempts != 1 || state.Err == nil {
+		t.Errorf("expect one refusal recorded, got %+v", state)
+	}
+	state = expectStatus(t, c, "#nonesuch", JoinFailed)
+	if err, ok := state.Err.(*JoinError); !ok || err.Retryable() {
+		t.Errorf("expect permanent JoinError, got %v", state.Err)
+	}
+
+	// backing off
+	io.WriteString(server, ":irc.test 474 bot #banned :Cannot join channel (+b)\r\n")
+	<-refused
+	state = expectStatus(t, c, "#banned", JoinRetrying)
+	if wait := time.Until(state.Retry); wait < 20*time.Millisecond || wait > 40*time.Millisecond {
+		t.Errorf("expect retry in 40ms, got %v", wait)
+	}
+	if m := readMessage(t, r); m.String() != "JOIN #banned" {
+		t.Errorf("expect JOIN #banned retried, got %q", m)
+	}
+}
+
+func TestAutoJoinKick(t *testing.T) {
+	c := &Client{JoinRetry: 10 * time.Millisecond}
+	c.AddChannel("#chan", "")
+	server, r := registerJoins(t, c, "NETWORK=test")
+	readMessage(t, r)
+	io.WriteString(server, ":bot!bot@host JOIN #chan\r\n"+
+		":op!op@host KICK #chan someone :not you\r\n"+
+		":op!op@host KICK #chan bot :bye\r\n")
+	syncHandlers(t, server, r)
+	state := expectStatus(t, c, "#chan", Kicked)
+	if err, ok := state.Err.(*JoinError); !ok || err.Code != "KICK" || err.Reason != "bye" {
+		t.Errorf("expect kick recorded, got %v", state.Err)
+	}
+
+	c.RejoinOnKick = true
+	c.JoinChannels()
+	readMessage(t, r)
+	io.WriteString(server, ":bot!bot@host JOIN #chan\r\n:op!op@host KICK #chan bot :bye\r\n")
+	if m := readMessage(t, r); m.String() != "JOIN #chan" {
+		t.Errorf("expect rejoin, got %q", m)
+	}
+}
+
+func TestDeferJoin(t *testing.T) {
+	c := &Client{DeferJoin: true}
+	c.AddChannel("#chan", "")
+	server, r := registerJoins(t, c, "NETWORK=test")
+	syncHandlers(t, server, r)
+	expectStatus(t, c, "#chan", JoinWaiting)
+
+	c.JoinChannels()
+	if m := readMessage(t, r); m.String() != "JOIN #chan" {
+		t.Errorf("expect JOIN #chan, got %q", m)
+	}
+}
@@ -0,0 +1,150 @@
+package irc
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// maxHosts bounds how many users' hostmasks the client remembers.
+const maxHosts = 4096
+
+// A BanStyle is a way of making a ban mask from a user's hostmask.
+type BanStyle int
+
+const (
+	// BanHost bans the user's host: *!*@host.
+	BanHost BanStyle = iota
+
+	// BanUserHost bans the user's ident on their host: *!user@host.
+	BanUserHost
+
+	// BanUserDomain bans the user's ident anywhere in their domain, or
+	// their IP's network: *!user@*.domain, *!user@1.2.3.*.
+	BanUserDomain
+
+	// BanDomain bans their whole domain or network: *!*@*.domain.
+	BanDomain
+
+	// BanNick bans the nick alone: nick!*@*.
+	BanNick
+)
+
+// BanMask returns a mask that bans h in the given style. Idents that
+// weren't confirmed by identd, which servers mark with a leading ~, are
+// matched with or without it. Cloaked hosts, which hold a slash, aren't cut
+// down to a domain, since their parts don't mean one.
+func (h *Hostmask) BanMask(style BanStyle) string {
+	if style == BanNick {
+		return h.Nick + "!*@*"
+	}
+
+	user := "*"
+	if style == BanUserHost || style == BanUserDomain {
+		user = h.User
+		if strings.HasPrefix(user, "~") {
+			user = "*" + user[1:]
+		}
+		if user == "" {
+			user = "*"
+		}
+	}
+	host := h.Address
+	if style == BanUserDomain || style == BanDomain {
+		host = domainMask(host)
+	}
+	if host == "" {
+		host = "*"
+	}
+	return "*!" + user + "@" + host
+}
+
+// domainMask returns a mask for the domain or network host belongs to.
+func domainMask(host string) string {
+	if strings.Contains(host, "/") {
+		return host
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return host[:strings.LastIndexByte(host, '.')] + ".*"
+		}
+		// the /64 a host is normally given
+		groups := strings.SplitN(ip.String(), ":", 5)
+		if len(groups) == 5 && !strings.Contains(strings.Join(groups[:4], ":"), "::") {
+			return strings.Join(groups[:4], ":") + ":*"
+		}
+		return host
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) < 3 {
+		return host
+	}
+	return "*." + strings.Join(labels[1:], ".")
+}
+
+// BanMask returns a mask in the style of BanStyle for nick, from the last
+// hostmask the client saw them with, and false if it hasn't seen them.
+func (c *Client) BanMask(nick string) (string, bool) {
+	h, ok := c.UserHost(nick)
+	if !ok {
+		return "", false
+	}
+	return h.BanMask(c.BanStyle), true
+}
+
+// hostCache remembers the hostmasks of the users the client has seen
+// messages from, for making ban masks.
+type hostCache struct {
+	mu    sync.Mutex
+	hosts map[string]*Hostmask // by lower case nick
+}
+
+// UserHost returns the last hostmask the client saw nick with, and false
+// if it hasn't seen nick since connecting.
+func (c *Client) UserHost(nick string) (*Hostmask, bool) {
+	c.hosts.mu.Lock()
+	defer c.hosts.mu.Unlock()
+	h, ok := c.hosts.hosts[strings.ToLower(nick)]
+	return h, ok
+}
+
+// trackHost notes the hostmask m came from, following the user through
+// nick changes and forgetting them when they quit.
+func (c *Client) trackHost(m *Message) {
+	h := m.From
+	if h == nil || h.Nick == "" || h.User == "" || h.Address == "" {
+		return
+	}
+	hc := &c.hosts
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	key := strings.ToLower(h.Nick)
+	switch m.Command {
+	case "QUIT":
+		delete(hc.hosts, key)
+		return
+	case "NICK":
+		delete(hc.hosts, key)
+		renamed := *h
+		renamed.Nick = m.Param(0)
+		h, key = &renamed, strings.ToLower(renamed.Nick)
+	}
+	if hc.hosts == nil {
+		hc.hosts = make(map[string]*Hostmask)
+	}
+	if _, ok := hc.hosts[key]; !ok && len(hc.hosts) >= maxHosts {
+		// forget someone, whoever the map gives up first
+		for k := range hc.hosts {
+			delete(hc.hosts, k)
+			break
+		}
+	}
+	hc.hosts[key] = h
+}
+
+// resetHosts forgets the users seen on the last connection.
+func (c *Client) resetHosts() {
+	c.hosts.mu.Lock()
+	c.hosts.hosts = nil
+	c.hosts.mu.Unlock()
+}
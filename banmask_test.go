@@ -0,0 +1,51 @@
+package irc
+
+import (
+	"io"
+	"testing"
+)
+
+func TestBanMask(t *testing.T) {
+	table := []struct {
+		host  string
+		style BanStyle
+		exp   string
+	}{
+		{"nick!~ident@host.example.com", BanHost, "*!*@host.example.com"},
+		{"nick!~ident@host.example.com", BanUserHost, "*!*ident@host.example.com"},
+		{"nick!ident@host.example.com", BanUserDomain, "*!ident@*.example.com"},
+		{"nick!ident@example.com", BanDomain, "*!*@example.com"},
+		{"nick!ident@203.0.113.7", BanDomain, "*!*@203.0.113.*"},
+		{"nick!ident@2001:db8:1:2:3:4:5:6", BanUserDomain, "*!ident@2001:db8:1:2:*"},
+		{"nick!ident@user/nick/x-1234", BanDomain, "*!*@user/nick/x-1234"},
+		{"nick!ident@host.example.com", BanNick, "nick!*@*"},
+	}
+	for _, test := range table {
+		h, err := ParseHostmask(test.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mask := h.BanMask(test.style); mask != test.exp {
+			t.Errorf("%s in style %d: expect %q, got %q", test.host, test.style, test.exp, mask)
+		}
+	}
+}
+
+func TestUserHost(t *testing.T) {
+	c := &Client{BanStyle: BanUserDomain}
+	server, r := registerJoins(t, c, "NETWORK=test")
+	io.WriteString(server, ":alice!~al@a.example.com PRIVMSG #chan :hi\r\n"+
+		":alice!~al@a.example.com NICK alicia\r\n"+
+		":bob!bob@b.example.com QUIT :bye\r\n")
+	syncHandlers(t, server, r)
+
+	if _, ok := c.UserHost("alice"); ok {
+		t.Error("expect alice forgotten after the nick change")
+	}
+	if mask, ok := c.BanMask("Alicia"); mask != "*!*al@*.example.com" {
+		t.Errorf("expect alicia's mask, got %q (%v)", mask, ok)
+	}
+	if _, ok := c.UserHost("bob"); ok {
+		t.Error("expect bob forgotten after quitting")
+	}
+}
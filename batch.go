@@ -0,0 +1,93 @@
+package irc
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// batch is an open IRCv3 batch: a group of messages the server marks with
+// a batch tag between BATCH +id and BATCH -id.
+type batch struct {
+	typ    string
+	params []string
+	parent *batch
+	label  string     // of the request a labeled-response batch answers
+	msgs   []*Message // collected, for batches that aren't dispatched live
+}
+
+// history returns the chathistory batch b is, or is nested in, if any.
+// Messages in it are held back from handlers until it ends, rather than
+// dispatched as they arrive, so that they aren't mistaken for live traffic.
+func (b *batch) history() *batch {
+	for ; b != nil; b = b.parent {
+		if b.typ == "chathistory" {
+			return b
+		}
+	}
+	return nil
+}
+
+// labeled returns the label of the request b answers, from b or the
+// labeled-response batch it is part of.
+func (b *batch) labeled() string {
+	for ; b != nil; b = b.parent {
+		if b.label != "" {
+			return b.label
+		}
+	}
+	return ""
+}
+
+// handleBatch opens or closes a batch:
+//
+//	BATCH +<id> <type> [params...]
+//	BATCH -<id>
+//
+// Batches are only touched by the receive goroutine, so need no locking.
+func (c *Client) handleBatch(m *Message) {
+	ref := m.Param(0)
+	if len(ref) < 2 {
+		return
+	}
+	id := ref[1:]
+
+	switch ref[0] {
+	case '+':
+		all := m.AllParams()
+		b := &batch{
+			typ:    strings.ToLower(m.Param(1)),
+			parent: c.batches[m.Tags["batch"]],
+			label:  m.Tags["label"],
+		}
+		if len(all) > 2 {
+			b.params = all[2:]
+		}
+		c.batches[id] = b
+
+	case '-':
+		b, ok := c.batches[id]
+		if !ok {
+			c.logger().Debug("irc: end of unknown batch", slog.String("batch", id))
+			return
+		}
+		delete(c.batches, id)
+		if b.typ == "chathistory" && len(b.params) > 0 {
+			c.historyDone(b.labeled(), b.params[0], b.msgs)
+		}
+	}
+}
+
+// collect holds m back if it belongs to a chathistory batch, and reports
+// whether it did.
+func (c *Client) collect(m *Message) bool {
+	id, ok := m.Tags["batch"]
+	if !ok || m.Command == "BATCH" {
+		return false
+	}
+	b := c.batches[id].history()
+	if b == nil {
+		return false
+	}
+	b.msgs = append(b.msgs, m)
+	return true
+}
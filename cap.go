@@ -0,0 +1,134 @@
+package irc
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// builtinCaps are the IRCv3 capabilities the client requests whenever the
+// server offers them, because it makes use of them itself.
+var builtinCaps = []string{"server-time", "batch", "message-tags", "draft/chathistory", "chathistory", "echo-message", "labeled-response"}
+
+// capState tracks IRCv3 capability negotiation.
+type capState struct {
+	mu          sync.Mutex
+	offered     map[string]string // name to value, from CAP LS and NEW
+	enabled     map[string]bool
+	negotiating bool // CAP END is still owed to the server
+}
+
+func newCapState() *capState {
+	return &capState{
+		offered: make(map[string]string),
+		enabled: make(map[string]bool),
+	}
+}
+
+// CapEnabled reports whether the server has acknowledged the capability
+// name on the current connection.
+func (c *Client) CapEnabled(name string) bool {
+	if c.capState == nil {
+		return false
+	}
+	c.capState.mu.Lock()
+	defer c.capState.mu.Unlock()
+	return c.capState.enabled[name]
+}
+
+// startCaps begins capability negotiation. The server holds registration
+// until CAP END; one that doesn't know CAP answers 421, which is ignored, and
+// carries on registering.
+func (c *Client) startCaps() {
+	c.capState.mu.Lock()
+	c.capState.negotiating = true
+	c.capState.mu.Unlock()
+	c.Command("CAP", []string{"LS", "302"})
+}
+
+// wanted returns the capabilities the client should request out of
+// offered, in the order they are asked for: builtinCaps, then Client.Caps.
+func (c *Client) wanted(offered map[string]string, enabled map[string]bool) []string {
+	var req []string
+	for _, caps := range [][]string{builtinCaps, c.Caps} {
+		for _, name := range caps {
+			if _, ok := offered[name]; ok && !enabled[name] && !slices.Contains(req, name) {
+				req = append(req, name)
+			}
+		}
+	}
+	return req
+}
+
+// handleCap follows the server's side of capability negotiation:
+//
+//	CAP * LS [*] :name[=value] ...
+//	CAP <nick> ACK|NAK :name ...
+//	CAP <nick> NEW|DEL :name ...
+func (c *Client) handleCap(m *Message) {
+	s := c.capState
+	list := strings.Fields(m.LastParam())
+
+	s.mu.Lock()
+	var req []string
+	switch strings.ToUpper(m.Param(1)) {
+	case "LS":
+		for _, cap := range list {
+			name, value, _ := strings.Cut(cap, "=")
+			s.offered[name] = value
+		}
+		if m.NumParams() > 3 && m.Param(2) == "*" {
+			// more of the reply to come
+			s.mu.Unlock()
+			return
+		}
+		req = c.wanted(s.offered, s.enabled)
+
+	case "NEW":
+		added := make(map[string]string, len(list))
+		for _, cap := range list {
+			name, value, _ := strings.Cut(cap, "=")
+			s.offered[name] = value
+			added[name] = value
+		}
+		req = c.wanted(added, s.enabled)
+
+	case "ACK":
+		for _, name := range list {
+			if strings.HasPrefix(name, "-") {
+				delete(s.enabled, name[1:])
+			} else {
+				s.enabled[name] = true
+			}
+		}
+
+	case "DEL":
+		for _, name := range list {
+			delete(s.offered, name)
+			delete(s.enabled, name)
+		}
+		s.mu.Unlock()
+		return
+
+	case "NAK":
+
+	default:
+		s.mu.Unlock()
+		return
+	}
+
+	// after LS, request what we want, or finish if there's nothing; after
+	// the ACK or NAK of that request, finish
+	end := s.negotiating && len(req) == 0
+	if end {
+		s.negotiating = false
+	}
+	s.mu.Unlock()
+
+	if len(req) > 0 {
+		c.Command("CAP", []string{"REQ"}, strings.Join(req, " "))
+	}
+	if end {
+		c.Command("CAP", []string{"END"})
+	}
+}
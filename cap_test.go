@@ -0,0 +1,135 @@
+package irc
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCapNegotiation(t *testing.T) {
+	// no flood control, as the exchange is more than the burst allows
+	c := &Client{Nick: "bot", User: "bot", Caps: []string{"echo-message", "batch"}, Flood: &FloodProfile{Window: time.Hour}}
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	io.WriteString(server, ":irc.test CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL server-time\r\n")
+	io.WriteString(server, ":irc.test CAP * LS :echo-message away-notify\r\n")
+	if m := readMessage(t, r); m.String() != "CAP REQ :server-time echo-message" {
+		t.Errorf("expect CAP REQ for wanted caps, got %q", m)
+	}
+	io.WriteString(server, ":irc.test CAP bot ACK :server-time echo-message\r\n")
+	if m := readMessage(t, r); m.String() != "CAP END" {
+		t.Errorf("expect CAP END, got %q", m)
+	}
+
+	// server-time stays enabled, echo-message is withdrawn
+	io.WriteString(server, ":irc.test CAP bot DEL :echo-message\r\n")
+	io.WriteString(server, ":irc.test CAP bot NEW :batch\r\n")
+	if m := readMessage(t, r); m.String() != "CAP REQ :batch" {
+		t.Errorf("expect CAP REQ for new cap, got %q", m)
+	}
+	io.WriteString(server, ":irc.test CAP bot ACK :batch\r\n")
+
+	// handlers run in order, so once the PING is answered the ACK is in
+	io.WriteString(server, "PING :sync\r\n")
+	readMessage(t, r)
+
+	for name, enabled := range map[string]bool{"server-time": true, "echo-message": false, "batch": true, "sasl": false} {
+		if c.CapEnabled(name) != enabled {
+			t.Errorf("expect CapEnabled(%q) = %t", name, enabled)
+		}
+	}
+}
+
+func TestCapNothingWanted(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	io.WriteString(server, ":irc.test CAP * LS :sasl\r\n")
+	if m := readMessage(t, r); m.String() != "CAP END" {
+		t.Errorf("expect CAP END, got %q", m)
+	}
+}
+
+func TestCapNAK(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	io.WriteString(server, ":irc.test CAP * LS :server-time\r\n")
+	readMessage(t, r)
+	io.WriteString(server, ":irc.test CAP * NAK :server-time\r\n")
+	if m := readMessage(t, r); m.String() != "CAP END" {
+		t.Errorf("expect CAP END, got %q", m)
+	}
+	if c.CapEnabled("server-time") {
+		t.Error("expect server-time disabled after NAK")
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	table := []struct {
+		source  TimeSource
+		enable  bool
+		expServ bool
+	}{
+		{TimeServer, true, true},
+		{TimeServer, false, false},
+		{TimeReceived, true, false},
+	}
+
+	for _, test := range table {
+		c := &Client{Nick: "bot", User: "bot", TimeSource: test.source}
+		got := make(chan *Message, 1)
+		c.HandleFunc("PRIVMSG", func(c *Client, m *Message) {
+			got <- m
+		})
+		server, r := connectPipe(t, c)
+
+		if test.enable {
+			io.WriteString(server, ":irc.test CAP * LS :server-time\r\n")
+			readMessage(t, r)
+			io.WriteString(server, ":irc.test CAP * ACK :server-time\r\n")
+		} else {
+			io.WriteString(server, ":irc.test CAP * LS :\r\n")
+		}
+		readMessage(t, r)
+
+		before := time.Now()
+		io.WriteString(server, "@time=2011-10-19T16:40:51.620Z :a!b@c PRIVMSG #chan :history\r\n")
+		m := <-got
+		c.Close()
+
+		if m.Received.Before(before) || time.Since(m.Received) > time.Second {
+			t.Errorf("%+v: bad receive time %v", test, m.Received)
+		}
+		sent := time.Date(2011, 10, 19, 16, 40, 51, 620e6, time.UTC)
+		if test.expServ && !m.Time.Equal(sent) {
+			t.Errorf("%+v: expect server time %v, got %v", test, sent, m.Time)
+		}
+		if !test.expServ && !m.Time.Equal(m.Received) {
+			t.Errorf("%+v: expect receive time %v, got %v", test, m.Received, m.Time)
+		}
+	}
+}
+
+// connectCaps connects c to a pipe and has the server offer caps, a space
+// separated list, and grant whatever c requests of them. Flood control is
+// off, as tests exchange more than the burst allows.
+func connectCaps(t *testing.T, c *Client, caps string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c.Flood = &FloodProfile{Window: time.Hour}
+	server, r := connectPipe(t, c)
+	t.Cleanup(func() { c.Close() })
+
+	io.WriteString(server, ":irc.test CAP * LS :"+caps+"\r\n")
+	req := readMessage(t, r)
+	io.WriteString(server, ":irc.test CAP bot ACK :"+req.LastParam()+"\r\n")
+	if m := readMessage(t, r); m.String() != "CAP END" {
+		t.Fatalf("expect CAP END, got %q", m)
+	}
+	return server, r
+}
@@ -1,15 +1,14 @@
 package irc
 
 import (
-	"bufio"
+	"context"
 	"crypto/tls"
-	"fmt"
-	"io"
-	"log"
-	"math/rand"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -19,34 +18,192 @@ import (
 
 // Client contains all of the state required by an event-driven IRC client.
 type Client struct {
-	Addr        string
-	Nick        string
-	User        string
-	Realname    string
-	Pass        string
-	Secure      bool // true to attempt TLS
-	Verbose     bool
+	Addr string
+
+	// Nick is the nick the client registers with. If the server refuses
+	// it, NickStrategy picks another to use meanwhile, CurrentNick returns
+	// that, and the client tries to regain Nick once registered.
+	Nick string
+
+	User     string
+	Realname string
+	Pass     string
+	Secure   bool // true to attempt TLS over the dialed connection
+	Verbose  bool // log raw traffic at info rather than debug level
+
+	// PingTimeout is how long the link may be quiet before the client pings
+	// the server, and how long it then waits for the PONG. Zero disables
+	// pinging.
 	PingTimeout time.Duration
 
+	// MaxLag, if non-zero, makes Run return ErrLagged when a measured round
+	// trip to the server exceeds it, so that the caller can reconnect.
+	MaxLag time.Duration
+
+	// QuitTimeout bounds how long Quit waits for the send queue to drain and
+	// the server to close the link. If zero, DefaultQuitTimeout is used.
+	QuitTimeout time.Duration
+
+	// WriteTimeout bounds each write to the connection. A write that
+	// doesn't complete in time fails the connection. If zero,
+	// DefaultWriteTimeout is used.
+	WriteTimeout time.Duration
+
+	// MaxQueue, if non-zero, limits how many messages may wait in the send
+	// queue for any one target. Further sends to it are dropped with
+	// ErrQueueFull until it drains.
+	MaxQueue int
+
+	// MaxLineLength is the longest line accepted from the server. Longer
+	// lines are discarded. If zero, DefaultMaxLineLength is used.
+	MaxLineLength int
+
+	// Encoding decodes lines from the server that aren't valid UTF-8, for
+	// networks where clients commonly send Latin1 or Windows1252. If nil,
+	// invalid bytes are replaced with U+FFFD.
+	Encoding Encoding
+
+	// Flood sets the flood control profile sends are paced by. If nil, the
+	// profile is picked from the server's version once it is known, see
+	// DetectFloodProfile.
+	Flood *FloodProfile
+
+	// Logger receives the client's log output. If nil, slog.Default() is
+	// used. Raw traffic is logged at debug level with credentials redacted.
+	Logger *slog.Logger
+
+	// Caps lists IRCv3 capabilities to request if the server offers them,
+	// besides the ones the client requests for its own use, such as
+	// server-time. CapEnabled reports which were granted.
+	Caps []string
+
+	// TimeSource selects which time handlers see as Message.Time. By default
+	// it's the time the server says a message was sent, where the
+	// server-time capability provides it.
+	TimeSource TimeSource
+
+	// Backfill, if non-zero, makes the client catch up on channels it
+	// rejoins, say after reconnecting: up to Backfill messages sent since
+	// the last one it saw there are fetched with CHATHISTORY and dispatched
+	// to EventBackfill handlers. It needs a server that offers chathistory
+	// and tags messages with msgids.
+	Backfill int
+
+	// DispatchEcho makes the messages the server echoes back to the client,
+	// with echo-message, go to the handlers for their command as well as
+	// to EventEcho handlers, as if someone else had sent them.
+	DispatchEcho bool
+
+	// ISONInterval is how often users given to Watch are polled with ISON
+	// when the server can't MONITOR them. If zero, DefaultISONInterval is
+	// used.
+	ISONInterval time.Duration
+
+	// NickStrategy picks the nicks to try while registering when the server
+	// refuses Nick. If nil, NickFallback{} is used.
+	NickStrategy NickStrategy
+
+	// RegainInterval is how often the client tries for Nick when it had to
+	// register with another and the server can't MONITOR Nick to say when
+	// it's free. If zero, DefaultRegainInterval is used; if negative, the
+	// client keeps whatever nick it registered with.
+	RegainInterval time.Duration
+
+	// Reclaim, if set, is called once registration is complete with a nick
+	// other than Nick, to have services free it, for example:
+	//
+	//	c.Reclaim = func(c *irc.Client, nick string) {
+	//		c.PRIVMSG("NickServ", "REGAIN "+nick+" "+password)
+	//	}
+	//
+	// The client takes the nick itself once it's free, unless services
+	// change it as part of the command, as REGAIN does.
+	Reclaim func(c *Client, nick string)
+
+	// DeferJoin stops the client joining the channels given to AddChannel
+	// as soon as registration completes. They are joined when JoinChannels
+	// is called instead, for example once services have identified the
+	// client.
+	DeferJoin bool
+
+	// JoinRetry is how long the client waits to retry a channel that
+	// refused it for a reason that may pass, see JoinError.Retryable. Each
+	// refusal in a row doubles the wait, up to MaxJoinRetry. If zero,
+	// DefaultJoinRetry is used; if negative, such channels aren't retried.
+	JoinRetry time.Duration
+
+	// RejoinOnKick makes the client rejoin channels given to AddChannel
+	// that it's kicked from, waiting as for JoinRetry.
+	RejoinOnKick bool
+
+	// JoinRefused, if set, is called when a channel refuses the client for
+	// a reason that may pass, before it retries, to have services invite
+	// or unban it, for example.
+	JoinRefused func(c *Client, err *JoinError)
+
+	// BanStyle is the style of the masks BanMask makes.
+	BanStyle BanStyle
+
+	// Dialer makes the connection to Addr. If nil, a plain TCP connection is
+	// made. Dialers that already encrypt the link, such as a wss://
+	// transport.WebSocket, should be used with Secure unset.
+	Dialer Dialer
+
 	conn net.Conn
 
-	send     chan *Message
+	send     *sendQueue
 	recv     chan *Message
-	ping     chan *Message
+	pong     chan time.Duration
 	err      chan error
 	die      chan struct{}
+	recvDone chan struct{} // closed when recvLoop exits
 	handlers map[string][]Handler
-	l        *ratelimit.Limiter
-
-	chans []*Channel
-	caps  map[string]string
+	l        *ratelimit.Penalty
+	lag      *lagMonitor
+	capState *capState
+	batches  map[string]*batch
+	hist     historyState
+	echoes   echoTracker
+	presence presence
+	nick     nickState
+	joins    joinState
+	lists    listState
+	hosts    hostCache
+
+	wg        sync.WaitGroup // the connection's goroutines
+	closeOnce *sync.Once
+	quitting  atomic.Bool
+	defaults  bool // defaultHandlers have been stacked
+
+	detectedFlood atomic.Pointer[FloodProfile]
+	labels        atomic.Uint64 // the last label given to a request
+
+	chans  []*Channel
+	caps   map[string]string
+	capsMu sync.RWMutex // guards writes to caps, and reads off the recv goroutine
 }
 
+const (
+	// DefaultQuitTimeout is used by Quit when Client.QuitTimeout is zero.
+	DefaultQuitTimeout = 10 * time.Second
+
+	// DefaultWriteTimeout is used when Client.WriteTimeout is zero.
+	DefaultWriteTimeout = 30 * time.Second
+)
+
 var (
-	errEmptyNick = errors.New("irc: cannot use empty nick")
-	errEmptyUser = errors.New("irc: cannot use empty username")
+	errEmptyNick   = errors.New("irc: cannot use empty nick")
+	errEmptyUser   = errors.New("irc: cannot use empty username")
+	errQuitTimeout = errors.New("irc: timed out waiting for server to close link")
+	errFlushQueue  = errors.New("irc: timed out flushing send queue")
 )
 
+// outgoing is a message waiting in the send queue.
+type outgoing struct {
+	m *Message
+	d *Delivery
+}
+
 // Connect logs c into the configured host.
 func (c *Client) Connect() error {
 	if c.Nick == "" {
@@ -56,14 +213,33 @@ func (c *Client) Connect() error {
 		return errEmptyUser
 	}
 
-	c.send = make(chan *Message, 10)
+	c.send = newSendQueue()
 	c.recv = make(chan *Message, 10)
-	c.ping = make(chan *Message)
-	c.err = make(chan error)
+	c.pong = make(chan time.Duration, 1)
+	c.err = make(chan error, 1) // so recvLoop can fail before Run is called
 	c.die = make(chan struct{})
-	c.l = ratelimit.New(time.Second, 4)
-
-	c.Stack(defaultHandlers)
+	c.recvDone = make(chan struct{})
+	c.detectedFlood.Store(nil)
+	c.l = ratelimit.NewPenalty(c.floodProfile().Window)
+	c.lag = new(lagMonitor)
+	c.capState = newCapState()
+	c.batches = make(map[string]*batch)
+	c.hist.reset()
+	c.echoes.reset(ErrClosed)
+	c.resetPresence()
+	c.resetNick()
+	c.resetJoins()
+	c.resetHosts()
+	c.lists.reset(ErrClosed)
+	c.conn = nil
+	c.closeOnce = new(sync.Once)
+	c.quitting.Store(false)
+
+	// handlers persist across reconnects
+	if !c.defaults {
+		c.Stack(defaultHandlers)
+		c.defaults = true
+	}
 
 	return c.connect()
 }
@@ -74,7 +250,7 @@ func (c *Client) connect() error {
 		err  error
 	)
 
-	conn, err = net.Dial("tcp", c.Addr)
+	conn, err = c.dialer().Dial("tcp", c.Addr)
 	if err != nil {
 		return err
 	}
@@ -85,6 +261,7 @@ func (c *Client) connect() error {
 		tlsConn := tls.Client(conn, &tlsConf)
 		err = tlsConn.Handshake()
 		if err != nil {
+			conn.Close()
 			return err
 		}
 
@@ -95,16 +272,24 @@ func (c *Client) connect() error {
 
 	firstLineCh := make(chan struct{})
 
+	c.wg.Add(2)
 	go c.recvLoop(firstLineCh)
 	go c.sendLoop()
 	if c.PingTimeout != 0 {
+		c.wg.Add(1)
 		go c.pingLoop()
 	}
 
 	// wait until we recieve the first data from the server to begin sending
 	// commands
-	<-firstLineCh
+	select {
+	case <-firstLineCh:
+	case <-c.recvDone:
+		c.Close()
+		return errors.New("irc: connection closed before registration")
+	}
 
+	c.startCaps()
 	if c.Pass != "" {
 		c.PASS(c.Pass)
 	}
@@ -116,93 +301,169 @@ func (c *Client) connect() error {
 
 // recvLoop processes all network reads and handles incoming events.
 func (c *Client) recvLoop(firstLineCh chan struct{}) {
-	s := bufio.NewScanner(c.conn)
+	defer c.wg.Done()
+	defer close(c.recvDone)
+
+	lr := newLineReader(c.conn, c.MaxLineLength)
 	for {
 		select {
 		case <-c.die:
 			return
 
 		default:
-			if !s.Scan() {
-				return
+			b, err := lr.readLine()
+			if err == ErrLineTooLong {
+				c.logger().Warn("irc: discarded overlong line", slog.String("dir", "in"))
+				continue
 			}
-			if err := s.Err(); err != nil {
-				c.err <- errors.Wrap(err, "recvLoop")
-				break
+			if err != nil {
+				if !c.quitting.Load() {
+					c.fail(errors.Wrap(err, "recvLoop"))
+				}
+				return
 			}
 			if firstLineCh != nil {
 				close(firstLineCh)
 				firstLineCh = nil
 			}
 
-			line := s.Text()
-			if c.Verbose {
-				log.Println("<<", line)
+			line := c.decodeLine(b)
+			now := time.Now()
+			c.lag.received(now)
+			m, err := ParseMessage(line, now)
+			if err == nil {
+				c.stamp(m, now)
 			}
-
-			m, err := ParseMessage(line, time.Now())
 			if err != nil {
-				log.Print("irc: client recv: %v", err)
+				c.logger().Warn("irc: malformed message", slog.String("dir", "in"), errAttr(err))
+				c.logger().Debug("irc: malformed message",
+					slog.String("dir", "in"),
+					slog.String("line", redactLine(line)))
 				continue
 			}
-
-			if handlers, ok := c.handlers[m.Command]; ok {
-				for _, h := range handlers {
-					h.HandleIRC(c, m)
-				}
-			} else {
-				log.Print("unhandled msg: ", m)
+			c.logTraffic("in", m)
+			c.trackHost(m)
+			if c.collect(m) {
+				continue
 			}
+			if c.echo(m) {
+				c.seen(m)
+				continue
+			}
+			c.dispatch(m)
+			c.seen(m)
 		}
 	}
 }
 
+// registered sets up what waits on registration, once the server has
+// finished welcoming the client with the MOTD.
+func (c *Client) registered() {
+	if !c.startPresence() {
+		// the MOTD was asked for again
+		return
+	}
+	c.startRegain()
+	c.startJoins()
+}
+
+// A TimeSource selects the time the client gives messages as Message.Time.
+type TimeSource int
+
+const (
+	// TimeServer uses the time from the server-time tag when the
+	// capability is enabled and the server sent one, so that history played
+	// back by a bouncer keeps its original times, and the receive time
+	// otherwise.
+	TimeServer TimeSource = iota
+
+	// TimeReceived always uses the time the client read the message.
+	TimeReceived
+)
+
+// stamp sets the times of m, which was read at received.
+func (c *Client) stamp(m *Message, received time.Time) {
+	m.Received = received
+	m.Time = received
+	if c.TimeSource != TimeServer || !c.CapEnabled("server-time") {
+		return
+	}
+	if t, ok := m.ServerTime(); ok {
+		m.Time = t
+	}
+}
+
 // sendLoop gates all sends so chunks don't get interleaved accidentally when
-// doing concurrent handlers. We can also do rate limiting here.
+// doing concurrent handlers. Messages are taken from the send queue in
+// priority and per-target order and paced by the flood control profile.
 func (c *Client) sendLoop() {
+	defer c.wg.Done()
+
 	for {
-		select {
-		case <-c.die:
-			return
-		default:
-			c.l.GrabTicket()
-			m := <-c.send
-			s := m.String()
-			if c.Verbose {
-				log.Println(">>", s)
+		o := c.send.pop()
+		if o == nil {
+			select {
+			case <-c.die:
+				return
+			case <-c.send.ready:
+				continue
 			}
-			io.WriteString(c.conn, s+"\r\n")
 		}
-	}
-}
 
-func (c *Client) pingLoop() {
-	t := time.NewTicker(c.PingTimeout)
+		if c.l.Wait(context.Background(), c.floodProfile().Cost(o.m)) != nil {
+			// stopped by Close
+			o.d.complete(ErrClosed)
+			c.send.finish()
+			return
+		}
 
-	for {
-		select {
-		case <-c.die:
+		echo := c.expectEcho(o)
+		c.isonSent(o.m)
+		c.modeSent(o.m)
+		c.logTraffic("out", o.m)
+		timeout := c.WriteTimeout
+		if timeout == 0 {
+			timeout = DefaultWriteTimeout
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(timeout))
+		_, err := o.m.WriteTo(c.conn)
+		if err != nil {
+			err = errors.Wrap(err, "sendLoop")
+		}
+		if err != nil && echo != nil {
+			c.echoes.remove(echo)
+		}
+		o.d.complete(err)
+		c.send.finish()
+
+		if err != nil {
+			c.fail(err)
 			return
-		case <-t.C:
-			r := fmt.Sprintf("%8X", rand.Int63())
-			log.Print("sending ping: ", r)
-			c.Command("PING", []string{r})
-			select {
-			case <-time.After(c.PingTimeout):
-				c.err <- errors.Errorf("ping timeout (%d seconds)", c.PingTimeout/time.Second)
-
-			case m := <-c.ping:
-				log.Printf("got ping %q", m.Trailing)
-				if m.Trailing != r {
-					c.err <- errors.Errorf("server ping failure: sent %q, got %q", r, m.Trailing)
-				} else {
-					log.Print("got successful pong ", m.Trailing)
-				}
-			}
 		}
 	}
 }
 
+// enqueue queues m for sending. The returned Delivery reports whether it
+// was written; a message that fails Validate is never queued.
+func (c *Client) enqueue(m *Message) *Delivery {
+	select {
+	case <-c.die:
+		return failedDelivery(ErrClosed)
+	default:
+	}
+	m.normalize()
+	c.labelEcho(m)
+	if err := m.Validate(); err != nil {
+		c.logger().Warn("irc: refusing to send invalid message", slog.String("command", m.Command), errAttr(err))
+		return failedDelivery(err)
+	}
+	o := &outgoing{m, newDelivery()}
+	if !c.send.push(o, c.MaxQueue) {
+		o.d.complete(ErrQueueFull)
+	}
+	return o.d
+}
+
 // Handle adds a Handler to run when `cmd` is received.
 func (c *Client) Handle(cmd string, h Handler) {
 	if c.handlers == nil {
@@ -221,7 +482,8 @@ func (c *Client) HandleFunc(cmd string, handler HandlerFunc) {
 	c.Handle(cmd, handler)
 }
 
-// Run handles events and blocks until the connection is closed
+// Run handles events and blocks until the connection is closed. It returns
+// nil if the client was shut down with Quit or Close, or on interrupt.
 func (c *Client) Run() error {
 	var (
 		ch  = make(chan os.Signal, 1)
@@ -229,21 +491,118 @@ func (c *Client) Run() error {
 	)
 
 	signal.Notify(ch, os.Interrupt)
-	defer c.conn.Close()
+	defer signal.Stop(ch)
 
 	select {
 	case err = <-c.err:
-		log.Print("caught error: ", err)
+		c.logger().Error("irc: connection error", errAttr(err))
+		c.Close()
 	case sig := <-ch:
-		log.Print("caught signal: ", sig)
+		c.logger().Info("irc: caught signal", slog.String("signal", sig.String()))
+		c.Quit("")
+	case <-c.die:
+		c.Close()
+	}
+
+	return err
+}
+
+// Quit waits for every message already queued to be written, sends QUIT
+// with the given reason, waits for the server to close the link, and then shuts
+// the client down as Close does. Both waits together are bounded by
+// QuitTimeout; if it expires the connection is closed anyway and an error
+// is returned.
+//
+// Quit must not be called from a Handler, since it waits for the goroutine
+// running handlers to exit. Call it in a new goroutine instead.
+func (c *Client) Quit(reason string) error {
+	if c.conn == nil {
+		// never connected, or Connect failed
+		return c.Close()
 	}
+	c.quitting.Store(true)
 
-	log.Print("quitting Run")
+	timeout := c.QuitTimeout
+	if timeout == 0 {
+		timeout = DefaultQuitTimeout
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	m := &Message{Command: "QUIT"}
+	if reason != "" {
+		m.Trailing = reason
+	}
 
-	close(c.die)
+	// QUIT is a priority message, so wait for the rest of the queue first
+	var err error
+	select {
+	case <-c.send.whenIdle():
+	case <-c.recvDone:
+	case <-c.die:
+	case <-deadline.C:
+		err = errFlushQueue
+	}
+
+	if err == nil {
+		select {
+		case <-c.enqueue(m).Done():
+			select {
+			case <-c.recvDone:
+			case <-deadline.C:
+				err = errQuitTimeout
+			}
+		case <-c.recvDone:
+		case <-deadline.C:
+			err = errFlushQueue
+		}
+	}
+
+	c.Close()
 	return err
 }
 
+// Close immediately shuts the client down without sending QUIT: queued
+// messages are discarded, the connection is closed and Close returns once
+// all of the client's goroutines have exited. It is safe to call more than
+// once, and on a client whose Connect failed or was never called. Like
+// Quit, it must not be called from a Handler.
+func (c *Client) Close() error {
+	if c.closeOnce == nil {
+		// never connected
+		return nil
+	}
+
+	var err error
+	c.closeOnce.Do(func() {
+		c.quitting.Store(true)
+		close(c.die)
+		c.l.Stop()
+		if c.conn != nil {
+			err = c.conn.Close()
+		}
+	})
+	c.wg.Wait()
+
+	// anything still queued will never be written
+	for _, o := range c.send.drain() {
+		o.d.complete(ErrClosed)
+	}
+	c.echoes.reset(ErrClosed)
+	c.resetJoins()
+	c.lists.reset(ErrClosed)
+	return err
+}
+
+// fail reports a fatal connection error to Run. It gives up if the client
+// is already shutting down, so callers never block forever.
+func (c *Client) fail(err error) {
+	select {
+	case c.err <- err:
+	case <-c.die:
+	}
+}
+
 // Stack appends handlers from hs to c.
 func (c *Client) Stack(hs HandlerSet) {
 	for k, v := range hs {
@@ -261,3 +620,12 @@ func (c *Client) chanByName(name string) *Channel {
 	}
 	return nil
 }
+
+// ISupport returns the value the server gave token in RPL_ISUPPORT, and
+// whether it gave the token at all.
+func (c *Client) ISupport(token string) (string, bool) {
+	c.capsMu.RLock()
+	defer c.capsMu.RUnlock()
+	v, ok := c.caps[token]
+	return v, ok
+}
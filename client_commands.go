@@ -1,54 +1,58 @@
 package irc
 
 import (
-	"log"
+	"log/slog"
 	"strconv"
 	"strings"
 )
 
 // SendRaw sends a raw command string to the remote server.
-func (c *Client) SendRaw(s string) {
+func (c *Client) SendRaw(s string) *Delivery {
 	m, err := ParseMessage(s)
 	if err != nil {
-		log.Printf("malformed command: %s (%v)", s, err)
-		return
+		c.logger().Warn("irc: malformed command", slog.String("dir", "out"), errAttr(err))
+		return failedDelivery(err)
 	}
 
-	c.send <- m
+	return c.enqueue(m)
 }
 
-// Command sends a well-formed command to the remote server.
-func (c *Client) Command(cmd string, params []string, trailing ...string) {
+// Command sends a well-formed command to the remote server. A last param
+// with spaces in it is sent as the trailing param. Params that would change
+// the meaning of the line, such as ones containing CR or LF, make the
+// returned Delivery fail with ErrInvalidMessage without anything being
+// sent; otherwise it reports whether the message was written or dropped.
+func (c *Client) Command(cmd string, params []string, trailing ...string) *Delivery {
 	m := &Message{
 		Command: cmd,
 		Params:  params,
 	}
 	if len(trailing) > 0 {
 		m.Trailing = strings.Join(trailing, " ")
+		m.HasTrailing = true
 	}
-	c.send <- m
+	return c.enqueue(m)
 }
 
-func (c *Client) PASS(pass string) {
-	c.Command("PASS", []string{pass})
+func (c *Client) PASS(pass string) *Delivery {
+	return c.Command("PASS", []string{pass})
 }
 
-func (c *Client) USER(user, realname string, modes int) {
-	c.Command("USER", []string{user, strconv.Itoa(modes), "*"}, realname)
+func (c *Client) USER(user, realname string, modes int) *Delivery {
+	return c.Command("USER", []string{user, strconv.Itoa(modes), "*"}, realname)
 }
 
-func (c *Client) NICK(nick string) {
-	c.Command("NICK", []string{nick})
+func (c *Client) NICK(nick string) *Delivery {
+	return c.Command("NICK", []string{nick})
 }
 
-func (c *Client) PRIVMSG(target, message string) {
-	c.Command("PRIVMSG", []string{target}, message)
+func (c *Client) PRIVMSG(target, message string) *Delivery {
+	return c.Command("PRIVMSG", []string{target}, message)
 }
 
-func (c *Client) JOIN(channel string, key ...string) {
+func (c *Client) JOIN(channel string, key ...string) *Delivery {
 	if len(key) > 0 {
-		c.Command("JOIN", []string{channel, key[0]})
-	} else {
-		c.Command("JOIN", []string{channel})
+		return c.Command("JOIN", []string{channel, key[0]})
 	}
+	return c.Command("JOIN", []string{channel})
 }
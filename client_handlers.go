@@ -1,7 +1,6 @@
 package irc
 
 import (
-	"log"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -12,46 +11,109 @@ type HandlerSet map[string]Handler
 var defaultHandlers = HandlerSet{
 	// server ping
 	"PING": HandlerFunc(func(c *Client, m *Message) {
-		var pingMessage string
-		if len(m.Params) > 0 {
-			pingMessage = m.Params[0]
-		} else {
-			pingMessage = m.Trailing
-		}
-		c.Command("PONG", []string{pingMessage})
+		c.Command("PONG", []string{m.Param(0)})
 	}),
 
 	"PONG": HandlerFunc(func(c *Client, m *Message) {
-		log.Print(m)
-		c.ping <- m
+		c.handlePong(m)
+	}),
+
+	// capability negotiation
+	"CAP": HandlerFunc(func(c *Client, m *Message) {
+		c.handleCap(m)
+	}),
+
+	// IRCv3 batches
+	"BATCH": HandlerFunc(func(c *Client, m *Message) {
+		c.handleBatch(m)
+	}),
+
+	// standard replies
+	"FAIL": HandlerFunc(func(c *Client, m *Message) {
+		if m.Param(0) == "CHATHISTORY" {
+			c.handleHistoryFail(m)
+		}
+	}),
+
+	// labeled request answered without an echo
+	"ACK": HandlerFunc(func(c *Client, m *Message) {
+		c.unechoed(m)
+	}),
+
+	// someone joined a channel
+	"JOIN": HandlerFunc(func(c *Client, m *Message) {
+		if m.From != nil && c.isMe(m.From.Nick) {
+			c.joined(m.Param(0))
+			c.backfill(m.Param(0), m)
+		}
+	}),
+
+	// someone left a channel
+	"PART": HandlerFunc(func(c *Client, m *Message) {
+		if m.From != nil && c.isMe(m.From.Nick) {
+			c.parted(m.Param(0))
+		}
+	}),
+
+	// someone was kicked from a channel
+	"KICK": HandlerFunc(func(c *Client, m *Message) {
+		if c.isMe(m.Param(1)) {
+			c.kicked(m)
+		}
 	}),
 
 	// disconnected by server
 	"ERROR": HandlerFunc(func(c *Client, m *Message) {
-		c.err <- errors.New("server error: " + m.Trailing)
+		if c.quitting.Load() {
+			// expected reply to our QUIT
+			return
+		}
+		c.fail(errors.New("server error: " + m.LastParam()))
 	}),
 
 	// someone's nick changed
 	"NICK": HandlerFunc(func(c *Client, m *Message) {
-		if m.From.Nick == c.Nick {
-			c.Nick = m.Trailing
+		if m.From == nil {
+			return
+		}
+		if c.isMe(m.From.Nick) {
+			c.setNick(m.Param(0))
+		} else {
+			c.nickFreed(m.From.Nick)
 		}
 	}),
 
+	// someone left
+	"QUIT": HandlerFunc(func(c *Client, m *Message) {
+		if m.From != nil {
+			c.nickFreed(m.From.Nick)
+		}
+	}),
+
+	// registered
+	"001": HandlerFunc(func(c *Client, m *Message) {
+		c.welcomed(m)
+	}),
+
 	// available modes
 	"004": HandlerFunc(func(c *Client, m *Message) {
-		// <server_name> <version> <user_modes> <chan_modes>
+		// <client> <server_name> <version> <user_modes> <chan_modes>
+		if len(m.Params) > 2 {
+			c.setServerVersion(m.Params[2])
+		}
 	}),
 
 	// server capabilities
 	"005": HandlerFunc(func(c *Client, m *Message) {
 		// http://www.irc.org/tech_docs/005.html
 
+		c.capsMu.Lock()
+		defer c.capsMu.Unlock()
 		if c.caps == nil {
 			c.caps = make(map[string]string, len(m.Params))
 		}
 		for _, param := range m.Params {
-			if param == c.Nick {
+			if c.isMe(param) {
 				continue
 			}
 
@@ -71,7 +133,7 @@ var defaultHandlers = HandlerSet{
 	// :server 353 <nick> = <chan> :<name> <name> <name> ...
 	"353": HandlerFunc(func(c *Client, m *Message) {
 		var (
-			chanName = m.Params[len(m.Params)-1]
+			chanName = m.Param(m.NumParams() - 2)
 			thisChan = c.chanByName(chanName)
 		)
 
@@ -83,7 +145,7 @@ var defaultHandlers = HandlerSet{
 			thisChan.namesChan = make(chan struct{})
 		}
 
-		names := strings.Fields(m.Trailing)
+		names := strings.Fields(m.LastParam())
 		users := make([]*Hostmask, len(names))
 		for i, name := range names {
 			name = strings.TrimLeft(name, c.caps["STATUSMSG"])
@@ -101,7 +163,7 @@ var defaultHandlers = HandlerSet{
 	// end of NAMES list
 	"366": HandlerFunc(func(c *Client, m *Message) {
 		var (
-			chanName = m.Params[len(m.Params)-1]
+			chanName = m.Param(1)
 			thisChan = c.chanByName(chanName)
 		)
 
@@ -111,9 +173,109 @@ var defaultHandlers = HandlerSet{
 		}
 	}),
 
-	// nickname already in use
+	// end of MOTD, or none: registration is complete
+	"376": HandlerFunc(func(c *Client, m *Message) {
+		c.registered()
+	}),
+	"422": HandlerFunc(func(c *Client, m *Message) {
+		c.registered()
+	}),
+
+	// ISON reply
+	"303": HandlerFunc(func(c *Client, m *Message) {
+		c.handleIson(m)
+	}),
+
+	// MONITOR online, offline, list full
+	"730": HandlerFunc(func(c *Client, m *Message) {
+		c.handleMonitor(m)
+	}),
+	"731": HandlerFunc(func(c *Client, m *Message) {
+		c.handleMonitor(m)
+	}),
+	"734": HandlerFunc(func(c *Client, m *Message) {
+		c.handleMonitor(m)
+	}),
+
+	// no such nick, no such channel, cannot send to channel
+	"401": HandlerFunc(func(c *Client, m *Message) {
+		c.rejected(m)
+	}),
+	"403": HandlerFunc(func(c *Client, m *Message) {
+		c.rejected(m)
+		c.joinRefused(m)
+		c.listRefused(m)
+	}),
+	"404": HandlerFunc(func(c *Client, m *Message) {
+		c.rejected(m)
+	}),
+
+	// channel refused: too many channels, full, invite only, banned, bad
+	// key, bad name, account required
+	"405": HandlerFunc(func(c *Client, m *Message) {
+		c.joinRefused(m)
+	}),
+	"471": HandlerFunc(func(c *Client, m *Message) {
+		c.joinRefused(m)
+	}),
+	"473": HandlerFunc(func(c *Client, m *Message) {
+		c.joinRefused(m)
+	}),
+	"474": HandlerFunc(func(c *Client, m *Message) {
+		c.joinRefused(m)
+	}),
+	"475": HandlerFunc(func(c *Client, m *Message) {
+		c.joinRefused(m)
+	}),
+	"476": HandlerFunc(func(c *Client, m *Message) {
+		c.joinRefused(m)
+	}),
+	"477": HandlerFunc(func(c *Client, m *Message) {
+		c.joinRefused(m)
+	}),
+
+	// channel lists: bans, exceptions, invites, and their ends
+	"367": HandlerFunc(func(c *Client, m *Message) {
+		c.handleList(m, BanList)
+	}),
+	"368": HandlerFunc(func(c *Client, m *Message) {
+		c.handleList(m, BanList)
+	}),
+	"348": HandlerFunc(func(c *Client, m *Message) {
+		c.handleList(m, ExceptList)
+	}),
+	"349": HandlerFunc(func(c *Client, m *Message) {
+		c.handleList(m, ExceptList)
+	}),
+	"346": HandlerFunc(func(c *Client, m *Message) {
+		c.handleList(m, InviteList)
+	}),
+	"347": HandlerFunc(func(c *Client, m *Message) {
+		c.handleList(m, InviteList)
+	}),
+
+	// list refused: not on channel, unknown mode, not an operator
+	"442": HandlerFunc(func(c *Client, m *Message) {
+		c.listRefused(m)
+	}),
+	"472": HandlerFunc(func(c *Client, m *Message) {
+		c.listRefused(m)
+	}),
+	"482": HandlerFunc(func(c *Client, m *Message) {
+		c.listRefused(m)
+	}),
+
+	// nick refused: erroneous, in use, collision, temporarily unavailable
+	"432": HandlerFunc(func(c *Client, m *Message) {
+		c.nickRefused(m)
+	}),
 	"433": HandlerFunc(func(c *Client, m *Message) {
-		c.Nick += "_"
-		c.NICK(c.Nick)
+		c.nickRefused(m)
+	}),
+	"436": HandlerFunc(func(c *Client, m *Message) {
+		c.nickRefused(m)
+	}),
+	"437": HandlerFunc(func(c *Client, m *Message) {
+		c.nickRefused(m)
 	}),
 }
@@ -0,0 +1,319 @@
+package irc
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientDialer(t *testing.T) {
+	var (
+		dialed         string
+		client, server = net.Pipe()
+	)
+	defer server.Close()
+
+	c := &Client{
+		Addr:     "irc.example.net:6667",
+		Nick:     "bot",
+		User:     "bot",
+		Realname: "a bot",
+		Dialer: DialerFunc(func(network, addr string) (net.Conn, error) {
+			dialed = network + " " + addr
+			return client, nil
+		}),
+	}
+
+	go server.Write([]byte(":irc.example.net NOTICE * :*** Looking up your hostname\r\n"))
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if dialed != "tcp irc.example.net:6667" {
+		t.Errorf("expect dial to tcp irc.example.net:6667, got %q", dialed)
+	}
+
+	r := bufio.NewReader(server)
+	for _, expect := range []string{"CAP LS 302\r\n", "USER bot 0 * :a bot\r\n", "NICK bot\r\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expect {
+			t.Errorf("expect %q, got %q", expect, line)
+		}
+	}
+}
+
+// connectPipe connects c to the server end of a net.Pipe and consumes the
+// registration lines, returning the server end and a reader over it.
+func connectPipe(t *testing.T, c *Client) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	client, server := net.Pipe()
+	c.Dialer = DialerFunc(func(network, addr string) (net.Conn, error) {
+		return client, nil
+	})
+	t.Cleanup(func() { server.Close() })
+
+	go server.Write([]byte(":irc.example.net NOTICE * :hello\r\n"))
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(server)
+	for i := 0; i < 3; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server, r
+}
+
+func readMessage(t *testing.T, r *bufio.Reader) *Message {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseMessage(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestLag(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", PingTimeout: 50 * time.Millisecond}
+	lagCh := make(chan string, 1)
+	c.HandleFunc(EventLag, func(c *Client, m *Message) {
+		lagCh <- m.Params[0]
+	})
+	server, r := connectPipe(t, c)
+
+	// inbound traffic postpones the ping
+	time.Sleep(30 * time.Millisecond)
+	io.WriteString(server, ":irc.example.net NOTICE bot :still here\r\n")
+	start := time.Now()
+
+	m := readMessage(t, r)
+	if m.Command != "PING" || len(m.Params) != 1 {
+		t.Fatalf("expect PING, got %v", m)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("ping sent %v after traffic, expected about 50ms", waited)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	io.WriteString(server, ":irc.example.net PONG irc.example.net :"+m.Params[0]+"\r\n")
+
+	select {
+	case s := <-lagCh:
+		lag, err := time.ParseDuration(s)
+		if err != nil || lag < 10*time.Millisecond {
+			t.Errorf("expect lag >= 10ms, got %q (%v)", s, err)
+		}
+		if c.Lag() != lag || c.AvgLag() != lag {
+			t.Errorf("expect Lag and AvgLag %v, got %v and %v", lag, c.Lag(), c.AvgLag())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no lag event")
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", PingTimeout: 20 * time.Millisecond}
+	_, r := connectPipe(t, c)
+
+	if m := readMessage(t, r); m.Command != "PING" {
+		t.Fatalf("expect PING, got %v", m)
+	}
+	if err := c.Run(); !errors.Is(err, ErrPingTimeout) {
+		t.Errorf("expect ErrPingTimeout, got %v", err)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	server, r := connectPipe(t, c)
+
+	c.PRIVMSG("#chan", "one")
+	c.PRIVMSG("#chan", "two")
+	quit := make(chan error)
+	go func() { quit <- c.Quit("bye") }()
+
+	for _, expect := range []string{"PRIVMSG #chan :one", "PRIVMSG #chan :two", "QUIT :bye"} {
+		if m := readMessage(t, r); m.String() != expect {
+			t.Errorf("expect %q, got %q", expect, m)
+		}
+	}
+	io.WriteString(server, "ERROR :Closing Link: bot (Quit: bye)\r\n")
+	server.Close()
+
+	select {
+	case err := <-quit:
+		if err != nil {
+			t.Errorf("Quit: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Quit did not return")
+	}
+	if err := c.Run(); err != nil {
+		t.Errorf("Run after Quit: %v", err)
+	}
+}
+
+func TestQuitTimeout(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", QuitTimeout: 20 * time.Millisecond}
+	_, r := connectPipe(t, c)
+
+	go r.ReadString('\n') // QUIT, but the server never closes the link
+	if err := c.Quit(""); err != errQuitTimeout {
+		t.Errorf("expect errQuitTimeout, got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", PingTimeout: time.Minute}
+	connectPipe(t, c)
+
+	runErr := make(chan error)
+	go func() { runErr <- c.Run() }()
+
+	if err := c.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Errorf("Run after Close: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+
+	// sends after Close must not block
+	for i := 0; i < 20; i++ {
+		c.PRIVMSG("#chan", "hello?")
+	}
+}
+
+func TestCloseUnconnected(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	if err := c.Quit(""); err != nil {
+		t.Errorf("Quit before Connect: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close before Connect: %v", err)
+	}
+
+	dialErr := errors.New("connection refused")
+	c.Dialer = DialerFunc(func(network, addr string) (net.Conn, error) {
+		return nil, dialErr
+	})
+	for i := 0; i < 2; i++ {
+		if err := c.Connect(); err != dialErr {
+			t.Fatalf("expect dial error, got %v", err)
+		}
+		if err := c.Quit(""); err != nil {
+			t.Errorf("Quit after failed Connect: %v", err)
+		}
+		if err := c.Close(); err != nil {
+			t.Errorf("Close after failed Connect: %v", err)
+		}
+		// sends after a failed Connect must not block
+		c.PRIVMSG("#chan", "hello?")
+	}
+
+	// a failed reconnect doesn't touch the old connection
+	connectPipe(t, c)
+	c.Close()
+	c.Dialer = DialerFunc(func(network, addr string) (net.Conn, error) {
+		return nil, dialErr
+	})
+	if err := c.Connect(); err != dialErr {
+		t.Fatalf("expect dial error, got %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close after failed reconnect: %v", err)
+	}
+}
+
+func TestFloodDetection(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	server, r := connectPipe(t, c)
+
+	if p := c.floodProfile(); p != DefaultFlood {
+		t.Errorf("expect default profile before 004, got %s", p.Name)
+	}
+	io.WriteString(server, ":irc.example.net 004 bot irc.example.net UnrealIRCd-6.1.0 iowrsxzdHtIDRqpWGTSB lvhopsmntikraqbeIzMQNRTOVKDdGLPZSCcf\r\n")
+	c.PRIVMSG("#chan", "sync") // handlers have run once this is written
+	readMessage(t, r)
+
+	if p := c.floodProfile(); p != FloodUnreal {
+		t.Errorf("expect unreal profile after 004, got %s", p.Name)
+	}
+
+	c2 := &Client{Nick: "bot", User: "bot", Flood: FloodIRCu}
+	server2, r2 := connectPipe(t, c2)
+	io.WriteString(server2, ":irc.example.net 004 bot irc.example.net solanum-1.0 a b\r\n")
+	c2.PRIVMSG("#chan", "sync")
+	readMessage(t, r2)
+	if p := c2.floodProfile(); p != FloodIRCu {
+		t.Errorf("expect configured profile to stick, got %s", p.Name)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", MaxQueue: 1}
+	_, r := connectPipe(t, c)
+
+	d := c.PRIVMSG("#chan", "hi")
+	readMessage(t, r)
+	if err := d.Err(); err != nil {
+		t.Errorf("expect delivered, got %v", err)
+	}
+
+	// the first message is taken off the queue and blocks writing to the
+	// pipe; the second waits; the third is over MaxQueue
+	c.PRIVMSG("#chan", "one")
+	for c.QueueStats().Queued != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	waiting := c.PRIVMSG("#chan", "two")
+	if err := c.PRIVMSG("#chan", "three").Err(); err != ErrQueueFull {
+		t.Errorf("expect ErrQueueFull, got %v", err)
+	}
+
+	c.CancelQueued("#chan")
+	if err := waiting.Err(); err != ErrCanceled {
+		t.Errorf("expect ErrCanceled, got %v", err)
+	}
+
+	queued := c.PRIVMSG("#chan", "four")
+	c.Close()
+	if err := queued.Err(); err != ErrClosed {
+		t.Errorf("expect ErrClosed for message queued at Close, got %v", err)
+	}
+	if err := c.PRIVMSG("#chan", "five").Err(); err != ErrClosed {
+		t.Errorf("expect ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", WriteTimeout: 20 * time.Millisecond}
+	connectPipe(t, c)
+
+	// nobody reads the server end, so the write can never complete
+	d := c.PRIVMSG("#chan", "hello?")
+	if err := c.Run(); err == nil {
+		t.Error("expect Run to fail on write timeout")
+	}
+	var netErr net.Error
+	if err := d.Err(); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("expect timeout error for Delivery, got %v", err)
+	}
+}
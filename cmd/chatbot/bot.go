@@ -7,6 +7,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -14,7 +15,6 @@ import (
 	"log"
 	"math/rand"
 	"os"
-	"os/signal"
 	"regexp"
 	"strings"
 	"time"
@@ -24,6 +24,8 @@ import (
 
 	"ktkr.us/pkg/gas/db"
 	"ktkr.us/pkg/irc"
+	"ktkr.us/pkg/irc/services"
+	"ktkr.us/pkg/irc/transport"
 )
 
 // Config is the struct which should mirror the config json file
@@ -36,6 +38,10 @@ type Config struct {
 	RespondChance float64
 	JoinChannels  []string
 	NickservPass  string
+	RejoinOnKick  bool
+	Services      string   // services dialect: "atheme" (default) or "anope"
+	Operators     []string // nicks of the bot's operators, watched for presence
+	TimedModes    string   // file keeping !tban and !tmute until they expire
 	LogVerbose    bool
 	WPM           float64
 	Ignore        struct {
@@ -47,6 +53,12 @@ type Config struct {
 		linePatterns []*regexp.Regexp
 		wordPatterns []*regexp.Regexp
 	}
+
+	// Who may use !tban and !tmute: services accounts, checked with
+	// account-tag, and hostmasks, in which * and ? are wildcards.
+	OperatorAccounts []string
+	OperatorMasks    []string
+	operatorMasks    []*regexp.Regexp
 }
 
 var (
@@ -133,6 +145,9 @@ func main() {
 		flagInsert = flag.String("insert", "", "just insert a pair and exit (comma separated)")
 		flagC      = flag.String("c", "", "path to config file")
 		flagHTTP   = flag.String("http", "", "addr:port for debug interface (blank = disable)")
+		flagRecord = flag.String("record", "", "append the session's traffic to this file")
+		flagReplay = flag.String("replay", "", "run against a recorded session instead of connecting")
+		flagSpeed  = flag.Float64("speed", 0, "playback speed for -replay (0 = as fast as possible)")
 	)
 	flag.Parse()
 
@@ -183,10 +198,66 @@ func main() {
 		Verbose:     config.LogVerbose,
 		Secure:      config.Secure,
 		PingTimeout: 4 * time.Minute,
+
+		// wait for services, for channels that need an account
+		DeferJoin:    true,
+		RejoinOnKick: config.RejoinOnKick,
+
+		// to tell operators by their account
+		Caps: []string{"account-tag"},
+	}
+	for _, ch := range config.JoinChannels {
+		name, key, _ := strings.Cut(ch, ":")
+		c.AddChannel(name, key)
+	}
+
+	switch {
+	case *flagReplay != "":
+		f, err := os.Open(*flagReplay)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		c.Dialer = &transport.Replay{R: f, Speed: *flagSpeed, W: os.Stdout, Linger: time.Second}
+		c.Secure = false
+		c.PingTimeout = 0
+
+	case *flagRecord != "":
+		f, err := os.OpenFile(*flagRecord, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		rec := &transport.Recorder{W: f}
+		if config.Secure {
+			// record the plaintext, not the TLS records
+			rec.Forward = &tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true}}
+			c.Secure = false
+		}
+		c.Dialer = rec
 	}
 
 	c.HandleFunc("PRIVMSG", handlePRIVMSG)
-	c.HandleFunc("001", handleLogin)
+	dialect := services.Atheme
+	if config.Services != "" {
+		if dialect = services.Dialects[config.Services]; dialect == nil {
+			log.Fatalf("config: unknown services dialect %q", config.Services)
+		}
+	}
+	serv := services.New(c, dialect)
+	serv.Password = config.NickservPass
+	serv.OnIdentified(handleLogin)
+	c.Reclaim = serv.Reclaim
+	c.JoinRefused = serv.JoinRefused
+	c.HandleFunc(irc.EventOnline, handlePresence)
+	c.HandleFunc(irc.EventOffline, handlePresence)
+	c.Watch(config.Operators...)
+	if config.TimedModes != "" {
+		timedModes, err = irc.NewModeScheduler(c, irc.FileModeStore{Path: config.TimedModes})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	go func() {
 		s := bufio.NewScanner(os.Stdin)
@@ -195,26 +266,21 @@ func main() {
 		}
 	}()
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
-
-	go func() {
-		<-sig
-		os.Exit(1)
-	}()
-
 	for {
-		if err := c.Connect(); err == nil {
+		err := c.Connect()
+		if err == nil {
 			err = c.Run()
 			if err == nil {
 				break
 			}
 		}
-
-		if err != nil {
-			log.Print(err)
-			time.Sleep(5 * time.Second)
+		if *flagReplay != "" {
+			log.Printf("replay finished: %v", err)
+			break
 		}
+
+		log.Print(err)
+		time.Sleep(5 * time.Second)
 	}
 }
 
@@ -236,6 +302,7 @@ func loadConfig(path string) error {
 	config.Ignore.nickPatterns = compileRegexps(config.Ignore.Nick)
 	config.Ignore.linePatterns = compileRegexps(config.Ignore.Line)
 	config.Ignore.wordPatterns = compileRegexps(config.Ignore.Word)
+	config.operatorMasks = compileMasks(config.OperatorMasks)
 
 	return nil
 }
@@ -251,6 +318,16 @@ func compileRegexps(in []string) []*regexp.Regexp {
 	return r
 }
 
+// compileMasks turns hostmasks with * and ? wildcards into regexps.
+func compileMasks(in []string) []*regexp.Regexp {
+	wildcards := strings.NewReplacer(`\*`, ".*", `\?`, ".")
+	r := make([]*regexp.Regexp, len(in))
+	for i, s := range in {
+		r[i] = regexp.MustCompile("(?i)^" + wildcards.Replace(regexp.QuoteMeta(s)) + "$")
+	}
+	return r
+}
+
 func handlePRIVMSG(c *irc.Client, m *irc.Message) {
 	switch targ := m.Target(); targ.(type) {
 	case irc.ChannelTarget:
@@ -300,19 +377,15 @@ func privatemsg(c *irc.Client, m *irc.Message) {
 
 }
 
-func handleLogin(c *irc.Client, m *irc.Message) {
-	if config.NickservPass != "" {
-		c.PRIVMSG("NickServ", "IDENTIFY "+config.NickservPass)
-	}
-	for _, ch := range config.JoinChannels {
-		parts := strings.SplitN(ch, ":", 2)
-		switch len(parts) {
-		case 1:
-			c.JOIN(parts[0])
-		case 2:
-			c.JOIN(parts[0], parts[1])
-		}
+func handleLogin(c *irc.Client, err error) {
+	if err != nil && err != services.ErrNotIdentified {
+		log.Printf("identify: %v", err)
 	}
+	c.JoinChannels()
+}
+
+func handlePresence(c *irc.Client, m *irc.Message) {
+	log.Printf("operator %s is %s", m.From, m.Command)
 }
 
 func randomChance() bool {
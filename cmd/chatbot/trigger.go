@@ -1,9 +1,80 @@
 package main
 
-import "ktkr.us/pkg/irc"
+import (
+	"log"
+	"strings"
+	"time"
 
-var triggers = map[string]irc.Handler{}
+	"ktkr.us/pkg/irc"
+)
 
+var triggers = map[string]irc.Handler{
+	"!tban":  irc.HandlerFunc(handleTimedBan),
+	"!tmute": irc.HandlerFunc(handleTimedBan),
+}
+
+// timedModes undoes !tban and !tmute once they run out.
+var timedModes *irc.ModeScheduler
+
+// handleTrigger runs the trigger m starts with, if any. Triggers only work
+// in channels.
 func handleTrigger(c *irc.Client, m *irc.Message) bool {
-	return false
+	if _, ok := m.Target().(irc.ChannelTarget); !ok {
+		return false
+	}
+	word, _, _ := strings.Cut(m.LastParam(), " ")
+	h, ok := triggers[word]
+	if !ok {
+		return false
+	}
+	h.HandleIRC(c, m)
+	return true
+}
+
+// isOperator reports whether m is from one of the bot's operators, by the
+// account the server tags it with, or failing that, by hostmask. Nicks
+// alone are no proof, since anyone can take one that's free.
+func isOperator(c *irc.Client, m *irc.Message) bool {
+	if account := m.Tags["account"]; account != "" && c.CapEnabled("account-tag") {
+		for _, op := range config.OperatorAccounts {
+			if strings.EqualFold(op, account) {
+				return true
+			}
+		}
+	}
+	return m.From != nil && stringMatchList(m.From.String(), config.operatorMasks)
+}
+
+// handleTimedBan handles "!tban nick 10m" and "!tmute nick 10m" from an
+// operator in a channel.
+func handleTimedBan(c *irc.Client, m *irc.Message) {
+	channel := m.Target().Name()
+	args := strings.Fields(m.LastParam())
+	if timedModes == nil || !isOperator(c, m) {
+		return
+	}
+	if len(args) != 3 {
+		c.PRIVMSG(channel, "usage: "+args[0]+" <nick> <duration>")
+		return
+	}
+	d, err := time.ParseDuration(args[2])
+	if err != nil || d <= 0 {
+		c.PRIVMSG(channel, "bad duration "+args[2])
+		return
+	}
+	mask, ok := c.BanMask(args[1])
+	if !ok {
+		mask = args[1] + "!*@*"
+	}
+
+	if args[0] == "!tmute" {
+		err = timedModes.Mute(channel, mask, d)
+	} else {
+		err = timedModes.Ban(channel, mask, d)
+	}
+	if err == irc.ErrNoMute {
+		c.PRIVMSG(channel, "can't mute on this network")
+	} else if err != nil {
+		log.Printf("%s %s: %v", args[0], mask, err)
+	}
 }
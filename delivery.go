@@ -0,0 +1,111 @@
+package irc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrQueueFull is reported for a message dropped because its target
+	// already had Client.MaxQueue messages waiting.
+	ErrQueueFull = errors.New("irc: send queue full")
+
+	// ErrCanceled is reported for a message removed by CancelQueued.
+	ErrCanceled = errors.New("irc: send canceled")
+
+	// ErrClosed is reported for a message that was still queued when the
+	// client shut down.
+	ErrClosed = errors.New("irc: client closed")
+
+	// ErrNoEcho is returned by Delivery.Echo for a message the server won't
+	// echo: one other than PRIVMSG, NOTICE or TAGMSG, or any message when
+	// the echo-message capability isn't enabled.
+	ErrNoEcho = errors.New("irc: message not echoed")
+
+	// ErrRejected is returned by Delivery.Echo, wrapped with the server's
+	// reply, when the server refuses to deliver a message.
+	ErrRejected = errors.New("irc: message rejected")
+)
+
+// A Delivery reports what became of a message handed to the client: it is
+// done once the message has been written to the connection or dropped.
+// With echo-message, it also reports what the server made of it.
+type Delivery struct {
+	done chan struct{}
+	err  error
+
+	echoed   chan struct{}
+	echo     *Message
+	echoErr  error
+	echoOnce sync.Once
+}
+
+func newDelivery() *Delivery {
+	return &Delivery{done: make(chan struct{}), echoed: make(chan struct{})}
+}
+
+// failedDelivery returns a Delivery that is already done with err.
+func failedDelivery(err error) *Delivery {
+	d := newDelivery()
+	d.complete(err)
+	return d
+}
+
+func (d *Delivery) complete(err error) {
+	d.err = err
+	close(d.done)
+	if err != nil {
+		d.resolve(nil, err)
+	}
+}
+
+// resolve records the server's echo of the message, or why there won't be
+// one. Only the first call has any effect.
+func (d *Delivery) resolve(echo *Message, err error) {
+	d.echoOnce.Do(func() {
+		d.echo, d.echoErr = echo, err
+		close(d.echoed)
+	})
+}
+
+// Done returns a channel that is closed once the message has been written
+// or dropped.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err blocks until the Delivery is done, then returns nil if the message was
+// written, or the reason it was dropped.
+func (d *Delivery) Err() error {
+	<-d.done
+	return d.err
+}
+
+// Wait is like Err but gives up when ctx is done, returning ctx.Err().
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Echo waits for the server to echo the message back, which it does for
+// PRIVMSG, NOTICE and TAGMSG once the echo-message capability is enabled,
+// and returns the echo. Its ID and Time are the msgid and time the server
+// gave the message, and its params show any change the server made to it,
+// such as stripped formatting. If the message was dropped, the error is the
+// one Err returns; if the server refused it, it wraps ErrRejected.
+//
+// Like History, Echo must not be called from a Handler.
+func (d *Delivery) Echo(ctx context.Context) (*Message, error) {
+	select {
+	case <-d.echoed:
+		return d.echo, d.echoErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
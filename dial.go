@@ -0,0 +1,26 @@
+package irc
+
+import "net"
+
+// A Dialer makes the connection to the server named by Client.Addr. It lets
+// callers route the client through a proxy, a Unix socket or an in-memory
+// net.Pipe. *net.Dialer, the dialers in golang.org/x/net/proxy and the ones
+// in package transport all satisfy it.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// DialerFunc adapts an ordinary function to a Dialer.
+type DialerFunc func(network, addr string) (net.Conn, error)
+
+func (f DialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(network, addr)
+}
+
+// dialer returns the Dialer c should connect with.
+func (c *Client) dialer() Dialer {
+	if c.Dialer != nil {
+		return c.Dialer
+	}
+	return &net.Dialer{}
+}
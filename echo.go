@@ -0,0 +1,186 @@
+package irc
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// echoCommands are the commands the server echoes back with echo-message.
+var echoCommands = map[string]bool{
+	"PRIVMSG": true,
+	"NOTICE":  true,
+	"TAGMSG":  true,
+}
+
+// maxEchoIDs bounds how many msgids of echoes the client remembers, to
+// spot an echo the server sends twice.
+const maxEchoIDs = 64
+
+// echoWait is a message that has been written and is waiting for its echo.
+type echoWait struct {
+	target string
+	label  string
+	d      *Delivery
+}
+
+// echoTracker matches echoes from the server to the messages they echo.
+// With labeled-response, each message is sent with a label that its echo,
+// or the error refusing it, carries back. Otherwise they are matched by
+// target, in order, since the server answers a client's messages in the
+// order it sent them.
+type echoTracker struct {
+	mu      sync.Mutex
+	pending []*echoWait
+
+	// ids are the msgids of the latest echoes, oldest first, kept across
+	// connections since a bouncer may play the same echo back again
+	ids []string
+}
+
+// reset resolves every message still waiting with err.
+func (t *echoTracker) reset(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, w := range t.pending {
+		w.d.resolve(nil, err)
+	}
+	t.pending = nil
+}
+
+// add starts waiting for the echo of m, by its label if it has one. It must
+// be called before m is written, so that the echo can't come first.
+func (t *echoTracker) add(m *Message, d *Delivery) *echoWait {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w := &echoWait{target: m.Param(0), label: m.Tags["label"], d: d}
+	t.pending = append(t.pending, w)
+	return w
+}
+
+// take stops waiting for the echo with label, or if label is empty, the
+// oldest one for target, and returns it, or nil if there is none.
+func (t *echoTracker) take(label, target string) *echoWait {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, w := range t.pending {
+		if label != "" && w.label == label ||
+			label == "" && w.label == "" && strings.EqualFold(w.target, target) {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			return w
+		}
+	}
+	return nil
+}
+
+// remove stops waiting for w, if it still is.
+func (t *echoTracker) remove(w *echoWait) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, p := range t.pending {
+		if p == w {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// duplicate notes the msgid of an echo, and reports whether it has already
+// been seen.
+func (t *echoTracker) duplicate(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if slices.Contains(t.ids, id) {
+		return true
+	}
+	if len(t.ids) == maxEchoIDs {
+		t.ids = append(t.ids[:0], t.ids[1:]...)
+	}
+	t.ids = append(t.ids, id)
+	return false
+}
+
+// labelEcho labels m, if it will be echoed and labeled-response is
+// enabled, so that its echo can be told apart. It's done as m is queued,
+// so that the label counts towards the line's length and flood cost.
+func (c *Client) labelEcho(m *Message) {
+	if !echoCommands[m.Command] || !c.CapEnabled("echo-message") ||
+		!c.CapEnabled("labeled-response") || m.Tags["label"] != "" {
+		return
+	}
+	tags := make(map[string]string, len(m.Tags)+1)
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	tags["label"] = c.newLabel()
+	m.Tags = tags
+}
+
+// expectEcho arranges for o's Delivery to be resolved by its echo, just
+// before o is written. It returns what to pass to echoes.remove should the
+// write fail, or nil if no echo is expected.
+func (c *Client) expectEcho(o *outgoing) *echoWait {
+	if !echoCommands[o.m.Command] || !c.CapEnabled("echo-message") {
+		o.d.resolve(nil, ErrNoEcho)
+		return nil
+	}
+	return c.echoes.add(o.m, o.d)
+}
+
+// newLabel returns a label for a labeled-response request, unique on the
+// connection.
+func (c *Client) newLabel() string {
+	return strconv.FormatUint(c.labels.Add(1), 36)
+}
+
+// label returns the label of the request m answers, from its own tags or
+// the labeled-response batch it is part of.
+func (c *Client) label(m *Message) string {
+	if label, ok := m.Tags["label"]; ok {
+		return label
+	}
+	return c.batches[m.Tags["batch"]].labeled()
+}
+
+// echo resolves the Delivery of the message m echoes, if it is the server
+// echoing one of the client's own messages, and dispatches it to EventEcho
+// handlers. It reports whether m should be kept from the handlers for its
+// command. An echo with a msgid already seen is dropped.
+func (c *Client) echo(m *Message) bool {
+	if !echoCommands[m.Command] || m.From == nil || !c.isMe(m.From.Nick) ||
+		!c.CapEnabled("echo-message") {
+		return false
+	}
+	if id := m.ID(); id != "" && c.echoes.duplicate(id) {
+		return true
+	}
+	if w := c.echoes.take(c.label(m), m.Param(0)); w != nil {
+		w.d.resolve(m, nil)
+	}
+	for _, h := range c.handlers[EventEcho] {
+		h.HandleIRC(c, m)
+	}
+	return !c.DispatchEcho
+}
+
+// rejected fails the Delivery of the message an error numeric refuses:
+//
+//	:server 404 <nick> <target> :<reason>
+func (c *Client) rejected(m *Message) {
+	if w := c.echoes.take(c.label(m), m.Param(1)); w != nil {
+		w.d.resolve(nil, errors.Wrapf(ErrRejected, "%s %s: %s", m.Command, m.Param(1), m.LastParam()))
+	}
+}
+
+// unechoed resolves the Delivery of a labeled message the server answered
+// with a bare ACK instead of an echo.
+func (c *Client) unechoed(m *Message) {
+	if label := c.label(m); label != "" {
+		if w := c.echoes.take(label, ""); w != nil {
+			w.d.resolve(nil, ErrNoEcho)
+		}
+	}
+}
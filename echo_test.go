@@ -0,0 +1,171 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func echoContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestEchoLabeled(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	live := make(chan *Message, 1)
+	echoes := make(chan *Message, 1)
+	c.HandleFunc("PRIVMSG", func(c *Client, m *Message) {
+		live <- m
+	})
+	c.HandleFunc(EventEcho, func(c *Client, m *Message) {
+		echoes <- m
+	})
+	server, r := connectCaps(t, c, "echo-message labeled-response message-tags server-time")
+
+	d := c.PRIVMSG("#chan", "\x02hello\x02")
+	m := readMessage(t, r)
+	label := m.Tags["label"]
+	if label == "" || m.Command != "PRIVMSG" {
+		t.Fatalf("expect labeled PRIVMSG, got %q", m)
+	}
+
+	// the server strips formatting
+	io.WriteString(server, "@label="+label+";msgid=abc;time=2023-06-01T12:00:00.000Z :bot!bot@host PRIVMSG #chan :hello\r\n")
+	echo, err := d.Echo(echoContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if echo.ID() != "abc" || !echo.Time.Equal(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)) || echo.LastParam() != "hello" {
+		t.Errorf("expect echo as the server sent it, got %q at %v", echo, echo.Time)
+	}
+	if m := <-echoes; m != echo {
+		t.Errorf("expect echo dispatched to EventEcho, got %q", m)
+	}
+
+	// a labeled refusal fails the send
+	d = c.PRIVMSG("#moderated", "hi")
+	label = readMessage(t, r).Tags["label"]
+	io.WriteString(server, "@label="+label+" :irc.test 404 bot #moderated :Cannot send to channel\r\n")
+	if _, err := d.Echo(echoContext(t)); !errors.Is(err, ErrRejected) {
+		t.Errorf("expect ErrRejected, got %v", err)
+	}
+
+	// others' messages still reach handlers, the client's own don't
+	io.WriteString(server, ":a!a@host PRIVMSG #chan :from a\r\n")
+	if m := <-live; m.From.Nick != "a" {
+		t.Errorf("expect only a's message dispatched, got %q", m)
+	}
+}
+
+func TestEchoUnlabeled(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	server, r := connectCaps(t, c, "echo-message")
+
+	d1 := c.PRIVMSG("#a", "one")
+	d2 := c.PRIVMSG("#b", "two")
+	d3 := c.PRIVMSG("#a", "three")
+	for i := 0; i < 3; i++ {
+		if m := readMessage(t, r); m.Tags["label"] != "" {
+			t.Errorf("expect no label, got %q", m)
+		}
+	}
+
+	// matched by target, in order
+	io.WriteString(server, ":irc.test 404 bot #a :Cannot send to channel\r\n"+
+		":bot!bot@host PRIVMSG #b :two\r\n"+
+		":bot!bot@host PRIVMSG #a :three\r\n")
+	if _, err := d1.Echo(echoContext(t)); !errors.Is(err, ErrRejected) {
+		t.Errorf("expect ErrRejected for one, got %v", err)
+	}
+	for _, test := range []struct {
+		d   *Delivery
+		exp string
+	}{{d2, "two"}, {d3, "three"}} {
+		m, err := test.d.Echo(echoContext(t))
+		if err != nil || m.LastParam() != test.exp {
+			t.Errorf("expect echo of %s, got %q, %v", test.exp, m, err)
+		}
+	}
+}
+
+func TestEchoDuplicate(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	echoes := make(chan *Message, 3)
+	c.HandleFunc(EventEcho, func(c *Client, m *Message) {
+		echoes <- m
+	})
+	server, r := connectCaps(t, c, "echo-message message-tags")
+
+	d1 := c.PRIVMSG("#a", "same")
+	d2 := c.PRIVMSG("#a", "same")
+	readMessage(t, r)
+	readMessage(t, r)
+
+	// the first echo comes twice, as a bouncer replaying it might send it
+	io.WriteString(server, "@msgid=1 :bot!bot@host PRIVMSG #a :same\r\n"+
+		"@msgid=1 :bot!bot@host PRIVMSG #a :same\r\n"+
+		"@msgid=2 :bot!bot@host PRIVMSG #a :same\r\n")
+	for _, test := range []struct {
+		d   *Delivery
+		exp string
+	}{{d1, "1"}, {d2, "2"}} {
+		m, err := test.d.Echo(echoContext(t))
+		if err != nil || m.ID() != test.exp {
+			t.Errorf("expect echo %s, got %q, %v", test.exp, m, err)
+		}
+	}
+	for _, exp := range []string{"1", "2"} {
+		if m := <-echoes; m.ID() != exp {
+			t.Errorf("expect echo %s dispatched, got %q", exp, m.ID())
+		}
+	}
+	select {
+	case m := <-echoes:
+		t.Errorf("duplicate echo dispatched: %q", m)
+	default:
+	}
+}
+
+func TestEchoDispatch(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", DispatchEcho: true}
+	live := make(chan *Message, 1)
+	c.HandleFunc("PRIVMSG", func(c *Client, m *Message) {
+		live <- m
+	})
+	server, r := connectCaps(t, c, "echo-message")
+
+	c.PRIVMSG("#chan", "hi")
+	readMessage(t, r)
+	io.WriteString(server, ":bot!bot@host PRIVMSG #chan :hi\r\n")
+	select {
+	case m := <-live:
+		if m.From.Nick != "bot" {
+			t.Errorf("expect own message, got %q", m)
+		}
+	case <-time.After(time.Second):
+		t.Error("expect echo dispatched to PRIVMSG handlers")
+	}
+}
+
+func TestNoEcho(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	server, r := connectPipe(t, c)
+	defer c.Close()
+	io.WriteString(server, ":irc.test CAP * LS :\r\n")
+	readMessage(t, r)
+
+	d := c.PRIVMSG("#chan", "hi")
+	readMessage(t, r)
+	if _, err := d.Echo(echoContext(t)); err != ErrNoEcho {
+		t.Errorf("expect ErrNoEcho without echo-message, got %v", err)
+	}
+
+	c.Close()
+	if _, err := c.PRIVMSG("#chan", "hi").Echo(echoContext(t)); err != ErrClosed {
+		t.Errorf("expect ErrClosed after Close, got %v", err)
+	}
+}
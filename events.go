@@ -0,0 +1,46 @@
+package irc
+
+import "log/slog"
+
+// Events are synthetic messages the client dispatches to handlers alongside
+// the commands it receives from the server. Their names are lowercase, so
+// they can never collide with a parsed command, which is always uppercase.
+const (
+	// EventLag is dispatched each time a round trip to the server has been
+	// measured. Params[0] holds the lag as a time.Duration string; Client.Lag
+	// and Client.AvgLag return it in typed form.
+	EventLag = "lag"
+
+	// EventBackfill is dispatched for each message fetched to catch up on a
+	// channel, see Client.Backfill, oldest first. The message is passed as
+	// it was sent, keeping its own Command, rather than renamed: handlers
+	// for it see PRIVMSG, NOTICE, JOIN and so on, and should check
+	// Message.Command.
+	EventBackfill = "backfill"
+
+	// EventEcho is dispatched for each of the client's own messages the
+	// server echoes back, with echo-message. As with EventBackfill, the
+	// message keeps its own Command. Unless Client.DispatchEcho is set,
+	// echoes go only to these handlers.
+	EventEcho = "echo"
+
+	// EventOnline and EventOffline are dispatched when a user given to
+	// Client.Watch comes online or goes offline. From holds the user's
+	// hostmask, as much of it as the server reported, and Params[0] the
+	// nick.
+	EventOnline  = "online"
+	EventOffline = "offline"
+)
+
+// dispatch runs the handlers registered for m.Command.
+func (c *Client) dispatch(m *Message) {
+	if handlers, ok := c.handlers[m.Command]; ok {
+		for _, h := range handlers {
+			h.HandleIRC(c, m)
+		}
+	} else {
+		c.logger().Debug("irc: unhandled message",
+			slog.String("command", m.Command),
+			slog.String("target", m.Target().Name()))
+	}
+}
@@ -0,0 +1,140 @@
+package irc
+
+import (
+	"strings"
+	"time"
+)
+
+// A FloodProfile describes how a family of servers meters client traffic,
+// in the penalty model most ircds share: each line the client sends adds
+// its cost to a timer that may run at most Window ahead of real time, and a
+// client that pushes it further is throttled or killed for Excess Flood.
+// The client paces its own sends by the same rules.
+type FloodProfile struct {
+	Name string
+
+	Window   time.Duration // how far the penalty timer may run ahead
+	LineCost time.Duration // penalty for every line
+	ByteCost time.Duration // penalty for every byte, including CRLF
+
+	// CommandCost is extra penalty for commands the server considers
+	// expensive.
+	CommandCost map[string]time.Duration
+}
+
+// Cost returns the penalty the server will charge for m.
+func (p *FloodProfile) Cost(m *Message) time.Duration {
+	var buf [512]byte
+	n := len(m.AppendTo(buf[:0])) + 2
+	return p.LineCost + time.Duration(n)*p.ByteCost + p.CommandCost[m.Command]
+}
+
+// expensiveCommands are the commands that cost servers the most work, and
+// that they penalize accordingly.
+var expensiveCommands = map[string]time.Duration{
+	"MODE":   time.Second,
+	"NAMES":  time.Second,
+	"WHO":    2 * time.Second,
+	"WHOIS":  2 * time.Second,
+	"WHOWAS": 2 * time.Second,
+	"LIST":   3 * time.Second,
+}
+
+var (
+	// FloodRFC1459 follows RFC 1459 §8.10, as implemented by ircd 2.x: two
+	// seconds per line, at most ten seconds ahead. It's the strictest, so
+	// it's only used for servers known to need it.
+	FloodRFC1459 = &FloodProfile{
+		Name:     "rfc1459",
+		Window:   10 * time.Second,
+		LineCost: 2 * time.Second,
+	}
+
+	// FloodIRCu matches ircu and its descendants (Undernet, QuakeNet),
+	// which add a second for every 120 bytes and extra for costly queries.
+	FloodIRCu = &FloodProfile{
+		Name:        "ircu",
+		Window:      10 * time.Second,
+		LineCost:    2 * time.Second,
+		ByteCost:    time.Second / 120,
+		CommandCost: expensiveCommands,
+	}
+
+	// FloodHybrid matches hybrid, ratbox, charybdis and solanum, which allow
+	// a short burst and then about a line a second before the receive
+	// queue fills.
+	FloodHybrid = &FloodProfile{
+		Name:        "hybrid",
+		Window:      5 * time.Second,
+		LineCost:    time.Second,
+		ByteCost:    time.Second / 512,
+		CommandCost: expensiveCommands,
+	}
+
+	// FloodUnreal matches UnrealIRCd's fake lag, charged per line and per
+	// 90 bytes.
+	FloodUnreal = &FloodProfile{
+		Name:        "unreal",
+		Window:      8 * time.Second,
+		LineCost:    time.Second,
+		ByteCost:    time.Second / 90,
+		CommandCost: expensiveCommands,
+	}
+
+	// FloodInspIRCd matches InspIRCd's per-command penalties.
+	FloodInspIRCd = &FloodProfile{
+		Name:        "inspircd",
+		Window:      10 * time.Second,
+		LineCost:    time.Second,
+		CommandCost: expensiveCommands,
+	}
+
+	// DefaultFlood is used until the server has identified itself, and for
+	// servers DetectFloodProfile doesn't recognize. Most networks run
+	// something hybrid-like, and a line a second suits the rest.
+	DefaultFlood = FloodHybrid
+)
+
+// DetectFloodProfile picks a profile from the server version reported in
+// RPL_MYINFO (004).
+func DetectFloodProfile(version string) *FloodProfile {
+	v := strings.ToLower(version)
+	switch {
+	case strings.Contains(v, "unreal"):
+		return FloodUnreal
+	case strings.Contains(v, "inspircd"):
+		return FloodInspIRCd
+	case strings.HasPrefix(v, "u2.") || strings.Contains(v, "ircu") || strings.Contains(v, "snircd"):
+		return FloodIRCu
+	case strings.Contains(v, "hybrid"), strings.Contains(v, "ratbox"),
+		strings.Contains(v, "charybdis"), strings.Contains(v, "solanum"),
+		strings.Contains(v, "ircd-seven"), strings.Contains(v, "plexus"):
+		return FloodHybrid
+	case strings.HasPrefix(v, "2."):
+		// ircd 2.x, as IRCnet runs
+		return FloodRFC1459
+	}
+	return DefaultFlood
+}
+
+// floodProfile returns the profile c is currently pacing by.
+func (c *Client) floodProfile() *FloodProfile {
+	if c.Flood != nil {
+		return c.Flood
+	}
+	if p := c.detectedFlood.Load(); p != nil {
+		return p
+	}
+	return DefaultFlood
+}
+
+// setServerVersion switches to the profile for the server's version, unless
+// the caller chose one.
+func (c *Client) setServerVersion(version string) {
+	if c.Flood != nil {
+		return
+	}
+	p := DetectFloodProfile(version)
+	c.detectedFlood.Store(p)
+	c.l.SetWindow(p.Window)
+}
@@ -0,0 +1,50 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFloodCost(t *testing.T) {
+	short := &Message{Command: "PRIVMSG", Params: []string{"#c"}, Trailing: "hi"}
+	long := &Message{Command: "PRIVMSG", Params: []string{"#c"}, Trailing: strings.Repeat("x", 400)}
+	who := &Message{Command: "WHO", Params: []string{"#c"}}
+
+	if c := FloodRFC1459.Cost(long); c != 2*time.Second {
+		t.Errorf("rfc1459: long line cost %v, expect flat 2s", c)
+	}
+	if FloodIRCu.Cost(long) <= FloodIRCu.Cost(short) {
+		t.Error("ircu: long line should cost more than short")
+	}
+	if c := FloodIRCu.Cost(short); c != 2*time.Second+time.Duration(len("PRIVMSG #c :hi\r\n"))*(time.Second/120) {
+		t.Errorf("ircu: short line cost %v", c)
+	}
+	if FloodHybrid.Cost(who) < FloodHybrid.Cost(short)+time.Second {
+		t.Error("hybrid: WHO should carry extra penalty")
+	}
+}
+
+func TestDetectFloodProfile(t *testing.T) {
+	table := []struct {
+		version string
+		expect  *FloodProfile
+	}{
+		{"solanum-1.0-dev", FloodHybrid},
+		{"charybdis-4.1.2", FloodHybrid},
+		{"ircd-ratbox-3.0.10", FloodHybrid},
+		{"hybrid-8.2.38", FloodHybrid},
+		{"u2.10.12.10+snircd(1.3.4a)", FloodIRCu},
+		{"UnrealIRCd-6.1.0", FloodUnreal},
+		{"InspIRCd-3", FloodInspIRCd},
+		{"2.11.2p3", FloodRFC1459},
+		{"ngircd-26.1", DefaultFlood},
+		{"", DefaultFlood},
+	}
+
+	for _, test := range table {
+		if p := DetectFloodProfile(test.version); p != test.expect {
+			t.Errorf("%q: expect %s, got %s", test.version, test.expect.Name, p.Name)
+		}
+	}
+}
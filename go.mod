@@ -1,6 +1,6 @@
 module ktkr.us/pkg/irc
 
-go 1.16
+go 1.21
 
 require (
 	github.com/pkg/errors v0.9.1
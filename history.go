@@ -0,0 +1,326 @@
+package irc
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultHistoryLimit is how many messages History asks for when its limit
+// is zero. Servers apply their own maximum too, which they advertise as
+// CHATHISTORY in RPL_ISUPPORT.
+const DefaultHistoryLimit = 100
+
+// ErrHistoryUnsupported is returned by History when the server hasn't
+// granted the chathistory and batch capabilities on this connection.
+var ErrHistoryUnsupported = errors.New("irc: server does not offer chathistory")
+
+// historyCaps are the names the chathistory capability goes by.
+var historyCaps = []string{"draft/chathistory", "chathistory"}
+
+// A HistoryError is a FAIL reply from the server to a CHATHISTORY request.
+type HistoryError struct {
+	Code        string // such as INVALID_TARGET or MESSAGE_ERROR
+	Description string
+}
+
+func (e *HistoryError) Error() string {
+	return "irc: chathistory: " + e.Code + ": " + e.Description
+}
+
+// A HistoryRef is a point in a conversation's history that a HistoryRange
+// is measured from.
+type HistoryRef string
+
+// MsgID refers to the message with the given msgid tag; see Message.ID.
+func MsgID(id string) HistoryRef {
+	return HistoryRef("msgid=" + id)
+}
+
+// Timestamp refers to the instant t.
+func Timestamp(t time.Time) HistoryRef {
+	return HistoryRef("timestamp=" + t.UTC().Format("2006-01-02T15:04:05.000Z"))
+}
+
+// A HistoryRange selects the messages History fetches. When there are more
+// than the limit, the ones nearest the ref it is measured from are taken,
+// but whichever way the range runs, they come back oldest first.
+type HistoryRange struct {
+	sub  string
+	refs []HistoryRef
+}
+
+// HistoryBefore selects the messages before ref.
+func HistoryBefore(ref HistoryRef) HistoryRange {
+	return HistoryRange{"BEFORE", []HistoryRef{ref}}
+}
+
+// HistoryAfter selects the messages after ref.
+func HistoryAfter(ref HistoryRef) HistoryRange {
+	return HistoryRange{"AFTER", []HistoryRef{ref}}
+}
+
+// HistoryAround selects the messages either side of ref.
+func HistoryAround(ref HistoryRef) HistoryRange {
+	return HistoryRange{"AROUND", []HistoryRef{ref}}
+}
+
+// HistoryLatest selects the most recent messages, back as far as ref if it
+// isn't empty.
+func HistoryLatest(ref HistoryRef) HistoryRange {
+	if ref == "" {
+		ref = "*"
+	}
+	return HistoryRange{"LATEST", []HistoryRef{ref}}
+}
+
+// HistoryBetween selects the messages strictly between from and to,
+// measured from from.
+func HistoryBetween(from, to HistoryRef) HistoryRange {
+	return HistoryRange{"BETWEEN", []HistoryRef{from, to}}
+}
+
+// historyRequest is a CHATHISTORY request waiting for its reply.
+type historyRequest struct {
+	target string
+	label  string // with labeled-response, what the reply carries back
+	msgs   []*Message
+	err    error
+	done   chan struct{}
+
+	// then, if set, is run on the receive goroutine with the messages
+	// once they have all arrived.
+	then func(msgs []*Message)
+}
+
+// historyState tracks CHATHISTORY requests and what has been seen where.
+// With labeled-response, a reply is matched to its request by label.
+// Otherwise replies are matched by target, in order, since the server
+// answers a target's requests in the order they were sent.
+type historyState struct {
+	mu      sync.Mutex
+	pending []*historyRequest // in the order they were queued
+
+	// last maps each channel, in lower case, to the msgid of the last
+	// message seen in it. It is kept across connections for Backfill.
+	last map[string]string
+}
+
+// reset fails every pending request, for a new connection.
+func (h *historyState) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, req := range h.pending {
+		req.err = ErrClosed
+		close(req.done)
+	}
+	h.pending = nil
+}
+
+// finish completes the request with label, or if label is empty, the
+// oldest unlabeled one for target, or the oldest of all if target is empty
+// too. It returns the request, or nil if there is none.
+func (h *historyState) finish(label, target string, msgs []*Message, err error) *historyRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, req := range h.pending {
+		if label != "" && req.label == label ||
+			label == "" && req.label == "" && (target == "" || strings.EqualFold(req.target, target)) {
+			return h.complete(i, msgs, err)
+		}
+	}
+	return nil
+}
+
+// drop completes req with err if it is still pending.
+func (h *historyState) drop(req *historyRequest, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, r := range h.pending {
+		if r == req {
+			h.complete(i, nil, err)
+			return
+		}
+	}
+}
+
+func (h *historyState) complete(i int, msgs []*Message, err error) *historyRequest {
+	req := h.pending[i]
+	h.pending = append(h.pending[:i], h.pending[i+1:]...)
+	req.msgs, req.err = msgs, err
+	close(req.done)
+	return req
+}
+
+// History fetches messages sent to target, a channel or a nick, while the
+// client may not have been there to see them, using the IRCv3 chathistory
+// extension. At most limit messages are returned, or DefaultHistoryLimit
+// if limit is zero, oldest first. The server may return fewer, and returns
+// none if it keeps no history for target.
+//
+// Like Quit, History must not be called from a Handler, since the reply it
+// waits for is read by the goroutine running handlers.
+func (c *Client) History(ctx context.Context, target string, r HistoryRange, limit int) ([]*Message, error) {
+	if !c.historyEnabled() {
+		return nil, ErrHistoryUnsupported
+	}
+	die := c.die
+	req, d := c.requestHistory(target, r, limit, nil)
+	select {
+	case <-req.done:
+		return req.msgs, req.err
+	case <-ctx.Done():
+		// so that the reply to the next request isn't taken for this one
+		c.hist.drop(req, ctx.Err())
+		return nil, ctx.Err()
+	case <-die:
+		return nil, ErrClosed
+	case <-d.Done():
+		if err := d.Err(); err != nil {
+			return nil, err
+		}
+	}
+	select {
+	case <-req.done:
+		return req.msgs, req.err
+	case <-ctx.Done():
+		c.hist.drop(req, ctx.Err())
+		return nil, ctx.Err()
+	case <-die:
+		return nil, ErrClosed
+	}
+}
+
+// historyEnabled reports whether CHATHISTORY may be used on this connection.
+func (c *Client) historyEnabled() bool {
+	if !c.CapEnabled("batch") {
+		return false
+	}
+	for _, name := range historyCaps {
+		if c.CapEnabled(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHistory sends a CHATHISTORY request and starts waiting for the
+// reply, which comes back as a batch or a FAIL.
+func (c *Client) requestHistory(target string, r HistoryRange, limit int, then func([]*Message)) (*historyRequest, *Delivery) {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	params := []string{r.sub, target}
+	for _, ref := range r.refs {
+		params = append(params, string(ref))
+	}
+	params = append(params, strconv.Itoa(limit))
+
+	m := &Message{Command: "CHATHISTORY", Params: params}
+	req := &historyRequest{target: target, done: make(chan struct{}), then: then}
+	if c.CapEnabled("labeled-response") {
+		req.label = c.newLabel()
+		m.Tags = map[string]string{"label": req.label}
+	}
+
+	// replies for a target come in the order the requests were sent, which
+	// is the order they are queued in, since they share a queue
+	c.hist.mu.Lock()
+	c.hist.pending = append(c.hist.pending, req)
+	d := c.enqueue(m)
+	c.hist.mu.Unlock()
+
+	go func() {
+		// one that's never sent will never be answered
+		if err := d.Err(); err != nil {
+			c.hist.drop(req, err)
+		}
+	}()
+	return req, d
+}
+
+// historyDone hands the messages of a chathistory batch for target to the
+// request waiting for them, which label identifies if it isn't empty.
+func (c *Client) historyDone(label, target string, msgs []*Message) {
+	req := c.hist.finish(label, target, msgs, nil)
+	if req == nil {
+		c.logger().Debug("irc: unrequested chathistory batch", slog.String("target", target))
+		return
+	}
+	if req.then != nil {
+		req.then(msgs)
+	}
+}
+
+// handleHistoryFail fails the request a FAIL CHATHISTORY reply answers:
+//
+//	FAIL CHATHISTORY <code> [<subcommand> [<target>]] :<description>
+func (c *Client) handleHistoryFail(m *Message) {
+	var target string
+	if m.NumParams() > 4 {
+		target = m.Param(3)
+	}
+	err := &HistoryError{Code: m.Param(1), Description: m.LastParam()}
+	if label := c.label(m); label != "" {
+		c.hist.finish(label, "", nil, err)
+		return
+	}
+	if c.hist.finish("", target, nil, err) == nil && target != "" {
+		c.hist.finish("", "", nil, err)
+	}
+}
+
+// seen records m's msgid as the last in its channel, for Backfill.
+func (c *Client) seen(m *Message) {
+	id := m.ID()
+	if c.Backfill == 0 || id == "" {
+		return
+	}
+	ch, ok := m.Target().(ChannelTarget)
+	if !ok {
+		return
+	}
+	c.hist.mu.Lock()
+	if c.hist.last == nil {
+		c.hist.last = make(map[string]string)
+	}
+	c.hist.last[strings.ToLower(string(ch))] = id
+	c.hist.mu.Unlock()
+}
+
+// backfill fetches what was said in channel since the last message the
+// client saw there, up to the JOIN m that brought it back, and dispatches
+// it to EventBackfill handlers.
+func (c *Client) backfill(channel string, join *Message) {
+	if c.Backfill == 0 || !c.historyEnabled() {
+		return
+	}
+	c.hist.mu.Lock()
+	last := c.hist.last[strings.ToLower(channel)]
+	c.hist.mu.Unlock()
+	if last == "" {
+		return
+	}
+
+	// stop at the JOIN, so that nothing is both backfilled and live
+	r := HistoryAfter(MsgID(last))
+	if id := join.ID(); id != "" {
+		r = HistoryBetween(MsgID(last), MsgID(id))
+	} else if t, ok := join.ServerTime(); ok {
+		r = HistoryBetween(MsgID(last), Timestamp(t))
+	}
+
+	c.logger().Debug("irc: backfilling", slog.String("channel", channel), slog.String("after", last))
+	c.requestHistory(channel, r, c.Backfill, func(msgs []*Message) {
+		for _, m := range msgs {
+			for _, h := range c.handlers[EventBackfill] {
+				h.HandleIRC(c, m)
+			}
+		}
+	})
+}
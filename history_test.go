@@ -0,0 +1,238 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestHistoryRange(t *testing.T) {
+	at := time.Date(2019, 1, 4, 15, 33, 26, 123456789, time.FixedZone("", 3600))
+	table := []struct {
+		r     HistoryRange
+		limit int
+		exp   string
+	}{
+		{HistoryLatest(""), 0, "LATEST #chan * 100"},
+		{HistoryLatest(MsgID("abc")), 5, "LATEST #chan msgid=abc 5"},
+		{HistoryBefore(Timestamp(at)), 5, "BEFORE #chan timestamp=2019-01-04T14:33:26.123Z 5"},
+		{HistoryAfter(MsgID("abc")), 5, "AFTER #chan msgid=abc 5"},
+		{HistoryAround(MsgID("abc")), 5, "AROUND #chan msgid=abc 5"},
+		{HistoryBetween(MsgID("a"), Timestamp(at)), 5, "BETWEEN #chan msgid=a timestamp=2019-01-04T14:33:26.123Z 5"},
+	}
+
+	c := &Client{Nick: "bot", User: "bot"}
+	server, r := connectCaps(t, c, "batch draft/chathistory message-tags server-time")
+	for _, test := range table {
+		go c.History(context.Background(), "#chan", test.r, test.limit)
+		if m := readMessage(t, r); m.String() != "CHATHISTORY "+test.exp {
+			t.Errorf("expect CHATHISTORY %s, got %q", test.exp, m)
+		}
+		io.WriteString(server, "FAIL CHATHISTORY MESSAGE_ERROR X #chan :no\r\n")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	live := make(chan *Message, 10)
+	c.HandleFunc("PRIVMSG", func(c *Client, m *Message) {
+		live <- m
+	})
+	server, r := connectCaps(t, c, "batch draft/chathistory message-tags server-time")
+
+	type result struct {
+		msgs []*Message
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		msgs, err := c.History(context.Background(), "#chan", HistoryLatest(""), 10)
+		done <- result{msgs, err}
+	}()
+	readMessage(t, r)
+
+	io.WriteString(server, ":irc.test BATCH +h1 chathistory #chan\r\n"+
+		"@batch=h1;msgid=1;time=2019-01-04T14:33:26.123Z :a!a@host PRIVMSG #chan :one\r\n"+
+		":b!b@host PRIVMSG #chan :live\r\n"+
+		"@batch=h1;msgid=2;time=2019-01-04T14:34:00.000Z :a!a@host PRIVMSG #chan :two\r\n"+
+		":irc.test BATCH -h1\r\n")
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if len(res.msgs) != 2 || res.msgs[0].LastParam() != "one" || res.msgs[1].LastParam() != "two" {
+		t.Fatalf("expect one and two, got %q", res.msgs)
+	}
+	if res.msgs[1].ID() != "2" || res.msgs[1].Time.Minute() != 34 {
+		t.Errorf("expect msgid and server time kept, got %q at %v", res.msgs[1].ID(), res.msgs[1].Time)
+	}
+	if m := <-live; m.LastParam() != "live" {
+		t.Errorf("expect only the live message dispatched, got %q", m)
+	}
+	select {
+	case m := <-live:
+		t.Errorf("history dispatched live: %q", m)
+	default:
+	}
+}
+
+func TestHistoryFail(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	server, r := connectCaps(t, c, "batch draft/chathistory message-tags server-time")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.History(context.Background(), "#secret", HistoryLatest(""), 0)
+		done <- err
+	}()
+	readMessage(t, r)
+	io.WriteString(server, "FAIL CHATHISTORY INVALID_TARGET LATEST #secret :Messages could not be retrieved\r\n")
+
+	var herr *HistoryError
+	if err := <-done; !errors.As(err, &herr) || herr.Code != "INVALID_TARGET" {
+		t.Errorf("expect INVALID_TARGET, got %v", err)
+	}
+}
+
+func TestHistoryCanceled(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	server, r := connectCaps(t, c, "batch draft/chathistory message-tags server-time")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.History(ctx, "#chan", HistoryLatest(""), 0)
+		done <- err
+	}()
+	readMessage(t, r)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+
+	// the server never answered, and the next reply isn't taken for it
+	go func() {
+		msgs, err := c.History(context.Background(), "#chan", HistoryLatest(""), 0)
+		if err == nil && (len(msgs) != 1 || msgs[0].LastParam() != "fresh") {
+			err = fmt.Errorf("got %q", msgs)
+		}
+		done <- err
+	}()
+	readMessage(t, r)
+	io.WriteString(server, ":irc.test BATCH +b chathistory #chan\r\n"+
+		"@batch=b :a!a@host PRIVMSG #chan :fresh\r\n:irc.test BATCH -b\r\n")
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHistoryLabeled(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	server, r := connectCaps(t, c, "batch draft/chathistory labeled-response message-tags")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.History(ctx, "#chan", HistoryLatest(""), 0)
+		done <- err
+	}()
+	stale := readMessage(t, r).Tags["label"]
+	cancel()
+	<-done
+
+	type result struct {
+		msgs []*Message
+		err  error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			msgs, err := c.History(context.Background(), "#chan", HistoryLatest(""), 0)
+			results <- result{msgs, err}
+		}()
+	}
+	first, second := readMessage(t, r).Tags["label"], readMessage(t, r).Tags["label"]
+	if stale == "" || first == "" || second == "" || first == second || stale == first {
+		t.Fatalf("expect distinct labels, got %q, %q and %q", stale, first, second)
+	}
+
+	// replies out of order, and a late one for the canceled request, are
+	// matched by label
+	io.WriteString(server, "@label="+stale+" :irc.test BATCH +s chathistory #chan\r\n"+
+		"@batch=s :a!a@host PRIVMSG #chan :stale\r\n:irc.test BATCH -s\r\n"+
+		"@label="+second+" FAIL CHATHISTORY MESSAGE_ERROR LATEST #chan :no\r\n"+
+		"@label="+first+" :irc.test BATCH +f chathistory #chan\r\n"+
+		"@batch=f :a!a@host PRIVMSG #chan :fresh\r\n:irc.test BATCH -f\r\n")
+	var ok, failed int
+	for i := 0; i < 2; i++ {
+		res := <-results
+		switch {
+		case res.err != nil:
+			failed++
+		case len(res.msgs) == 1 && res.msgs[0].LastParam() == "fresh":
+			ok++
+		default:
+			t.Errorf("got %q", res.msgs)
+		}
+	}
+	if ok != 1 || failed != 1 {
+		t.Errorf("expect one batch and one FAIL, got %d and %d", ok, failed)
+	}
+}
+
+func TestHistoryUnsupported(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	connectPipe(t, c)
+	defer c.Close()
+	if _, err := c.History(context.Background(), "#chan", HistoryLatest(""), 0); err != ErrHistoryUnsupported {
+		t.Errorf("expect ErrHistoryUnsupported, got %v", err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", Backfill: 50}
+	live := make(chan *Message, 10)
+	backfilled := make(chan *Message, 10)
+	c.HandleFunc("PRIVMSG", func(c *Client, m *Message) {
+		live <- m
+	})
+	c.HandleFunc(EventBackfill, func(c *Client, m *Message) {
+		backfilled <- m
+	})
+	server, r := connectCaps(t, c, "batch draft/chathistory message-tags server-time")
+
+	// a channel seen for the first time isn't backfilled
+	io.WriteString(server, "@msgid=j0 :bot!bot@host JOIN #chan\r\n")
+	io.WriteString(server, "@msgid=m1 :a!a@host PRIVMSG #chan :before\r\n")
+	<-live
+
+	// on rejoining, what was missed up to the JOIN is fetched
+	io.WriteString(server, "@msgid=j1 :bot!bot@host JOIN #Chan\r\n")
+	if m := readMessage(t, r); m.String() != "CHATHISTORY BETWEEN #Chan msgid=m1 msgid=j1 50" {
+		t.Fatalf("expect backfill request, got %q", m)
+	}
+	io.WriteString(server, ":irc.test BATCH +b chathistory #chan\r\n"+
+		"@batch=b;msgid=m2 :a!a@host PRIVMSG #chan :missed\r\n"+
+		"@batch=b;msgid=m3 :a!a@host NOTICE #chan :also missed\r\n"+
+		":irc.test BATCH -b\r\n")
+
+	for _, exp := range []string{"PRIVMSG missed", "NOTICE also missed"} {
+		select {
+		case m := <-backfilled:
+			if m.Command+" "+m.LastParam() != exp {
+				t.Errorf("expect %s, got %q", exp, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect %s backfilled", exp)
+		}
+	}
+	select {
+	case m := <-live:
+		t.Errorf("backfill dispatched live: %q", m)
+	default:
+	}
+}
@@ -2,7 +2,7 @@ package irc
 
 import (
 	"errors"
-	"fmt"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -16,37 +16,92 @@ var (
 	errMessageInvalid  = errors.New("malformed message")
 )
 
+// A Hostmask identifies the source of a message: a server by name, or a
+// user by nick, with the user's ident and host when the server gives them.
 type Hostmask struct {
 	Nick    string
 	User    string
 	Address string
 }
 
+// A HostmaskError reports a hostmask that couldn't be parsed.
+type HostmaskError struct {
+	Input string
+	Err   error
+}
+
+func (e *HostmaskError) Error() string {
+	return "irc: " + e.Err.Error() + " " + strconv.Quote(e.Input)
+}
+
+func (e *HostmaskError) Unwrap() error {
+	return e.Err
+}
+
+// ParseHostmask parses any of the prefix forms in RFC 2812: servername,
+// nick, nick@host, nick!user@host, and also nick!user. A bare name is taken
+// to be a server if it contains a dot, which nicks can't, and a nick
+// otherwise. Errors are of type *HostmaskError.
 func ParseHostmask(s string) (*Hostmask, error) {
+	h := new(Hostmask)
+	if err := parseHostmask(s, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parseHostmask parses s into h.
+func parseHostmask(s string, h *Hostmask) error {
 	if len(s) == 0 {
-		return nil, errHostmaskEmpty
+		return &HostmaskError{s, errHostmaskEmpty}
 	}
 
-	bang := strings.Index(s, "!")
-	at := strings.Index(s, "@")
+	bang := strings.IndexByte(s, '!')
+	at := strings.IndexByte(s, '@')
 
-	if bang == -1 && at == -1 {
-		return &Hostmask{Address: s}, nil
+	if bang < 0 && at < 0 {
+		if strings.IndexByte(s, '.') >= 0 {
+			*h = Hostmask{Address: s}
+		} else {
+			*h = Hostmask{Nick: s}
+		}
+		return nil
 	}
 
-	// empty nick or no bang || no at || bang happens after at or user is empty
-	if bang < 1 || at < 0 || bang > (at-2) {
-		return nil, errHostmaskInvalid
+	// the nick ends at whichever of ! or @ comes first, and the user, if
+	// any, at the @
+	end, userEnd := at, len(s)
+	if bang >= 0 {
+		if at >= 0 && at < bang {
+			return &HostmaskError{s, errHostmaskInvalid}
+		}
+		end = bang
+		if at >= 0 {
+			userEnd = at
+		}
 	}
 
-	return &Hostmask{s[:bang], s[bang+1 : at], s[at+1:]}, nil
+	*h = Hostmask{Nick: s[:end]}
+	if bang >= 0 {
+		h.User = s[bang+1 : userEnd]
+	}
+	if at >= 0 {
+		h.Address = s[at+1:]
+	}
+	if h.Nick == "" || (bang >= 0 && h.User == "") || (at >= 0 && h.Address == "") {
+		return &HostmaskError{s, errHostmaskInvalid}
+	}
+	return nil
+}
+
+// IsServer reports whether h names a server rather than a user.
+func (h *Hostmask) IsServer() bool {
+	return h.Nick == ""
 }
 
 func (h *Hostmask) String() string {
-	if h.Nick == "" && h.User == "" {
-		return h.Address
-	}
-	return fmt.Sprintf("%s!%s@%s", h.Nick, h.User, h.Address)
+	var buf [128]byte
+	return string(h.AppendTo(buf[:0]))
 }
 
 func (h *Hostmask) MatchString(other string) bool {
@@ -203,125 +258,106 @@ func (t ChannelTarget) Name() string { return string(t) }
 func (t UserTarget) Name() string    { return string(t) }
 
 type Message struct {
-	Time     time.Time
+	Tags map[string]string // IRCv3 message tags, unescaped
+
+	// Time is when the message was sent: for messages from the server,
+	// either its server-time or Received, as Client.TimeSource selects.
+	Time time.Time
+
+	// Received is when the client read the message from the server.
+	Received time.Time
+
 	From     *Hostmask
 	Command  string
 	Params   []string
 	Trailing string
+
+	// HasTrailing records that m has a trailing param, so that an empty one
+	// survives a round trip. A non-empty Trailing is always written in the
+	// colon form, whether HasTrailing is set or not.
+	HasTrailing bool
 }
 
 func (m *Message) String() string {
-	s := ""
-	if m.From != nil {
-		s += ":" + m.From.String() + " "
-	}
-	if m.Command != "" {
-		s += m.Command
-	}
-	if m.Params != nil && len(m.Params) > 0 {
-		s += " " + strings.Join(m.Params, " ")
-	}
-	if m.Trailing != "" {
-		s += " :" + m.Trailing
-	}
-	return s
+	var buf [512]byte
+	return string(m.AppendTo(buf[:0]))
 }
 
 // parse message with optional timestamp
 func ParseMessage(s string, t ...time.Time) (*Message, error) {
-	/*
-			RFC2812 §2.3.1
-		    message    =  [ ":" prefix SPACE ] command [ params ] crlf
-		    prefix     =  servername / ( nickname [ [ "!" user ] "@" host ] )
-		    command    =  1*letter / 3digit
-		    params     =  *14( SPACE middle ) [ SPACE ":" trailing ]
-		               =/ 14( SPACE middle ) [ SPACE [ ":" ] trailing ]
-
-		    nospcrlfcl =  %x01-09 / %x0B-0C / %x0E-1F / %x21-39 / %x3B-FF
-		                    ; any octet except NUL, CR, LF, " " and ":"
-		    middle     =  nospcrlfcl *( ":" / nospcrlfcl )
-		    trailing   =  *( ":" / " " / nospcrlfcl )
-
-		    SPACE      =  %x20        ; space character
-		    crlf       =  %x0D %x0A   ; "carriage return" "linefeed"
-	*/
-
-	if len(s) == 0 {
-		return nil, errMessageEmpty
-	}
-
 	m := &Message{}
+	if err := parseMessage(s, m); err != nil {
+		return nil, err
+	}
 	if len(t) > 0 {
 		m.Time = t[0]
 	}
+	return m, nil
+}
 
-	s = strings.TrimSpace(s)
-
-	// prefix
-	if s[0] == ':' {
-		i := strings.Index(s, " ")
-		if i < 0 {
-			// host only and nothing else? pretty weird
-			return nil, errMessageInvalid
-		}
-		hs := s[1:i]
-		s = s[i+1:]
+// ServerTime returns the time from the IRCv3 server-time tag of m, and
+// whether it had a valid one.
+func (m *Message) ServerTime() (time.Time, bool) {
+	v, ok := m.Tags["time"]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
 
-		h, err := ParseHostmask(hs)
-		if err != nil {
-			return nil, err
-		}
+// ID returns the IRCv3 msgid tag of m, which the server uses to refer to
+// it, or "" if it has none.
+func (m *Message) ID() string {
+	return m.Tags["msgid"]
+}
 
-		m.From = h
-	}
+// hasTrailing reports whether m has a trailing param, empty or not.
+func (m *Message) hasTrailing() bool {
+	return m.HasTrailing || m.Trailing != ""
+}
 
-	s = strings.TrimSpace(s)
-	if m.From != nil && s == "" {
-		return nil, errMessageInvalid
+// NumParams returns how many params m has, counting the trailing one.
+func (m *Message) NumParams() int {
+	if m.hasTrailing() {
+		return len(m.Params) + 1
 	}
+	return len(m.Params)
+}
 
-	// command
-	i := strings.Index(s, " ")
-	if i < 0 {
-		// no space means the command is the last element
-		m.Command = strings.ToUpper(s)
-		return m, nil
-	} else {
-		m.Command = strings.ToUpper(s[:i])
-		s = s[i+1:]
+// Param returns the ith param of m, counting the trailing one as the last,
+// or "" if there are not that many. It makes no difference whether the
+// sender used the colon form, so "PRIVMSG #c hi" and "PRIVMSG #c :hi" both
+// have "hi" as Param(1).
+func (m *Message) Param(i int) string {
+	switch {
+	case i < 0:
+		return ""
+	case i < len(m.Params):
+		return m.Params[i]
+	case i == len(m.Params):
+		return m.Trailing
 	}
+	return ""
+}
 
-	// params or trailing
+// LastParam returns the last param of m, whether or not it was trailing.
+func (m *Message) LastParam() string {
+	return m.Param(m.NumParams() - 1)
+}
 
-	for {
-		if len(s) == 0 {
-			return m, nil
-		}
-		switch s[0] {
-		case ' ':
-			s = s[1:]
-		case ':':
-			m.Trailing = s[1:]
-			return m, nil
-		default:
-			if len(m.Params) == 14 {
-				// Max 14 params. If there are 14 then a colon isn't required
-				// for the trailing. So we just pack up the rest and leave once
-				// we reach 14 params.
-				m.Trailing = s
-				return m, nil
-			}
-			i = strings.Index(s, " ")
-			if i < 0 {
-				m.Params = append(m.Params, s)
-				return m, nil
-			}
-			m.Params = append(m.Params, s[:i])
-			s = s[i+1:]
-		}
+// AllParams returns the params of m with the trailing one, if any, appended.
+// It only allocates when there is a trailing param.
+func (m *Message) AllParams() []string {
+	if !m.hasTrailing() {
+		return m.Params
 	}
-
-	panic("unreachable")
+	params := make([]string, len(m.Params), len(m.Params)+1)
+	copy(params, m.Params)
+	return append(params, m.Trailing)
 }
 
 func (m *Message) Target() MessageTarget {
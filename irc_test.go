@@ -1,6 +1,7 @@
 package irc
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 )
@@ -14,13 +15,17 @@ type hostmaskTest struct {
 func TestParseHostmask(t *testing.T) {
 	table := []hostmaskTest{
 		{"", nil, errHostmaskEmpty},
-		{"host", &Hostmask{Address: "host"}, nil},
+		{"host", &Hostmask{Nick: "host"}, nil},
 		{"server.host.tld", &Hostmask{Address: "server.host.tld"}, nil},
-		{"nick!malformed", nil, errHostmaskInvalid},
-		{"user@malformed", nil, errHostmaskInvalid},
+		{"nick!user", &Hostmask{Nick: "nick", User: "user"}, nil},
+		{"nick@host", &Hostmask{Nick: "nick", Address: "host"}, nil},
 		{"nick@user!malformed", nil, errHostmaskInvalid},
 		{"!user@malformed", nil, errHostmaskInvalid},
 		{"nick!@malformed", nil, errHostmaskInvalid},
+		{"nick!user@", nil, errHostmaskInvalid},
+		{"nick@", nil, errHostmaskInvalid},
+		{"nick!", nil, errHostmaskInvalid},
+		{"@host", nil, errHostmaskInvalid},
 		{"!@", nil, errHostmaskInvalid},
 		{"@!", nil, errHostmaskInvalid},
 		{"!", nil, errHostmaskInvalid},
@@ -32,9 +37,34 @@ func TestParseHostmask(t *testing.T) {
 
 	for _, test := range table {
 		h, err := ParseHostmask(test.s)
-		if !reflect.DeepEqual(h, test.expectResult) || err != test.expectError {
+		if !reflect.DeepEqual(h, test.expectResult) || !errors.Is(err, test.expectError) {
 			t.Errorf("%q: expect %v (%v), got %v (%v)", test.s, test.expectResult, test.expectError, h, err)
 		}
+		if err == nil && h.String() != test.s {
+			t.Errorf("%q: String gives %q", test.s, h.String())
+		}
+
+		var herr *HostmaskError
+		if err != nil && (!errors.As(err, &herr) || herr.Input != test.s) {
+			t.Errorf("%q: expect *HostmaskError carrying the input, got %#v", test.s, err)
+		}
+	}
+}
+
+func TestHostmaskIsServer(t *testing.T) {
+	for s, server := range map[string]bool{
+		"irc.example.net": true,
+		"NickServ":        false,
+		"nick@host":       false,
+		"nick!user@host":  false,
+	} {
+		h, err := ParseHostmask(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.IsServer() != server {
+			t.Errorf("%q: expect IsServer %t", s, server)
+		}
 	}
 }
 
@@ -63,12 +93,12 @@ func TestParseMessage(t *testing.T) {
 		},
 		{
 			"PING :a.b.c",
-			&Message{Command: "PING", Trailing: "a.b.c"},
+			&Message{Command: "PING", Trailing: "a.b.c", HasTrailing: true},
 			nil,
 		},
 		{
 			":moshee!~moshee@mo.sh.ee PRIVMSG #roboworld :hi",
-			&Message{From: &Hostmask{"moshee", "~moshee", "mo.sh.ee"}, Command: "PRIVMSG", Params: []string{"#roboworld"}, Trailing: "hi"},
+			&Message{From: &Hostmask{"moshee", "~moshee", "mo.sh.ee"}, Command: "PRIVMSG", Params: []string{"#roboworld"}, Trailing: "hi", HasTrailing: true},
 			nil,
 		},
 		{
@@ -88,12 +118,12 @@ func TestParseMessage(t *testing.T) {
 		},
 		{
 			":a.b.c CMD param1 param2 :trailing",
-			&Message{From: &Hostmask{Address: "a.b.c"}, Command: "CMD", Params: []string{"param1", "param2"}, Trailing: "trailing"},
+			&Message{From: &Hostmask{Address: "a.b.c"}, Command: "CMD", Params: []string{"param1", "param2"}, Trailing: "trailing", HasTrailing: true},
 			nil,
 		},
 		{
 			":a.b.c CMD param:1 p:aram2 :trailing trailing",
-			&Message{From: &Hostmask{Address: "a.b.c"}, Command: "CMD", Params: []string{"param:1", "p:aram2"}, Trailing: "trailing trailing"},
+			&Message{From: &Hostmask{Address: "a.b.c"}, Command: "CMD", Params: []string{"param:1", "p:aram2"}, Trailing: "trailing trailing", HasTrailing: true},
 			nil,
 		},
 		{
@@ -104,13 +134,34 @@ func TestParseMessage(t *testing.T) {
 				Params: []string{
 					"p1", "p2", "p3", "p4", "p5", "p6", "p7", "p8", "p9", "p10", "p11", "p12", "p13", "p14",
 				},
-				Trailing: "trailing trailing trailing",
+				Trailing:    "trailing trailing trailing",
+				HasTrailing: true,
 			},
 			nil,
 		},
 		{
 			":a.b.c CMD :trailing trailing",
-			&Message{From: &Hostmask{Address: "a.b.c"}, Command: "CMD", Trailing: "trailing trailing"},
+			&Message{From: &Hostmask{Address: "a.b.c"}, Command: "CMD", Trailing: "trailing trailing", HasTrailing: true},
+			nil,
+		},
+		{
+			"TOPIC #chan :",
+			&Message{Command: "TOPIC", Params: []string{"#chan"}, HasTrailing: true},
+			nil,
+		},
+		{
+			":NickServ!NickServ@services NOTICE bot :hi",
+			&Message{From: &Hostmask{"NickServ", "NickServ", "services"}, Command: "NOTICE", Params: []string{"bot"}, Trailing: "hi", HasTrailing: true},
+			nil,
+		},
+		{
+			":bouncer@znc.in NOTICE bot :hi",
+			&Message{From: &Hostmask{Nick: "bouncer", Address: "znc.in"}, Command: "NOTICE", Params: []string{"bot"}, Trailing: "hi", HasTrailing: true},
+			nil,
+		},
+		{
+			":newnick NICK other",
+			&Message{From: &Hostmask{Nick: "newnick"}, Command: "NICK", Params: []string{"other"}},
 			nil,
 		},
 		{
@@ -118,6 +169,16 @@ func TestParseMessage(t *testing.T) {
 			nil,
 			errMessageInvalid,
 		},
+		{
+			"PRIVMSG #a :x\r\nQUIT",
+			nil,
+			errMessageInvalid,
+		},
+		{
+			"PRIVMSG #a :trailing spaces  \r\n",
+			&Message{Command: "PRIVMSG", Params: []string{"#a"}, Trailing: "trailing spaces  ", HasTrailing: true},
+			nil,
+		},
 	}
 
 	for _, test := range table {
@@ -127,3 +188,64 @@ func TestParseMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestMessageParams(t *testing.T) {
+	table := []struct {
+		s      string
+		expect []string
+	}{
+		{"PRIVMSG #c :hi there", []string{"#c", "hi there"}},
+		{"PRIVMSG #c hi", []string{"#c", "hi"}},
+		{"TOPIC #c :", []string{"#c", ""}},
+		{"PING :a.b.c", []string{"a.b.c"}},
+		{"QUIT", nil},
+	}
+
+	for _, test := range table {
+		m, err := ParseMessage(test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params := m.AllParams(); !reflect.DeepEqual(params, test.expect) {
+			t.Errorf("%q: expect %q, got %q", test.s, test.expect, params)
+		}
+		if m.NumParams() != len(test.expect) {
+			t.Errorf("%q: expect %d params, got %d", test.s, len(test.expect), m.NumParams())
+		}
+		for i := -1; i <= len(test.expect); i++ {
+			expect := ""
+			if i >= 0 && i < len(test.expect) {
+				expect = test.expect[i]
+			}
+			if p := m.Param(i); p != expect {
+				t.Errorf("%q: expect Param(%d) = %q, got %q", test.s, i, expect, p)
+			}
+		}
+		if len(test.expect) > 0 && m.LastParam() != test.expect[len(test.expect)-1] {
+			t.Errorf("%q: got LastParam %q", test.s, m.LastParam())
+		}
+		if m.String() != test.s {
+			t.Errorf("%q: String gives %q", test.s, m.String())
+		}
+	}
+}
+
+func FuzzParseHostmask(f *testing.F) {
+	for _, s := range []string{"nick!user@host", "irc.example.net", "n!u@h@x", "n!u!v@h", "!u@h", "n!@h", "n@h", "n!u", "nick", "n@h!u"} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		h, err := ParseHostmask(s)
+		if err != nil {
+			return
+		}
+		back, err := ParseHostmask(h.String())
+		if err != nil {
+			t.Fatalf("%q parsed, but its encoding %q doesn't: %v", s, h.String(), err)
+		}
+		if *back != *h {
+			t.Fatalf("%q: encoding %q parses to %+v, expect %+v", s, h.String(), back, h)
+		}
+	})
+}
@@ -0,0 +1,424 @@
+// Package irctest provides an in-process fake IRC server for testing
+// clients offline. A Server hands out connections through its Dial method,
+// which satisfies irc.Dialer; the test then drives each connection with a
+// Conn, scripting what the server says and asserting on what the client
+// sent.
+//
+// Conn methods that wait for the client fail the test when it doesn't
+// deliver in time, so like testing.T.Fatal they must be called from the
+// goroutine running the test.
+package irctest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"ktkr.us/pkg/irc"
+)
+
+// DefaultTimeout is how long a Server waits for the client when
+// Server.Timeout is zero.
+const DefaultTimeout = 5 * time.Second
+
+// A Server is a fake IRC server. Its fields configure what it tells clients
+// and must not be changed once it has been dialed.
+type Server struct {
+	// Name is the server name used as the prefix of server messages. If
+	// empty, "irc.test" is used.
+	Name string
+
+	// Greeting is the line sent as soon as a client connects, which the
+	// client waits for before registering. If empty, a NOTICE is sent.
+	Greeting string
+
+	// NoGreeting stops the server sending Greeting, leaving the client
+	// waiting for its first line.
+	NoGreeting bool
+
+	// Caps are the capabilities offered in reply to CAP LS, with their
+	// values, or "" for none.
+	Caps map[string]string
+
+	// Accounts maps SASL PLAIN account names to passwords.
+	Accounts map[string]string
+
+	// Taken are nicks held by other users, which Register refuses with
+	// ERR_NICKNAMEINUSE.
+	Taken []string
+
+	// ISupport are the tokens sent in RPL_ISUPPORT (005). If nil, a few
+	// common ones are sent.
+	ISupport []string
+
+	// Timeout bounds every wait for the client. If zero, DefaultTimeout is
+	// used.
+	Timeout time.Duration
+
+	t     testing.TB
+	conns chan *Conn
+
+	mu  sync.Mutex
+	all []*Conn
+}
+
+// NewServer returns a Server whose connections are closed when the test
+// finishes.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		t:     t,
+		conns: make(chan *Conn, 16),
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *Server) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return "irc.test"
+}
+
+func (s *Server) taken(nick string) bool {
+	for _, t := range s.Taken {
+		if strings.EqualFold(t, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout != 0 {
+		return s.Timeout
+	}
+	return DefaultTimeout
+}
+
+// Dial connects to the server over a net.Pipe, whatever addr is. The
+// server's end is handed to the next call to Accept.
+func (s *Server) Dial(network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	c := newConn(s, server, addr)
+
+	if !s.NoGreeting {
+		greeting := s.Greeting
+		if greeting == "" {
+			greeting = ":" + s.name() + " NOTICE * :*** Welcome to irctest"
+		}
+		c.Send(greeting)
+	}
+
+	s.mu.Lock()
+	s.all = append(s.all, c)
+	s.mu.Unlock()
+
+	select {
+	case s.conns <- c:
+		return client, nil
+	default:
+		c.Close()
+		client.Close()
+		return nil, errors.New("irctest: too many connections waiting for Accept")
+	}
+}
+
+// Accept returns the next connection made with Dial, failing the test if
+// there is none in time.
+func (s *Server) Accept() *Conn {
+	s.t.Helper()
+	select {
+	case c := <-s.conns:
+		return c
+	case <-time.After(s.timeout()):
+		s.t.Fatalf("irctest: no connection after %v", s.timeout())
+		return nil
+	}
+}
+
+// Close closes every connection the server has made.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.all {
+		c.Close()
+	}
+}
+
+// A Conn is the server's end of a connection from a client.
+type Conn struct {
+	// Addr is the address the client dialed.
+	Addr string
+
+	// Pass, Nick, User and Realname are filled in by Register from what the
+	// client sent.
+	Pass     string
+	Nick     string
+	User     string
+	Realname string
+
+	// Caps holds the capabilities the client has enabled with CAP REQ.
+	Caps map[string]bool
+
+	// Account is the account the client logged in to with SASL, if any.
+	Account string
+
+	s    *Server
+	t    testing.TB
+	conn net.Conn
+	in   chan *irc.Message // closed when the client hangs up
+	out  chan write
+
+	sasl struct {
+		mech string
+		buf  strings.Builder
+	}
+
+	mu   sync.Mutex
+	sent []*irc.Message
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// write is a line for the writer goroutine, or a flush request if done is
+// set.
+type write struct {
+	line string
+	done chan struct{}
+}
+
+func newConn(s *Server, conn net.Conn, addr string) *Conn {
+	c := &Conn{
+		Addr:   addr,
+		Caps:   make(map[string]bool),
+		s:      s,
+		t:      s.t,
+		conn:   conn,
+		in:     make(chan *irc.Message, 256),
+		out:    make(chan write, 256),
+		closed: make(chan struct{}),
+	}
+	go c.readLoop()
+	go c.writeLoop()
+	return c
+}
+
+func (c *Conn) readLoop() {
+	defer close(c.in)
+
+	sc := bufio.NewScanner(c.conn)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		m, err := irc.ParseMessage(line)
+		if err != nil {
+			c.t.Errorf("irctest: client sent malformed line %q: %v", line, err)
+			continue
+		}
+		c.mu.Lock()
+		c.sent = append(c.sent, m)
+		c.mu.Unlock()
+
+		select {
+		case c.in <- m:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *Conn) writeLoop() {
+	for {
+		select {
+		case w := <-c.out:
+			if w.done != nil {
+				close(w.done)
+				continue
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(c.s.timeout()))
+			if _, err := c.conn.Write([]byte(w.line + "\r\n")); err != nil {
+				c.t.Logf("irctest: dropped %q: %v", w.line, err)
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Send sends a raw line to the client. It doesn't wait for the client to
+// read it, and lines are delivered in the order they were sent.
+func (c *Conn) Send(line string) {
+	select {
+	case c.out <- write{line: line}:
+	case <-c.closed:
+	}
+}
+
+// Sendf formats a line and sends it to the client.
+func (c *Conn) Sendf(format string, args ...interface{}) {
+	c.Send(fmt.Sprintf(format, args...))
+}
+
+// Reply sends a message from the server addressed to the client, as
+// numerics are: the client's nick, or "*" before it has one, is inserted as
+// the first param. The last param is sent as the trailing one.
+func (c *Conn) Reply(cmd string, params ...string) {
+	m := &irc.Message{
+		From:    &irc.Hostmask{Address: c.s.name()},
+		Command: cmd,
+		Params:  append([]string{c.target()}, params...),
+	}
+	c.Send(trailing(m).String())
+}
+
+// Flush waits until every line sent so far has been read by the client.
+func (c *Conn) Flush() {
+	done := make(chan struct{})
+	select {
+	case c.out <- write{done: done}:
+	case <-c.closed:
+		return
+	}
+	select {
+	case <-done:
+	case <-c.closed:
+	}
+}
+
+// Next returns the next message from the client, failing the test if none
+// arrives in time or the client hangs up.
+func (c *Conn) Next() *irc.Message {
+	c.t.Helper()
+	select {
+	case m, ok := <-c.in:
+		if !ok {
+			c.t.Fatal("irctest: client hung up")
+		}
+		return m
+	case <-time.After(c.s.timeout()):
+		c.t.Fatalf("irctest: client sent nothing for %v", c.s.timeout())
+		return nil
+	}
+}
+
+// Expect returns the next message from the client, failing the test unless
+// it has the command cmd and starts with params.
+func (c *Conn) Expect(cmd string, params ...string) *irc.Message {
+	c.t.Helper()
+	m := c.Next()
+	if !matches(m, cmd, params) {
+		c.t.Fatalf("irctest: expect %s %q, got %q", cmd, params, m)
+	}
+	return m
+}
+
+// ExpectLine returns the next message from the client, failing the test
+// unless it encodes to line.
+func (c *Conn) ExpectLine(line string) *irc.Message {
+	c.t.Helper()
+	m := c.Next()
+	if s := m.String(); s != line {
+		c.t.Fatalf("irctest: expect %q, got %q", line, s)
+	}
+	return m
+}
+
+// ExpectEventually discards messages from the client until one matches as
+// for Expect, and returns it.
+func (c *Conn) ExpectEventually(cmd string, params ...string) *irc.Message {
+	c.t.Helper()
+	for {
+		if m := c.Next(); matches(m, cmd, params) {
+			return m
+		}
+	}
+}
+
+// ExpectNothing fails the test if the client sends anything within d.
+func (c *Conn) ExpectNothing(d time.Duration) {
+	c.t.Helper()
+	select {
+	case m, ok := <-c.in:
+		if ok {
+			c.t.Fatalf("irctest: expect nothing, got %q", m)
+		}
+	case <-time.After(d):
+	}
+}
+
+// ExpectClosed fails the test unless the client hangs up in time. Anything
+// it sends first is discarded.
+func (c *Conn) ExpectClosed() {
+	c.t.Helper()
+	timeout := time.After(c.s.timeout())
+	for {
+		select {
+		case _, ok := <-c.in:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			c.t.Fatalf("irctest: client still connected after %v", c.s.timeout())
+		}
+	}
+}
+
+// Sent returns every message the client has sent so far, including ones
+// not yet returned by Next.
+func (c *Conn) Sent() []*irc.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*irc.Message(nil), c.sent...)
+}
+
+// Close hangs up on the client without a word.
+func (c *Conn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// Hostmask returns the client's hostmask as the server reports it.
+func (c *Conn) Hostmask() *irc.Hostmask {
+	return &irc.Hostmask{Nick: c.Nick, User: c.User, Address: "127.0.0.1"}
+}
+
+// target returns the client's nick, or "*" if it doesn't have one yet.
+func (c *Conn) target() string {
+	if c.Nick == "" {
+		return "*"
+	}
+	return c.Nick
+}
+
+// matches reports whether m has the command cmd and starts with params.
+func matches(m *irc.Message, cmd string, params []string) bool {
+	if !strings.EqualFold(m.Command, cmd) {
+		return false
+	}
+	for i, p := range params {
+		if m.Param(i) != p {
+			return false
+		}
+	}
+	return true
+}
+
+// trailing moves the last param of m into the trailing position, so that
+// it may contain spaces.
+func trailing(m *irc.Message) *irc.Message {
+	if n := len(m.Params); n > 0 && !m.HasTrailing {
+		m.Trailing = m.Params[n-1]
+		m.Params = m.Params[:n-1]
+		m.HasTrailing = true
+	}
+	return m
+}
@@ -0,0 +1,267 @@
+package irctest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"ktkr.us/pkg/irc"
+)
+
+func connect(t *testing.T, s *Server, c *irc.Client) *Conn {
+	t.Helper()
+	c.Dialer = s
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return s.Accept()
+}
+
+func TestRegister(t *testing.T) {
+	s := NewServer(t)
+	c := &irc.Client{Addr: "irc.example.net:6697", Nick: "bot", User: "botuser", Realname: "A Bot", Pass: "letmein"}
+	welcome := make(chan *irc.Message, 1)
+	c.HandleFunc("001", func(c *irc.Client, m *irc.Message) {
+		welcome <- m
+	})
+
+	conn := connect(t, s, c)
+	conn.Register()
+	if conn.Addr != "irc.example.net:6697" {
+		t.Errorf("client dialed %q", conn.Addr)
+	}
+	if conn.Pass != "letmein" || conn.Nick != "bot" || conn.User != "botuser" || conn.Realname != "A Bot" {
+		t.Errorf("registered as %+v", conn)
+	}
+
+	select {
+	case m := <-welcome:
+		if m.Param(0) != "bot" {
+			t.Errorf("001 addressed to %q", m.Param(0))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client never saw 001")
+	}
+
+	var cmds []string
+	for _, m := range conn.Sent() {
+		cmds = append(cmds, m.Command+" "+m.Param(0))
+	}
+	if s := strings.Join(cmds, ", "); s != "CAP LS, PASS letmein, USER botuser, NICK bot, CAP END" {
+		t.Errorf("client sent %s", s)
+	}
+}
+
+func TestNickTaken(t *testing.T) {
+	s := NewServer(t)
+	s.Taken = []string{"bot"}
+	c := &irc.Client{Nick: "bot", User: "bot", NickStrategy: irc.NickFallback{Alternatives: []string{"bot_"}}}
+	conn := connect(t, s, c)
+	conn.Register()
+	if conn.Nick != "bot_" {
+		t.Errorf("expect registered as bot_, got %q", conn.Nick)
+	}
+
+	conn.Ping("sync")
+	if c.CurrentNick() != "bot_" {
+		t.Errorf("expect current nick bot_, got %q", c.CurrentNick())
+	}
+}
+
+func TestCapSASL(t *testing.T) {
+	s := NewServer(t)
+	s.Caps = map[string]string{"sasl": "PLAIN", "server-time": ""}
+	s.Accounts = map[string]string{"bot": "hunter2"}
+
+	client, err := s.Dial("tcp", "irc.test:6667")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := s.Accept()
+
+	payload := base64.StdEncoding.EncodeToString([]byte("\x00bot\x00hunter2"))
+	go io.WriteString(client, "CAP LS 302\r\nNICK bot\r\nUSER bot 0 * :Bot\r\n"+
+		"CAP REQ :sasl bogus\r\nCAP REQ :sasl\r\n"+
+		"AUTHENTICATE PLAIN\r\nAUTHENTICATE "+payload+"\r\nCAP END\r\n")
+	conn.Register()
+
+	if !conn.Caps["sasl"] || conn.Caps["server-time"] || conn.Account != "bot" {
+		t.Errorf("expect sasl enabled and logged in, got caps %v account %q", conn.Caps, conn.Account)
+	}
+
+	r := bufio.NewReader(client)
+	for _, expect := range []string{
+		":irc.test NOTICE * :*** Welcome to irctest",
+		":irc.test CAP * LS :sasl=PLAIN server-time",
+		":irc.test CAP bot NAK :sasl bogus",
+		":irc.test CAP bot ACK :sasl",
+		"AUTHENTICATE +",
+		":irc.test 900 bot bot!bot@127.0.0.1 bot :You are now logged in as bot",
+		":irc.test 903 bot :SASL authentication successful",
+		":irc.test 001 bot :Welcome to the irctest IRC network bot!bot@127.0.0.1",
+	} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expect+"\r\n" {
+			t.Errorf("expect %q, got %q", expect, line)
+		}
+	}
+}
+
+func TestSASLFailure(t *testing.T) {
+	s := NewServer(t)
+	s.Caps = map[string]string{"sasl": ""}
+	s.Accounts = map[string]string{"bot": "hunter2"}
+
+	client, _ := s.Dial("tcp", "")
+	defer client.Close()
+	conn := s.Accept()
+
+	payload := base64.StdEncoding.EncodeToString([]byte("\x00bot\x00wrong"))
+	go io.WriteString(client, "CAP LS\r\nCAP REQ sasl\r\nAUTHENTICATE PLAIN\r\nAUTHENTICATE "+payload+"\r\nNICK bot\r\nUSER bot 0 * bot\r\nCAP END\r\n")
+	conn.Register()
+	if conn.Account != "" {
+		t.Errorf("expect no account, got %q", conn.Account)
+	}
+
+	r := bufio.NewReader(client)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, " 904 ") {
+			break
+		}
+		if strings.Contains(line, " 900 ") || strings.Contains(line, " 001 ") {
+			t.Fatalf("expect 904 first, got %q", line)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	s := NewServer(t)
+	c := &irc.Client{Nick: "bot", User: "bot"}
+	names := make(chan string, 1)
+	c.HandleFunc("353", func(c *irc.Client, m *irc.Message) {
+		names <- m.LastParam()
+	})
+	conn := connect(t, s, c)
+	conn.Register()
+
+	c.JOIN("#chan", "key")
+	conn.Join("#chan", "alice", "@bob")
+	select {
+	case n := <-names:
+		if n != "bot alice @bob" {
+			t.Errorf("got names %q", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client never saw 353")
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := NewServer(t)
+	c := &irc.Client{Nick: "bot", User: "bot", PingTimeout: 100 * time.Millisecond}
+	lag := make(chan string, 1)
+	c.HandleFunc(irc.EventLag, func(c *irc.Client, m *irc.Message) {
+		lag <- m.Param(0)
+	})
+	conn := connect(t, s, c)
+	conn.Register()
+
+	if rtt := conn.Ping("abc"); rtt > time.Second {
+		t.Errorf("round trip took %v", rtt)
+	}
+
+	conn.AnswerPing(10 * time.Millisecond)
+	select {
+	case d := <-lag:
+		if lag, _ := time.ParseDuration(d); lag < 10*time.Millisecond {
+			t.Errorf("expect lag of at least 10ms, got %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no lag measured")
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	s := NewServer(t)
+	c := &irc.Client{Nick: "bot", User: "bot"}
+	conn := connect(t, s, c)
+	conn.Register()
+
+	conn.Disconnect("K-Lined")
+	err := c.Run()
+	if err == nil || !strings.Contains(err.Error(), "K-Lined") {
+		t.Errorf("expect server error, got %v", err)
+	}
+}
+
+func TestHangUpBeforeGreeting(t *testing.T) {
+	s := NewServer(t)
+	s.NoGreeting = true
+	c := &irc.Client{Nick: "bot", User: "bot", Dialer: s}
+	errs := make(chan error, 1)
+	go func() { errs <- c.Connect() }()
+
+	s.Accept().Close()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("expect Connect to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Connect did not return after the server hung up")
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	s := NewServer(t)
+	c := &irc.Client{Nick: "bot", User: "bot"}
+	conn := connect(t, s, c)
+	conn.Register()
+
+	c.PRIVMSG("#chan", "bye all")
+	done := make(chan error, 1)
+	go func() { done <- c.Quit("done here") }()
+
+	conn.Expect("PRIVMSG", "#chan", "bye all")
+	if m := conn.ExpectQuit(); m.LastParam() != "done here" {
+		t.Errorf("got QUIT %q", m)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Quit: %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s := NewServer(t)
+	c := &irc.Client{Nick: "bot", User: "bot"}
+	conn := connect(t, s, c)
+	conn.Register()
+	conn.Close()
+	if err := c.Run(); err == nil {
+		t.Error("expect error after server hung up")
+	}
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	conn = s.Accept()
+	conn.Register()
+	c.PRIVMSG("#chan", "back")
+	conn.ExpectLine("PRIVMSG #chan :back")
+	conn.ExpectNothing(20 * time.Millisecond)
+}
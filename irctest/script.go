@@ -0,0 +1,232 @@
+package irctest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ktkr.us/pkg/irc"
+)
+
+// Register plays the server's part of registration and sends the welcome
+// burst. It takes PASS, NICK and USER, refusing nicks in Server.Taken, and
+// answers CAP negotiation and SASL PLAIN against Server.Caps and
+// Server.Accounts, in whatever order the client sends them. The burst
+// follows once the client has a nick and user and has ended any CAP
+// negotiation. Anything else from the client before then fails the test.
+func (c *Conn) Register() {
+	c.t.Helper()
+	negotiating := false
+	for c.Nick == "" || c.User == "" || negotiating {
+		m := c.Next()
+		switch m.Command {
+		case "PASS":
+			c.Pass = m.Param(0)
+		case "NICK":
+			if c.s.taken(m.Param(0)) {
+				c.Reply("433", m.Param(0), "Nickname is already in use")
+				continue
+			}
+			c.Nick = m.Param(0)
+		case "USER":
+			c.User = m.Param(0)
+			c.Realname = m.Param(3)
+		case "CAP":
+			negotiating = c.cap(m, negotiating)
+		case "AUTHENTICATE":
+			c.authenticate(m)
+		default:
+			c.t.Fatalf("irctest: unexpected %q during registration", m)
+		}
+	}
+	c.Welcome()
+}
+
+// cap answers a CAP command and reports whether negotiation is still in
+// progress afterwards.
+func (c *Conn) cap(m *irc.Message, negotiating bool) bool {
+	switch strings.ToUpper(m.Param(0)) {
+	case "LS":
+		version, _ := strconv.Atoi(m.Param(1))
+		names := make([]string, 0, len(c.s.Caps))
+		for name, value := range c.s.Caps {
+			if value != "" && version >= 302 {
+				name += "=" + value
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.Reply("CAP", "LS", strings.Join(names, " "))
+		return true
+
+	case "LIST":
+		names := make([]string, 0, len(c.Caps))
+		for name := range c.Caps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.Reply("CAP", "LIST", strings.Join(names, " "))
+
+	case "REQ":
+		req := m.Param(1)
+		for _, name := range strings.Fields(req) {
+			if _, ok := c.s.Caps[strings.TrimPrefix(name, "-")]; !ok {
+				c.Reply("CAP", "NAK", req)
+				return true
+			}
+		}
+		for _, name := range strings.Fields(req) {
+			if strings.HasPrefix(name, "-") {
+				delete(c.Caps, name[1:])
+			} else {
+				c.Caps[name] = true
+			}
+		}
+		c.Reply("CAP", "ACK", req)
+		return true
+
+	case "END":
+		return false
+
+	default:
+		c.Reply("410", m.Param(0), "Invalid CAP command")
+	}
+	return negotiating
+}
+
+// authenticate answers an AUTHENTICATE command. Only the PLAIN mechanism is
+// supported.
+func (c *Conn) authenticate(m *irc.Message) {
+	arg := m.Param(0)
+	switch {
+	case arg == "*":
+		c.sasl.mech = ""
+		c.sasl.buf.Reset()
+		c.Reply("906", "SASL authentication aborted")
+
+	case c.sasl.mech == "":
+		if !c.Caps["sasl"] {
+			c.Reply("904", "SASL authentication failed")
+			return
+		}
+		if strings.ToUpper(arg) != "PLAIN" {
+			c.Reply("908", "PLAIN", "are available SASL mechanisms")
+			c.Reply("904", "SASL authentication failed")
+			return
+		}
+		c.sasl.mech = "PLAIN"
+		c.Send("AUTHENTICATE +")
+
+	default:
+		// payloads come in 400 byte chunks, the last one shorter or "+"
+		if arg != "+" {
+			c.sasl.buf.WriteString(arg)
+		}
+		if len(arg) == 400 {
+			return
+		}
+		payload := c.sasl.buf.String()
+		c.sasl.mech = ""
+		c.sasl.buf.Reset()
+
+		fields := bytes.Split(decodeBase64(payload), []byte{0})
+		if len(fields) != 3 {
+			c.Reply("904", "SASL authentication failed")
+			return
+		}
+		account, pass := string(fields[1]), string(fields[2])
+		if want, ok := c.s.Accounts[account]; !ok || want != pass {
+			c.Reply("904", "SASL authentication failed")
+			return
+		}
+		c.Account = account
+		c.Reply("900", c.Hostmask().String(), account, "You are now logged in as "+account)
+		c.Reply("903", "SASL authentication successful")
+	}
+}
+
+func decodeBase64(s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// Welcome sends the burst of numerics that completes registration:
+// RPL_WELCOME through RPL_ISUPPORT, then the MOTD.
+func (c *Conn) Welcome() {
+	name := c.s.name()
+	isupport := c.s.ISupport
+	if isupport == nil {
+		isupport = []string{"CASEMAPPING=rfc1459", "CHANTYPES=#&", "NICKLEN=30", "PREFIX=(ov)@+", "NETWORK=irctest"}
+	}
+
+	c.Reply("001", "Welcome to the irctest IRC network "+c.Hostmask().String())
+	c.Reply("002", "Your host is "+name+", running version irctest-1.0")
+	c.Reply("003", "This server was created "+time.Now().Format(time.RFC1123))
+	c.Send(":" + name + " 004 " + c.target() + " " + name + " irctest-1.0 iowx bhiklmnostv")
+	c.Reply("005", append(isupport, "are supported by this server")...)
+	c.Reply("375", "- "+name+" Message of the day -")
+	c.Reply("372", "- This is a fake server for tests.")
+	c.Reply("376", "End of /MOTD command.")
+}
+
+// Join expects the client to JOIN one or more channels and answers as the
+// server would: it echoes the join from the client's hostmask and sends
+// the NAMES list, made of the client and names.
+func (c *Conn) Join(channel string, names ...string) {
+	c.t.Helper()
+	m := c.Expect("JOIN", channel)
+	from := c.Hostmask().String()
+	for _, ch := range strings.Split(m.Param(0), ",") {
+		c.Sendf(":%s JOIN %s", from, ch)
+		c.Reply("353", "=", ch, strings.Join(append([]string{c.Nick}, names...), " "))
+		c.Reply("366", ch, "End of /NAMES list.")
+	}
+}
+
+// Ping sends PING with token and waits for the client to answer with a
+// matching PONG, returning the round trip. Other messages from the client
+// in the meantime are discarded.
+func (c *Conn) Ping(token string) time.Duration {
+	c.t.Helper()
+	start := time.Now()
+	c.Send("PING :" + token)
+	for {
+		m := c.ExpectEventually("PONG")
+		if m.LastParam() == token {
+			return time.Since(start)
+		}
+	}
+}
+
+// AnswerPing expects the client to PING the server and answers it after
+// delay, returning the token the client sent.
+func (c *Conn) AnswerPing(delay time.Duration) string {
+	c.t.Helper()
+	token := c.Expect("PING").LastParam()
+	time.Sleep(delay)
+	c.Sendf(":%s PONG %s :%s", c.s.name(), c.s.name(), token)
+	return token
+}
+
+// ExpectQuit expects the client to QUIT, then closes the link as the
+// server would, returning the QUIT message.
+func (c *Conn) ExpectQuit() *irc.Message {
+	c.t.Helper()
+	m := c.Expect("QUIT")
+	c.Disconnect("Quit: " + m.LastParam())
+	return m
+}
+
+// Disconnect sends ERROR with reason and closes the connection, as a
+// server does when it drops a client.
+func (c *Conn) Disconnect(reason string) {
+	c.Send("ERROR :Closing Link: 127.0.0.1 (" + reason + ")")
+	c.Flush()
+	c.Close()
+}
@@ -0,0 +1,160 @@
+package irc
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrPingTimeout is returned by Run when the server fails to answer a
+	// PING within Client.PingTimeout.
+	ErrPingTimeout = errors.New("irc: ping timeout")
+
+	// ErrLagged is returned by Run when a measured round trip exceeds
+	// Client.MaxLag.
+	ErrLagged = errors.New("irc: lag exceeds limit")
+)
+
+// lagMonitor tracks round trips to the server.
+type lagMonitor struct {
+	lastRecv atomic.Int64 // UnixNano of the last line received
+
+	mu    sync.Mutex
+	token string    // payload of the outstanding PING, if any
+	sent  time.Time // when it was sent
+	cur   time.Duration
+	avg   time.Duration
+}
+
+// received notes that the server has sent something.
+func (l *lagMonitor) received(t time.Time) {
+	l.lastRecv.Store(t.UnixNano())
+}
+
+// idle returns how long it has been since the server last sent anything.
+func (l *lagMonitor) idle() time.Duration {
+	return time.Since(time.Unix(0, l.lastRecv.Load()))
+}
+
+// start records an outgoing PING and returns the token to send with it.
+func (l *lagMonitor) start() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.token = fmt.Sprintf("%8X", rand.Int63())
+	l.sent = time.Now()
+	return l.token
+}
+
+// finish matches a PONG payload against the outstanding PING and returns
+// the measured round trip.
+func (l *lagMonitor) finish(token string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.token == "" || token != l.token {
+		return 0, false
+	}
+	l.cur = time.Since(l.sent)
+	if l.avg == 0 {
+		l.avg = l.cur
+	} else {
+		// exponentially weighted, 1/8 per sample like TCP's SRTT
+		l.avg += (l.cur - l.avg) / 8
+	}
+	l.token = ""
+	return l.cur, true
+}
+
+// Lag returns the most recently measured round trip to the server. While a
+// PING is outstanding for longer than that, the time it has been waiting is
+// returned instead, so the value rises as the link stalls.
+func (c *Client) Lag() time.Duration {
+	if c.lag == nil {
+		return 0
+	}
+	c.lag.mu.Lock()
+	defer c.lag.mu.Unlock()
+	if c.lag.token != "" {
+		if waiting := time.Since(c.lag.sent); waiting > c.lag.cur {
+			return waiting
+		}
+	}
+	return c.lag.cur
+}
+
+// AvgLag returns a moving average of the measured round trips.
+func (c *Client) AvgLag() time.Duration {
+	if c.lag == nil {
+		return 0
+	}
+	c.lag.mu.Lock()
+	defer c.lag.mu.Unlock()
+	return c.lag.avg
+}
+
+// pingLoop pings the server whenever the link has been quiet for
+// PingTimeout, and fails the connection if the PONG doesn't come back in
+// time or the round trip exceeds MaxLag.
+func (c *Client) pingLoop() {
+	defer c.wg.Done()
+
+	t := time.NewTimer(c.PingTimeout)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.die:
+			return
+		case <-t.C:
+		}
+
+		// any traffic proves the link is alive; only ping a quiet one
+		if idle := c.lag.idle(); idle < c.PingTimeout {
+			t.Reset(c.PingTimeout - idle)
+			continue
+		}
+
+		c.Command("PING", []string{c.lag.start()})
+
+		select {
+		case <-c.die:
+			return
+		case <-time.After(c.PingTimeout):
+			c.fail(errors.Wrapf(ErrPingTimeout, "no PONG after %v", c.PingTimeout))
+			return
+		case lag := <-c.pong:
+			if c.MaxLag > 0 && lag > c.MaxLag {
+				c.fail(errors.Wrapf(ErrLagged, "%v > %v", lag, c.MaxLag))
+				return
+			}
+		}
+
+		t.Reset(c.PingTimeout)
+	}
+}
+
+// handlePong measures the round trip for a PONG answering our PING.
+func (c *Client) handlePong(m *Message) {
+	token := m.LastParam()
+
+	lag, ok := c.lag.finish(token)
+	if !ok {
+		return
+	}
+	c.logger().Debug("irc: pong", slog.Duration("latency", lag))
+
+	select {
+	case c.pong <- lag:
+	default:
+	}
+	c.dispatch(&Message{
+		Time:    time.Now(),
+		Command: EventLag,
+		Params:  []string{lag.String()},
+	})
+}
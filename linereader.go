@@ -0,0 +1,135 @@
+package irc
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxLineLength is the longest line read when Client.MaxLineLength is
+// zero: 512 bytes for the message itself plus 8191 for IRCv3 message tags.
+const DefaultMaxLineLength = 8191 + 512
+
+// ErrLineTooLong is reported for a line longer than the maximum. The line is
+// discarded and reading continues with the next one.
+var ErrLineTooLong = errors.New("irc: line too long")
+
+// lineReader splits a stream into lines terminated by CR, LF or CRLF,
+// skipping empty lines.
+type lineReader struct {
+	r      *bufio.Reader
+	max    int
+	buf    []byte
+	skipLF bool // the previous line ended in CR; a following LF is part of it
+}
+
+func newLineReader(r io.Reader, max int) *lineReader {
+	if max <= 0 {
+		max = DefaultMaxLineLength
+	}
+	return &lineReader{r: bufio.NewReaderSize(r, 4096), max: max}
+}
+
+// readLine returns the next non-empty line without its terminator. The
+// returned slice is only valid until the next call. A final line cut off by
+// the end of the stream is returned before the error.
+func (lr *lineReader) readLine() ([]byte, error) {
+	lr.buf = lr.buf[:0]
+	tooLong := false
+
+	for {
+		b, err := lr.r.ReadByte()
+		if err != nil {
+			if len(lr.buf) > 0 && !tooLong {
+				return lr.buf, nil
+			}
+			return nil, err
+		}
+
+		if lr.skipLF {
+			lr.skipLF = false
+			if b == '\n' {
+				continue
+			}
+		}
+
+		switch b {
+		case '\r', '\n':
+			lr.skipLF = b == '\r'
+			if tooLong {
+				return nil, ErrLineTooLong
+			}
+			if len(lr.buf) == 0 {
+				continue
+			}
+			return lr.buf, nil
+		}
+
+		if len(lr.buf) >= lr.max {
+			// keep reading to resynchronize on the next terminator
+			tooLong = true
+			continue
+		}
+		lr.buf = append(lr.buf, b)
+	}
+}
+
+// An Encoding decodes text in a legacy character set to UTF-8.
+type Encoding interface {
+	Decode(b []byte) string
+}
+
+// single-byte encodings, indexed by byte
+type charmap [256]rune
+
+func (m *charmap) Decode(b []byte) string {
+	var sb strings.Builder
+	sb.Grow(len(b) + len(b)/2)
+	for _, c := range b {
+		sb.WriteRune(m[c])
+	}
+	return sb.String()
+}
+
+var (
+	// Latin1 is ISO 8859-1.
+	Latin1 Encoding = newCharmap(nil)
+
+	// Windows1252 is Windows code page 1252, the usual encoding of
+	// "latin-1" text from Windows clients. Its five undefined bytes decode
+	// to the C1 controls of the same value.
+	Windows1252 Encoding = newCharmap(map[byte]rune{
+		0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡',
+		0x88: 'ˆ', 0x89: '‰', 0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ', 0x8E: 'Ž',
+		0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—',
+		0x98: '˜', 0x99: '™', 0x9A: 'š', 0x9B: '›', 0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+	})
+)
+
+// newCharmap returns a Latin-1 charmap with the given overrides.
+func newCharmap(overrides map[byte]rune) *charmap {
+	m := new(charmap)
+	for i := range m {
+		m[i] = rune(i)
+	}
+	for b, r := range overrides {
+		m[b] = r
+	}
+	return m
+}
+
+// decodeLine converts a line read from the server to a UTF-8 string. Valid
+// UTF-8 is taken as is; anything else goes through c.Encoding, or has its
+// invalid bytes replaced if no Encoding is set.
+func (c *Client) decodeLine(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	if c.Encoding != nil {
+		return c.Encoding.Decode(b)
+	}
+	return strings.ToValidUTF8(string(b), "�")
+}
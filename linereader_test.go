@@ -0,0 +1,62 @@
+package irc
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineReader(t *testing.T) {
+	input := "one\r\ntwo\nthree\rfour\r\r\n\n" + strings.Repeat("x", 20) + "\r\nfive\r\nsix"
+	lr := newLineReader(strings.NewReader(input), 10)
+
+	var (
+		lines   []string
+		tooLong int
+	)
+	for {
+		b, err := lr.readLine()
+		if err == ErrLineTooLong {
+			tooLong++
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(b))
+	}
+
+	expect := []string{"one", "two", "three", "four", "five", "six"}
+	if !reflect.DeepEqual(lines, expect) {
+		t.Errorf("expect %q, got %q", expect, lines)
+	}
+	if tooLong != 1 {
+		t.Errorf("expect 1 overlong line, got %d", tooLong)
+	}
+}
+
+func TestDecodeLine(t *testing.T) {
+	table := []struct {
+		enc    Encoding
+		in     string
+		expect string
+	}{
+		{nil, "caf\xc3\xa9", "café"},
+		{nil, "caf\xe9", "caf�"},
+		{Latin1, "caf\xe9", "café"},
+		{Latin1, "caf\xc3\xa9", "café"},
+		{Windows1252, "\x93quoted\x94 \x80", "“quoted” €"},
+		{Latin1, "\x93", "\u0093"},
+	}
+
+	for _, test := range table {
+		c := &Client{Encoding: test.enc}
+		if s := c.decodeLine([]byte(test.in)); s != test.expect {
+			t.Errorf("%q: expect %q, got %q", test.in, test.expect, s)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package irc
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A ListMode is one of the channel modes that hold a list of masks.
+type ListMode int
+
+const (
+	BanList    ListMode = iota // +b
+	ExceptList                 // +e, or as the server's EXCEPTS token says
+	InviteList                 // +I, or as the server's INVEX token says
+)
+
+// listNumerics are the replies carrying each list's entries, and ending it.
+var listNumerics = [...]struct{ entry, end string }{
+	BanList:    {"367", "368"},
+	ExceptList: {"348", "349"},
+	InviteList: {"346", "347"},
+}
+
+// A ListEntry is a mask on a channel's ban, exception or invite list, with
+// who set it and when, where the server says.
+type ListEntry struct {
+	Mask  string
+	SetBy string
+	SetAt time.Time
+}
+
+// A ListError is the server refusing to send a channel's list, with the
+// numeric it replied with, such as 482 if only operators may see it.
+type ListError struct {
+	Channel string
+	Code    string
+	Reason  string
+}
+
+func (e *ListError) Error() string {
+	return "irc: " + e.Channel + ": " + e.Code + " " + e.Reason
+}
+
+// listRequest is a request for a list, waiting for the server's reply.
+type listRequest struct {
+	list     ListMode
+	mode     byte
+	entries  []ListEntry
+	err      error
+	done     chan struct{}
+	finished bool // done is closed
+}
+
+// modeLine is a MODE line written for a channel: a request for a list, or
+// a change if req is nil.
+type modeLine struct {
+	channel string
+	req     *listRequest
+}
+
+// maxModeLines bounds how many MODE lines the client remembers writing.
+// Changes the server carries out without a reply are only forgotten once
+// something later for their channel is answered, or to make room.
+const maxModeLines = 64
+
+// listState matches list replies to the requests for them. The server
+// answers MODE lines in the order they were written, so replies are
+// matched to the lines in that order too. A refusal is only taken for a
+// list request if it's the oldest line still awaiting an answer for its
+// channel, so that one refusing a change isn't mistaken for it.
+type listState struct {
+	mu      sync.Mutex
+	pending []*listRequest
+	queries map[*Message]*listRequest // list requests not written yet
+	written []modeLine                // in the order they were written
+}
+
+// reset fails the requests of a connection that has ended.
+func (l *listState) reset(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.pending) > 0 {
+		l.finish(l.pending[0], err)
+	}
+	l.queries = nil
+	l.written = nil
+}
+
+// finish completes req, if it is still pending. l.mu must be held.
+func (l *listState) finish(req *listRequest, err error) {
+	if req.finished {
+		return
+	}
+	if i := slices.Index(l.pending, req); i >= 0 {
+		l.pending = slices.Delete(l.pending, i, i+1)
+	}
+	req.err = err
+	req.finished = true
+	close(req.done)
+}
+
+// drop fails req if it is still pending, and forgets it, so that a reply
+// that never comes doesn't hold up the replies to later requests. One that
+// comes late is taken for the next request for the same list, which is
+// asking for the same thing.
+func (l *listState) drop(req *listRequest, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.finish(req, err)
+	l.written = slices.DeleteFunc(l.written, func(line modeLine) bool { return line.req == req })
+}
+
+// answered returns the index of the oldest line written that match
+// accepts, and forgets the lines for the same channel written before it,
+// since the server has answered those already. It returns -1 if none
+// match. l.mu must be held.
+func (l *listState) answered(match func(modeLine) bool) int {
+	i := slices.IndexFunc(l.written, match)
+	if i < 0 {
+		return -1
+	}
+	channel := l.written[i].channel
+	kept, at := l.written[:0], -1
+	for k, line := range l.written {
+		switch {
+		case k == i:
+			at = len(kept)
+		case k < i && strings.EqualFold(line.channel, channel):
+			continue
+		}
+		kept = append(kept, line)
+	}
+	l.written = kept
+	return at
+}
+
+// modeSent notes m, if it is a MODE line for a channel, as written. It is
+// called just before m is written.
+func (c *Client) modeSent(m *Message) {
+	if m.Command != "MODE" {
+		return
+	}
+	channel, ok := m.Target().(ChannelTarget)
+	if !ok {
+		return
+	}
+	l := &c.lists
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	req := l.queries[m]
+	delete(l.queries, m)
+	if req != nil && req.finished {
+		// dropped before it was written
+		return
+	}
+	if len(l.written) == maxModeLines {
+		i := slices.IndexFunc(l.written, func(line modeLine) bool { return line.req == nil })
+		if i < 0 {
+			i = 0
+		}
+		l.written = slices.Delete(l.written, i, i+1)
+	}
+	l.written = append(l.written, modeLine{channel: string(channel), req: req})
+}
+
+// listMode returns the mode letter the server uses for list.
+func (c *Client) listMode(list ListMode) byte {
+	token, def := "", byte('b')
+	switch list {
+	case ExceptList:
+		token, def = "EXCEPTS", 'e'
+	case InviteList:
+		token, def = "INVEX", 'I'
+	}
+	if v, _ := c.ISupport(token); token != "" && v != "" {
+		return v[0]
+	}
+	return def
+}
+
+// List fetches a channel's ban, exception or invite list.
+//
+// Like History, List must not be called from a Handler, since the reply it
+// waits for is read by the goroutine running handlers.
+func (c *Client) List(ctx context.Context, channel string, list ListMode) ([]ListEntry, error) {
+	die := c.die
+	req := &listRequest{list: list, mode: c.listMode(list), done: make(chan struct{})}
+	m := &Message{Command: "MODE", Params: []string{channel, string(req.mode)}}
+
+	c.lists.mu.Lock()
+	c.lists.pending = append(c.lists.pending, req)
+	if c.lists.queries == nil {
+		c.lists.queries = make(map[*Message]*listRequest)
+	}
+	c.lists.queries[m] = req
+	c.lists.mu.Unlock()
+	d := c.enqueue(m)
+
+	go func() {
+		// one that's never sent will never be answered
+		if err := d.Err(); err != nil {
+			c.lists.drop(req, err)
+		}
+	}()
+
+	select {
+	case <-req.done:
+		return req.entries, req.err
+	case <-ctx.Done():
+		c.lists.drop(req, ctx.Err())
+		return nil, ctx.Err()
+	case <-die:
+		return nil, ErrClosed
+	}
+}
+
+// AddToList adds masks to a channel's list, in as few MODE lines as the
+// server allows.
+func (c *Client) AddToList(channel string, list ListMode, masks ...string) []*Delivery {
+	return c.Modes(channel).Add(c.listMode(list), masks...).Send()
+}
+
+// RemoveFromList removes masks from a channel's list, in as few MODE lines
+// as the server allows.
+func (c *Client) RemoveFromList(channel string, list ListMode, masks ...string) []*Delivery {
+	return c.Modes(channel).Remove(c.listMode(list), masks...).Send()
+}
+
+// handleList takes an entry of a list, or the end of one:
+//
+//	:server 367 <nick> <channel> <mask> [<who> <set-ts>]   RPL_BANLIST
+//	:server 368 <nick> <channel> :<reason>                 RPL_ENDOFBANLIST
+//
+// and likewise 348 and 349 for exceptions, and 346 and 347 for invites.
+func (c *Client) handleList(m *Message, list ListMode) {
+	channel := m.Param(1)
+	l := &c.lists
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.answered(func(line modeLine) bool {
+		return line.req != nil && line.req.list == list && strings.EqualFold(line.channel, channel)
+	})
+	if i < 0 {
+		return
+	}
+	req := l.written[i].req
+	if m.Command == listNumerics[list].end {
+		l.written = slices.Delete(l.written, i, i+1)
+		l.finish(req, nil)
+		return
+	}
+
+	e := ListEntry{Mask: m.Param(2), SetBy: m.Param(3)}
+	if ts, err := strconv.ParseInt(m.Param(4), 10, 64); err == nil {
+		e.SetAt = time.Unix(ts, 0)
+	}
+	req.entries = append(req.entries, e)
+}
+
+// listRefused takes the server refusing a MODE line, which fails the list
+// request it answers, if it answers one:
+//
+//	:server 403 <nick> <channel> :<reason>   ERR_NOSUCHCHANNEL
+//	:server 442 <nick> <channel> :<reason>   ERR_NOTONCHANNEL
+//	:server 482 <nick> <channel> :<reason>   ERR_CHANOPRIVSNEEDED
+//	:server 472 <nick> <char> :<reason>      ERR_UNKNOWNMODE
+//
+// The first three answer the oldest line for the channel, whichever it is.
+// ERR_UNKNOWNMODE doesn't say the channel, so it's taken for the oldest
+// list request for the mode it names.
+func (c *Client) listRefused(m *Message) {
+	arg := m.Param(1)
+	l := &c.lists
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var i int
+	if m.Command == "472" {
+		i = slices.IndexFunc(l.written, func(line modeLine) bool {
+			return line.req != nil && arg == string(line.req.mode)
+		})
+	} else {
+		i = l.answered(func(line modeLine) bool {
+			return strings.EqualFold(line.channel, arg)
+		})
+	}
+	if i < 0 {
+		return
+	}
+	line := l.written[i]
+	l.written = slices.Delete(l.written, i, i+1)
+	if line.req != nil {
+		l.finish(line.req, &ListError{Channel: line.channel, Code: m.Command, Reason: m.LastParam()})
+	}
+}
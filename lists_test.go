@@ -0,0 +1,142 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	c := new(Client)
+	server, r := registerJoins(t, c, "EXCEPTS INVEX=J")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	type result struct {
+		entries []ListEntry
+		err     error
+	}
+	results := make(chan result, 1)
+	list := func(channel string, l ListMode) {
+		go func() {
+			entries, err := c.List(ctx, channel, l)
+			results <- result{entries, err}
+		}()
+	}
+
+	list("#chan", BanList)
+	if m := readMessage(t, r); m.String() != "MODE #chan b" {
+		t.Fatalf("expect MODE #chan b, got %q", m)
+	}
+	io.WriteString(server, ":irc.test 367 bot #chan *!*@spam.example.com op!op@host 1685620800\r\n"+
+		":irc.test 367 bot #chan troll!*@*\r\n"+
+		":irc.test 368 bot #chan :End of Channel Ban List\r\n")
+	res := <-results
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	exp := []ListEntry{
+		{"*!*@spam.example.com", "op!op@host", time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)},
+		{"troll!*@*", "", time.Time{}},
+	}
+	if len(res.entries) != len(exp) {
+		t.Fatalf("expect %d entries, got %+v", len(exp), res.entries)
+	}
+	for i, e := range res.entries {
+		if e.Mask != exp[i].Mask || e.SetBy != exp[i].SetBy || !e.SetAt.Equal(exp[i].SetAt) {
+			t.Errorf("expect %+v, got %+v", exp[i], e)
+		}
+	}
+
+	// the server's own letter for invite exceptions
+	list("#chan", InviteList)
+	if m := readMessage(t, r); m.String() != "MODE #chan J" {
+		t.Fatalf("expect MODE #chan J, got %q", m)
+	}
+	io.WriteString(server, ":irc.test 482 bot #chan :You're not a channel operator\r\n")
+	var lerr *ListError
+	if res := <-results; !errors.As(res.err, &lerr) || lerr.Code != "482" {
+		t.Errorf("expect ListError 482, got %v", res.err)
+	}
+}
+
+func TestAddToList(t *testing.T) {
+	c := new(Client)
+	server, r := registerJoins(t, c, "MODES=4")
+	syncHandlers(t, server, r)
+
+	c.AddToList("#chan", ExceptList, "a!*@*", "b!*@*")
+	c.RemoveFromList("#chan", BanList, "1", "2", "3", "4", "5")
+	for _, exp := range []string{
+		"MODE #chan +ee a!*@* b!*@*",
+		"MODE #chan -bbbb 1 2 3 4",
+		"MODE #chan -b 5",
+	} {
+		if m := readMessage(t, r); m.String() != exp {
+			t.Errorf("expect %s, got %q", exp, m)
+		}
+	}
+}
+
+func TestListRefusedChange(t *testing.T) {
+	c := new(Client)
+	server, r := registerJoins(t, c, "EXCEPTS")
+	syncHandlers(t, server, r)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	c.Modes("#chan").Add('o', "friend").Send()
+	readMessage(t, r)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.List(ctx, "#chan", ExceptList)
+		errs <- err
+	}()
+	readMessage(t, r)
+
+	// the refusal answers the change, the list comes after it
+	io.WriteString(server, ":irc.test 482 bot #chan :You're not a channel operator\r\n"+
+		":irc.test 349 bot #chan :End of Channel Exception List\r\n")
+	if err := <-errs; err != nil {
+		t.Errorf("expect the list, got %v", err)
+	}
+}
+
+func TestListCanceled(t *testing.T) {
+	c := new(Client)
+	server, r := registerJoins(t, c, "MODES=4")
+	syncHandlers(t, server, r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.List(ctx, "#chan", BanList)
+		errs <- err
+	}()
+	readMessage(t, r)
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+
+	type result struct {
+		entries []ListEntry
+		err     error
+	}
+	results := make(chan result, 1)
+	go func() {
+		entries, err := c.List(context.Background(), "#chan", BanList)
+		results <- result{entries, err}
+	}()
+	readMessage(t, r)
+
+	// the server never answered, and the next reply isn't taken for it
+	io.WriteString(server, ":irc.test 367 bot #chan fresh!*@*\r\n"+
+		":irc.test 368 bot #chan :End of Channel Ban List\r\n")
+	res := <-results
+	if res.err != nil || len(res.entries) != 1 || res.entries[0].Mask != "fresh!*@*" {
+		t.Errorf("expect fresh!*@*, got %+v, %v", res.entries, res.err)
+	}
+}
@@ -0,0 +1,128 @@
+package irc
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+const redacted = "<redacted>"
+
+// logger returns the logger c should write to.
+func (c *Client) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// logTraffic logs a message crossing the wire in direction dir ("in" or
+// "out"). Raw traffic is only logged at debug level unless c.Verbose is set.
+func (c *Client) logTraffic(dir string, m *Message) {
+	level := slog.LevelDebug
+	if c.Verbose {
+		level = slog.LevelInfo
+	}
+
+	l := c.logger()
+	if !l.Enabled(context.Background(), level) {
+		return
+	}
+
+	l.LogAttrs(context.Background(), level, "irc traffic",
+		slog.String("dir", dir),
+		slog.String("command", m.Command),
+		slog.String("target", m.Target().Name()),
+		slog.String("line", redact(m)),
+	)
+}
+
+// secretServiceCommands are the NickServ subcommands whose arguments carry a
+// password.
+var secretServiceCommands = []string{"IDENTIFY", "REGISTER", "GHOST", "REGAIN", "RECOVER", "RELEASE", "SET PASSWORD"}
+
+// redact returns the wire form of m with any credentials it carries replaced
+// so that it is safe to log.
+func redact(m *Message) string {
+	switch m.Command {
+	case "PASS", "AUTHENTICATE", "OPER":
+		return m.Command + " " + redacted
+
+	case "PRIVMSG", "NOTICE":
+		if len(m.Params) == 0 || !strings.HasPrefix(strings.ToLower(m.Params[0]), "nickserv") {
+			break
+		}
+		if sub, ok := secretServiceCommand(messageText(m, 1)); ok {
+			return m.Command + " " + m.Params[0] + " :" + sub + " " + redacted
+		}
+
+	case "NICKSERV", "NS":
+		if sub, ok := secretServiceCommand(messageText(m, 0)); ok {
+			return m.Command + " " + sub + " " + redacted
+		}
+	}
+	return m.String()
+}
+
+// messageText joins the params of m from index i onwards, so that a
+// colon-less "PRIVMSG NickServ IDENTIFY pass" reads the same as the colon
+// form.
+func messageText(m *Message, i int) string {
+	params := m.AllParams()
+	if i >= len(params) {
+		return ""
+	}
+	return strings.Join(params[i:], " ")
+}
+
+// RedactLine returns line with any credentials it carries replaced, as the
+// client does when logging traffic. Lines without credentials are returned
+// unchanged.
+func RedactLine(line string) string {
+	m, err := ParseMessage(line)
+	if err != nil {
+		return redactLine(line)
+	}
+	if r := redact(m); r != m.String() {
+		return r
+	}
+	return line
+}
+
+// maxLoggedLine bounds how much of an unparseable line is logged.
+const maxLoggedLine = 512
+
+// redactLine makes a raw line that could not be parsed as a Message safe to
+// log. Everything after a credential-bearing word is dropped, since without
+// a parse there's no telling which part is the secret.
+func redactLine(line string) string {
+	upper := strings.ToUpper(line)
+	for _, word := range []string{"PASS", "AUTHENTICATE", "OPER", "IDENTIFY", "REGISTER", "GHOST", "REGAIN", "RECOVER", "RELEASE"} {
+		if i := strings.Index(upper, word); i >= 0 {
+			line = line[:i+len(word)] + " " + redacted
+			upper = strings.ToUpper(line)
+		}
+	}
+	if len(line) > maxLoggedLine {
+		line = line[:maxLoggedLine] + "..."
+	}
+	return line
+}
+
+// secretServiceCommand reports whether text is a services command that
+// carries a password, returning the command name.
+func secretServiceCommand(text string) (string, bool) {
+	upper := strings.ToUpper(strings.TrimSpace(text))
+	for _, cmd := range secretServiceCommands {
+		if upper == cmd || strings.HasPrefix(upper, cmd+" ") {
+			return cmd, true
+		}
+	}
+	return "", false
+}
+
+// errAttr logs err by its message. Handlers format errors with %+v, which
+// would otherwise dump the stack trace github.com/pkg/errors attaches.
+func errAttr(err error) slog.Attr {
+	return slog.String("err", err.Error())
+}
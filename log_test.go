@@ -0,0 +1,101 @@
+package irc
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	table := []struct {
+		m      *Message
+		expect string
+	}{
+		{&Message{Command: "PASS", Params: []string{"hunter2"}}, "PASS <redacted>"},
+		{&Message{Command: "AUTHENTICATE", Params: []string{"Zm9vAGZvbwBodW50ZXIy"}}, "AUTHENTICATE <redacted>"},
+		{&Message{Command: "PRIVMSG", Params: []string{"NickServ"}, Trailing: "IDENTIFY hunter2"}, "PRIVMSG NickServ :IDENTIFY <redacted>"},
+		{&Message{Command: "PRIVMSG", Params: []string{"nickserv@services.example"}, Trailing: "identify bot hunter2"}, "PRIVMSG nickserv@services.example :IDENTIFY <redacted>"},
+		{&Message{Command: "PRIVMSG", Params: []string{"NickServ", "IDENTIFY", "hunter2"}}, "PRIVMSG NickServ :IDENTIFY <redacted>"},
+		{&Message{Command: "NS", Params: []string{"IDENTIFY", "hunter2"}}, "NS IDENTIFY <redacted>"},
+		{&Message{Command: "PRIVMSG", Params: []string{"NickServ"}, Trailing: "INFO bot"}, "PRIVMSG NickServ :INFO bot"},
+		{&Message{Command: "PRIVMSG", Params: []string{"#chan"}, Trailing: "IDENTIFY hunter2"}, "PRIVMSG #chan :IDENTIFY hunter2"},
+	}
+
+	for _, test := range table {
+		if s := redact(test.m); s != test.expect {
+			t.Errorf("%q: expect %q, got %q", test.m, test.expect, s)
+		}
+	}
+}
+
+func TestRedactLine(t *testing.T) {
+	table := []struct {
+		line   string
+		expect string
+	}{
+		{":a.b.c", ":a.b.c"},
+		{"PASS hunter2 :x", "PASS <redacted>"},
+		{"@bad PRIVMSG NickServ :identify hunter2", "@bad PRIVMSG NickServ :identify <redacted>"},
+		{strings.Repeat("x", 600), strings.Repeat("x", 512) + "..."},
+	}
+
+	for _, test := range table {
+		if s := redactLine(test.line); s != test.expect {
+			t.Errorf("%q: expect %q, got %q", test.line, test.expect, s)
+		}
+	}
+}
+
+func TestRedactLineExported(t *testing.T) {
+	table := []struct {
+		line   string
+		expect string
+	}{
+		{"PRIVMSG  #chan   :hi", "PRIVMSG  #chan   :hi"},
+		{"PRIVMSG NickServ IDENTIFY hunter2", "PRIVMSG NickServ :IDENTIFY <redacted>"},
+		{"AUTHENTICATE Ym90AGJvdABodW50ZXIy", "AUTHENTICATE <redacted>"},
+		{":a.b.c", ":a.b.c"},
+	}
+
+	for _, test := range table {
+		if s := RedactLine(test.line); s != test.expect {
+			t.Errorf("%q: expect %q, got %q", test.line, test.expect, s)
+		}
+	}
+}
+
+func TestLogTraffic(t *testing.T) {
+	m := &Message{Command: "PRIVMSG", Params: []string{"#chan"}, Trailing: "hi"}
+
+	table := []struct {
+		level   slog.Level
+		verbose bool
+		expect  string
+	}{
+		{slog.LevelInfo, false, ""},
+		{slog.LevelDebug, false, `level=DEBUG msg="irc traffic" dir=out command=PRIVMSG target=#chan line="PRIVMSG #chan :hi"`},
+		{slog.LevelInfo, true, `level=INFO msg="irc traffic" dir=out command=PRIVMSG target=#chan line="PRIVMSG #chan :hi"`},
+	}
+
+	for _, test := range table {
+		var buf bytes.Buffer
+		c := &Client{
+			Verbose: test.verbose,
+			Logger: slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+				Level: test.level,
+				ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+					if a.Key == slog.TimeKey {
+						return slog.Attr{}
+					}
+					return a
+				},
+			})),
+		}
+		c.logTraffic("out", m)
+
+		if s := strings.TrimSpace(buf.String()); s != test.expect {
+			t.Errorf("level %v verbose %t: expect %q, got %q", test.level, test.verbose, test.expect, s)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package irc
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// ParseMessageBytes parses a line into m, reusing m's storage: the Params
+// slice, the Tags map and the Hostmask From points to are overwritten rather
+// than reallocated. The line isn't copied either: the strings in m share
+// b's memory, so they are only good until b is changed or reused. Once m
+// has warmed up, parsing doesn't allocate, apart from unescaping tag values
+// that need it, which suits relays that handle every line once and move on.
+// Time is left unchanged.
+//
+// Handlers may keep the Messages the client gives them, so the client
+// itself still parses each line into a fresh Message.
+func ParseMessageBytes(b []byte, m *Message) error {
+	return parseMessage(unsafe.String(unsafe.SliceData(b), len(b)), m)
+}
+
+// parseMessage parses s into m, reusing m's storage.
+func parseMessage(s string, m *Message) error {
+	/*
+			RFC2812 §2.3.1
+		    message    =  [ ":" prefix SPACE ] command [ params ] crlf
+		    prefix     =  servername / ( nickname [ [ "!" user ] "@" host ] )
+		    command    =  1*letter / 3digit
+		    params     =  *14( SPACE middle ) [ SPACE ":" trailing ]
+		               =/ 14( SPACE middle ) [ SPACE [ ":" ] trailing ]
+
+		    nospcrlfcl =  %x01-09 / %x0B-0C / %x0E-1F / %x21-39 / %x3B-FF
+		                    ; any octet except NUL, CR, LF, " " and ":"
+		    middle     =  nospcrlfcl *( ":" / nospcrlfcl )
+		    trailing   =  *( ":" / " " / nospcrlfcl )
+
+		    SPACE      =  %x20        ; space character
+		    crlf       =  %x0D %x0A   ; "carriage return" "linefeed"
+
+			IRCv3 message tags prepend [ "@" tags SPACE ].
+	*/
+
+	from := m.From
+	m.From = nil
+	m.Command = ""
+	m.Params = m.Params[:0]
+	m.Trailing = ""
+	m.HasTrailing = false
+	if m.Tags != nil {
+		clear(m.Tags)
+	}
+
+	// only the line ending goes: spaces at the end of a trailing param are
+	// part of it
+	s = strings.TrimLeft(strings.TrimRight(s, "\r\n"), " ")
+	if len(s) == 0 {
+		return errMessageEmpty
+	}
+	if strings.ContainsAny(s, "\r\n") {
+		// more than one line
+		return errMessageInvalid
+	}
+
+	// tags
+	if s[0] == '@' {
+		i := strings.IndexByte(s, ' ')
+		if i < 0 {
+			return errMessageInvalid
+		}
+		m.parseTags(s[1:i])
+		s = strings.TrimLeft(s[i+1:], " ")
+		if s == "" {
+			return errMessageInvalid
+		}
+	}
+
+	// prefix
+	hasPrefix := false
+	if s[0] == ':' {
+		i := strings.IndexByte(s, ' ')
+		if i < 0 {
+			// host only and nothing else? pretty weird
+			return errMessageInvalid
+		}
+		if from == nil {
+			from = new(Hostmask)
+		}
+		if err := parseHostmask(s[1:i], from); err != nil {
+			return err
+		}
+		m.From = from
+		hasPrefix = true
+		s = s[i+1:]
+	}
+
+	s = strings.TrimLeft(s, " ")
+	if hasPrefix && s == "" {
+		return errMessageInvalid
+	}
+	if s[0] == ':' || s[0] == '@' {
+		// a second prefix or tags out of place
+		return errMessageInvalid
+	}
+
+	// command
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		// no space means the command is the last element
+		m.Command = strings.ToUpper(s)
+		return nil
+	} else {
+		m.Command = strings.ToUpper(s[:i])
+		s = s[i+1:]
+	}
+
+	// params or trailing
+	for len(s) > 0 {
+		switch s[0] {
+		case ' ':
+			s = s[1:]
+		case ':':
+			m.Trailing = s[1:]
+			m.HasTrailing = true
+			return nil
+		default:
+			if len(m.Params) == 14 {
+				// Max 14 params. If there are 14 then a colon isn't required
+				// for the trailing. So we just pack up the rest and leave once
+				// we reach 14 params.
+				m.Trailing = s
+				m.HasTrailing = true
+				return nil
+			}
+			i = strings.IndexByte(s, ' ')
+			if i < 0 {
+				m.Params = append(m.Params, s)
+				return nil
+			}
+			m.Params = append(m.Params, s[:i])
+			s = s[i+1:]
+		}
+	}
+	return nil
+}
+
+// parseTags parses the tags section of a message, without its leading @.
+func (m *Message) parseTags(s string) {
+	for len(s) > 0 {
+		var tag string
+		if i := strings.IndexByte(s, ';'); i >= 0 {
+			tag, s = s[:i], s[i+1:]
+		} else {
+			tag, s = s, ""
+		}
+
+		key, value := tag, ""
+		if i := strings.IndexByte(tag, '='); i >= 0 {
+			key, value = tag[:i], unescapeTag(tag[i+1:])
+		}
+		if key == "" {
+			continue
+		}
+		if m.Tags == nil {
+			m.Tags = make(map[string]string)
+		}
+		m.Tags[key] = value
+	}
+}
+
+// unescapeTag decodes a tag value. Values without escapes are returned
+// without copying.
+func unescapeTag(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(s) {
+			// a lone trailing backslash is dropped
+			break
+		}
+		switch s[i] {
+		case ':':
+			sb.WriteByte(';')
+		case 's':
+			sb.WriteByte(' ')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'n':
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+// AppendTo appends the wire form of m, without a line terminator, to b and
+// returns the extended slice. Tags are written in key order.
+func (m *Message) AppendTo(b []byte) []byte {
+	if len(m.Tags) > 0 {
+		b = append(b, '@')
+		b = appendTags(b, m.Tags)
+		b = append(b, ' ')
+	}
+	if m.From != nil {
+		b = append(b, ':')
+		b = m.From.AppendTo(b)
+		b = append(b, ' ')
+	}
+	b = append(b, m.Command...)
+	for _, p := range m.Params {
+		b = append(b, ' ')
+		b = append(b, p...)
+	}
+	if m.hasTrailing() {
+		b = append(b, " :"...)
+		b = append(b, m.Trailing...)
+	}
+	return b
+}
+
+func appendTags(b []byte, tags map[string]string) []byte {
+	// sort the keys by insertion into a buffer that normally stays on the
+	// stack; messages rarely carry more than a handful of tags
+	var buf [16]string
+	keys := buf[:0]
+	for k := range tags {
+		keys = append(keys, k)
+		for i := len(keys) - 1; i > 0 && keys[i] < keys[i-1]; i-- {
+			keys[i], keys[i-1] = keys[i-1], keys[i]
+		}
+	}
+
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ';')
+		}
+		b = append(b, k...)
+		v := tags[k]
+		if v == "" {
+			continue
+		}
+		b = append(b, '=')
+		for j := 0; j < len(v); j++ {
+			switch c := v[j]; c {
+			case ';':
+				b = append(b, `\:`...)
+			case ' ':
+				b = append(b, `\s`...)
+			case '\\':
+				b = append(b, `\\`...)
+			case '\r':
+				b = append(b, `\r`...)
+			case '\n':
+				b = append(b, `\n`...)
+			default:
+				b = append(b, c)
+			}
+		}
+	}
+	return b
+}
+
+// AppendTo appends the wire form of h to b and returns the extended slice.
+func (h *Hostmask) AppendTo(b []byte) []byte {
+	if h.Nick == "" && h.User == "" {
+		return append(b, h.Address...)
+	}
+	b = append(b, h.Nick...)
+	if h.User != "" {
+		b = append(b, '!')
+		b = append(b, h.User...)
+	}
+	if h.Address != "" {
+		b = append(b, '@')
+		b = append(b, h.Address...)
+	}
+	return b
+}
+
+var linePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// WriteTo writes m to w as a complete line, terminated by CRLF, in a single
+// Write. When w is a *bufio.Writer the line is encoded straight into its
+// buffer; otherwise a pooled buffer is used, so steady-state writes don't
+// allocate.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	if bw, ok := w.(*bufio.Writer); ok {
+		b := m.AppendTo(bw.AvailableBuffer())
+		b = append(b, '\r', '\n')
+		n, err := bw.Write(b)
+		return int64(n), err
+	}
+
+	bp := linePool.Get().(*[]byte)
+	b := m.AppendTo((*bp)[:0])
+	b = append(b, '\r', '\n')
+	n, err := w.Write(b)
+	*bp = b
+	linePool.Put(bp)
+	return int64(n), err
+}
@@ -0,0 +1,322 @@
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTags(t *testing.T) {
+	table := []struct {
+		s      string
+		expect map[string]string
+	}{
+		{"@a=b :n!u@h CMD", map[string]string{"a": "b"}},
+		{"@a=b;c;d= CMD", map[string]string{"a": "b", "c": "", "d": ""}},
+		{`@k=semi\:space\sback\\cr\rlf\n CMD`, map[string]string{"k": "semi;space back\\cr\rlf\n"}},
+		{`@k=x\y\ CMD`, map[string]string{"k": "xy"}},
+		{"@a=1;a=2;;=x CMD", map[string]string{"a": "2"}},
+		{"@+draft/reply=abc;time=2023-01-01T00:00:00.000Z   CMD", map[string]string{"+draft/reply": "abc", "time": "2023-01-01T00:00:00.000Z"}},
+	}
+
+	for _, test := range table {
+		m, err := ParseMessage(test.s)
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(m.Tags, test.expect) || m.Command != "CMD" {
+			t.Errorf("%q: expect %q, got %q (%s)", test.s, test.expect, m.Tags, m.Command)
+		}
+	}
+
+	for _, s := range []string{"@", "@a=b", "@a=b   "} {
+		if _, err := ParseMessage(s); err == nil {
+			t.Errorf("%q: expect error", s)
+		}
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	m := &Message{
+		Tags:     map[string]string{"z": "", "a": "x; y\\"},
+		From:     &Hostmask{"nick", "user", "host"},
+		Command:  "PRIVMSG",
+		Params:   []string{"#chan"},
+		Trailing: "hello world",
+
+		HasTrailing: true,
+	}
+	expect := `@a=x\:\sy\\;z :nick!user@host PRIVMSG #chan :hello world`
+
+	if s := m.String(); s != expect {
+		t.Errorf("String: expect %q, got %q", expect, s)
+	}
+	if b := m.AppendTo([]byte("> ")); string(b) != "> "+expect {
+		t.Errorf("AppendTo: got %q", b)
+	}
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil || buf.String() != expect+"\r\n" {
+		t.Errorf("WriteTo: got %q (%v)", buf.String(), err)
+	}
+	buf.Reset()
+	w := bufio.NewWriter(&buf)
+	m.WriteTo(w)
+	w.Flush()
+	if buf.String() != expect+"\r\n" {
+		t.Errorf("WriteTo bufio: got %q", buf.String())
+	}
+
+	back, err := ParseMessage(expect)
+	if err != nil || !reflect.DeepEqual(back, m) {
+		t.Errorf("round trip: expect %#v, got %#v (%v)", m, back, err)
+	}
+}
+
+func TestParseMessageBytesReuse(t *testing.T) {
+	var m Message
+	if err := ParseMessageBytes([]byte("@t=1 :a!b@c PRIVMSG #x :one"), &m); err != nil {
+		t.Fatal(err)
+	}
+	from := m.From
+
+	if err := ParseMessageBytes([]byte(":d!e@f NOTICE y z"), &m); err != nil {
+		t.Fatal(err)
+	}
+	expect := Message{
+		Tags:    map[string]string{},
+		From:    &Hostmask{"d", "e", "f"},
+		Command: "NOTICE",
+		Params:  []string{"y", "z"},
+	}
+	if !reflect.DeepEqual(m, expect) {
+		t.Errorf("expect %#v, got %#v", expect, m)
+	}
+	if m.From != from {
+		t.Error("From not reused")
+	}
+
+	if err := ParseMessageBytes([]byte("PING :x"), &m); err != nil || m.From != nil || m.Trailing != "x" {
+		t.Errorf("prefix-less reparse: got %#v (%v)", m, err)
+	}
+}
+
+func TestMessageAllocs(t *testing.T) {
+	line := []byte("@time=2023-01-01T00:00:00.000Z;msgid=abc :nick!user@host PRIVMSG #channel :hello there, how are you?")
+	var m Message
+	ParseMessageBytes(line, &m)
+
+	if n := testing.AllocsPerRun(100, func() { ParseMessageBytes(line, &m) }); n > 0 {
+		t.Errorf("ParseMessageBytes: %v allocs per line, expect 0", n)
+	}
+
+	w := bufio.NewWriter(io.Discard)
+	if n := testing.AllocsPerRun(100, func() { m.WriteTo(w) }); n > 0 {
+		t.Errorf("WriteTo(*bufio.Writer): %v allocs per line, expect 0", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { m.WriteTo(io.Discard) }); n > 0 {
+		t.Errorf("WriteTo(io.Writer): %v allocs per line, expect 0", n)
+	}
+}
+
+var benchLine = "@time=2023-01-01T00:00:00.000Z;msgid=abc :nick!user@host PRIVMSG #channel :hello there, how are you?"
+
+func BenchmarkParseMessage(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseMessage(benchLine)
+	}
+}
+
+func BenchmarkParseMessageBytes(b *testing.B) {
+	line := []byte(benchLine)
+	var m Message
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseMessageBytes(line, &m)
+	}
+}
+
+func BenchmarkMessageString(b *testing.B) {
+	m, _ := ParseMessage(benchLine)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		io.WriteString(io.Discard, m.String()+"\r\n")
+	}
+}
+
+func BenchmarkMessageWriteTo(b *testing.B) {
+	m, _ := ParseMessage(benchLine)
+	w := bufio.NewWriter(io.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.WriteTo(w)
+	}
+}
+
+// equalMessage compares messages as parsing produces them, ignoring Time.
+func equalMessage(a, b *Message) bool {
+	a2, b2 := *a, *b
+	a2.Time, b2.Time = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a2, b2)
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, s := range []string{
+		"PING :a.b.c",
+		":nick!user@host PRIVMSG #chan :hello there",
+		"@time=2023-01-01T00:00:00.000Z;+x=a\\sb :srv 001 bot :Welcome",
+		":a.b.c CMD p1 p2 p3 p4 p5 p6 p7 p8 p9 p10 p11 p12 p13 p14 trailing trailing",
+		"TOPIC #chan :",
+		"PRIVMSG #chan :spaces at the end  ",
+		"@; @c d",
+		"@a=b :x",
+		":a :b c",
+		"CMD  a   b  ",
+		"00\r ",
+	} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		m, err := ParseMessage(s)
+		if err != nil {
+			return
+		}
+
+		line := m.String()
+		back, err := ParseMessage(line)
+		if err != nil {
+			t.Fatalf("%q parsed, but its encoding %q doesn't: %v", s, line, err)
+		}
+		if !equalMessage(m, back) {
+			t.Fatalf("%q: encoding %q parses to %#v, expect %#v", s, line, back, m)
+		}
+
+		// a reused Message keeps its storage, but must hold the same values
+		var reused Message
+		ParseMessageBytes([]byte("@k=v :x!y@z OLD a b :c"), &reused)
+		if err := ParseMessageBytes([]byte(s), &reused); err != nil {
+			t.Fatalf("%q: ParseMessage accepts it but ParseMessageBytes says %v", s, err)
+		}
+		if len(reused.Tags) == 0 {
+			reused.Tags = nil
+		}
+		if len(reused.Params) == 0 {
+			reused.Params = nil
+		}
+		if !equalMessage(m, &reused) {
+			t.Fatalf("%q: reused Message parses to %#v, expect %#v", s, reused, m)
+		}
+	})
+}
+
+func FuzzParseTags(f *testing.F) {
+	for _, s := range []string{"a=b", `k=semi\:space\sback\\cr\rlf\n`, "a;b=;=c;;", `x=\`, `x=\y`} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		if strings.IndexByte(s, ' ') >= 0 {
+			// a space ends the tags on the wire
+			return
+		}
+		var m Message
+		m.parseTags(s)
+		if len(m.Tags) == 0 {
+			return
+		}
+
+		encoded := string(appendTags(nil, m.Tags))
+		var back Message
+		back.parseTags(encoded)
+		if !reflect.DeepEqual(m.Tags, back.Tags) {
+			t.Fatalf("%q: encoding %q parses to %q, expect %q", s, encoded, back.Tags, m.Tags)
+		}
+	})
+}
+
+// randomMessage returns a random message that Validate accepts.
+func randomMessage(r *rand.Rand) *Message {
+	const (
+		letters  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+		keyChars = "abcdefghijklmnopqrstuvwxyz0123456789-/."
+		anyChars = "abc XYZ 019 :;@!#&=\\\t\x01\x7féあ"
+	)
+	word := func(chars string, min, max int) string {
+		runes := []rune(chars)
+		b := make([]rune, min+r.Intn(max-min+1))
+		for i := range b {
+			b[i] = runes[r.Intn(len(runes))]
+		}
+		return string(b)
+	}
+	middle := func() string {
+		for {
+			s := word(anyChars, 1, 8)
+			if s[0] != ':' && !strings.Contains(s, " ") {
+				return s
+			}
+		}
+	}
+
+	m := new(Message)
+	if r.Intn(2) == 0 {
+		m.Tags = make(map[string]string)
+		for i := r.Intn(4); i >= 0; i-- {
+			key := word(keyChars, 1, 8)
+			if r.Intn(3) == 0 {
+				key = "+" + key
+			}
+			m.Tags[key] = word(anyChars+"\r\n", 0, 10)
+		}
+	}
+
+	switch r.Intn(3) {
+	case 0:
+		m.From = &Hostmask{Address: word(letters, 1, 10) + "." + word(keyChars, 1, 10)}
+	case 1:
+		m.From = &Hostmask{word(letters, 1, 8), "~" + word(keyChars, 1, 8), word(keyChars, 1, 12)}
+	}
+
+	if r.Intn(3) == 0 {
+		m.Command = fmt.Sprintf("%03d", r.Intn(1000))
+	} else {
+		m.Command = word(letters, 1, 10)
+	}
+
+	for i := r.Intn(MaxParams); i > 0; i-- {
+		m.Params = append(m.Params, middle())
+	}
+	if len(m.Params) < MaxParams && r.Intn(2) == 0 {
+		m.Trailing = word(anyChars, 0, 20)
+		m.HasTrailing = true
+	}
+	return m
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		m := randomMessage(r)
+		if err := m.Validate(); err != nil {
+			t.Fatalf("generated invalid message %#v: %v", m, err)
+		}
+
+		line := m.String()
+		back, err := ParseMessage(line)
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if !equalMessage(m, back) {
+			t.Fatalf("%q parses to %#v, expect %#v", line, back, m)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+)
+
+// defaultModes is how many modes with a param the client puts in one MODE
+// line when the server doesn't say, as RFC 2812 allows.
+const defaultModes = 3
+
+// A ModeChange sets or unsets one mode, with its param if it takes one.
+type ModeChange struct {
+	Add   bool
+	Mode  byte
+	Param string
+}
+
+func (m ModeChange) String() string {
+	sign := "-"
+	if m.Add {
+		sign = "+"
+	}
+	if m.Param == "" {
+		return sign + string(m.Mode)
+	}
+	return sign + string(m.Mode) + " " + m.Param
+}
+
+// A ModeBuilder collects mode changes for a channel, or the client itself,
+// and sends them in as few MODE lines as the server allows: as many modes
+// with params per line as its MODES token says, keeping each line well
+// under the 512 byte limit. Changes are sent in the order they were added.
+type ModeBuilder struct {
+	c       *Client
+	target  string
+	changes []ModeChange
+}
+
+// Modes returns a ModeBuilder for target.
+func (c *Client) Modes(target string) *ModeBuilder {
+	return &ModeBuilder{c: c, target: target}
+}
+
+// Add sets mode, once for each of params if it takes a param:
+//
+//	c.Modes("#chan").Add('m').Add('b', mask1, mask2).Send()
+func (b *ModeBuilder) Add(mode byte, params ...string) *ModeBuilder {
+	return b.change(true, mode, params)
+}
+
+// Remove unsets mode, once for each of params if it takes a param.
+func (b *ModeBuilder) Remove(mode byte, params ...string) *ModeBuilder {
+	return b.change(false, mode, params)
+}
+
+// Change adds changes as they are.
+func (b *ModeBuilder) Change(changes ...ModeChange) *ModeBuilder {
+	b.changes = append(b.changes, changes...)
+	return b
+}
+
+func (b *ModeBuilder) change(add bool, mode byte, params []string) *ModeBuilder {
+	if len(params) == 0 {
+		b.changes = append(b.changes, ModeChange{Add: add, Mode: mode})
+	}
+	for _, param := range params {
+		b.changes = append(b.changes, ModeChange{Add: add, Mode: mode, Param: param})
+	}
+	return b
+}
+
+// Changes returns the changes added so far.
+func (b *ModeBuilder) Changes() []ModeChange {
+	return b.changes
+}
+
+// Messages returns the MODE lines Send would send.
+func (b *ModeBuilder) Messages() []*Message {
+	limit := b.c.modesPerLine()
+
+	var (
+		msgs   []*Message
+		modes  strings.Builder
+		params []string
+		sign   byte
+		size   int
+		n      int // changes with params in this line
+	)
+	flush := func() {
+		if modes.Len() == 0 {
+			return
+		}
+		msgs = append(msgs, &Message{
+			Command: "MODE",
+			Params:  append([]string{b.target, modes.String()}, params...),
+		})
+		modes.Reset()
+		params, sign, size, n = nil, 0, 0, 0
+	}
+	for _, ch := range b.changes {
+		cost := 2 + len(ch.Param)
+		if (ch.Param != "" && limit > 0 && n == limit) || size+cost > maxLineBudget {
+			flush()
+		}
+		s := byte('-')
+		if ch.Add {
+			s = '+'
+		}
+		if s != sign {
+			modes.WriteByte(s)
+			sign = s
+		}
+		modes.WriteByte(ch.Mode)
+		if ch.Param != "" {
+			params = append(params, ch.Param)
+			n++
+		}
+		size += cost
+	}
+	flush()
+	return msgs
+}
+
+// Send sends the changes, returning a Delivery for each line.
+func (b *ModeBuilder) Send() []*Delivery {
+	msgs := b.Messages()
+	ds := make([]*Delivery, len(msgs))
+	for i, m := range msgs {
+		ds[i] = b.c.enqueue(m)
+	}
+	return ds
+}
+
+// modesPerLine returns how many modes with params the server takes in one
+// MODE line, or 0 if there's no limit.
+func (c *Client) modesPerLine() int {
+	v, ok := c.ISupport("MODES")
+	if !ok {
+		return defaultModes
+	}
+	n, _ := strconv.Atoi(v)
+	return n
+}
@@ -0,0 +1,53 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestModeBuilder(t *testing.T) {
+	long := strings.Repeat("x", 150)
+	table := []struct {
+		caps  map[string]string
+		build func(b *ModeBuilder)
+		exp   []string
+	}{
+		{
+			nil,
+			func(b *ModeBuilder) { b.Add('b', "a!*@*", "b!*@*", "c!*@*", "d!*@*") },
+			[]string{"MODE #chan +bbb a!*@* b!*@* c!*@*", "MODE #chan +b d!*@*"},
+		},
+		{
+			map[string]string{"MODES": "2"},
+			func(b *ModeBuilder) { b.Add('m').Remove('b', "a!*@*").Add('o', "nick").Add('v', "nick").Remove('i') },
+			[]string{"MODE #chan +m-b+o a!*@* nick", "MODE #chan +v-i nick"},
+		},
+		{
+			map[string]string{"MODES": ""},
+			func(b *ModeBuilder) { b.Add('e', "a", "b", "c", "d", "e") },
+			[]string{"MODE #chan +eeeee a b c d e"},
+		},
+		{
+			map[string]string{"MODES": ""},
+			func(b *ModeBuilder) { b.Add('b', long, long, long) },
+			[]string{"MODE #chan +bb " + long + " " + long, "MODE #chan +b " + long},
+		},
+		{
+			nil,
+			func(b *ModeBuilder) {},
+			nil,
+		},
+	}
+	for i, test := range table {
+		c := &Client{caps: test.caps}
+		b := c.Modes("#chan")
+		test.build(b)
+		var lines []string
+		for _, m := range b.Messages() {
+			lines = append(lines, m.String())
+		}
+		if strings.Join(lines, "\n") != strings.Join(test.exp, "\n") {
+			t.Errorf("%d: expect %q, got %q", i, test.exp, lines)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultRegainInterval is how often the client tries to take back its
+	// preferred nick when Client.RegainInterval is zero and the server
+	// can't MONITOR it.
+	DefaultRegainInterval = time.Minute
+
+	// MaxNickAttempts bounds how many nicks the client falls back on while
+	// registering before it gives up.
+	MaxNickAttempts = 10
+)
+
+// ErrNoNick is the connection error when the server has refused every nick
+// the client tried while registering.
+var ErrNoNick = errors.New("irc: server refused every nick tried")
+
+// A NickStrategy picks the nicks to fall back on while registering, when
+// the server refuses the one the client asked for.
+type NickStrategy interface {
+	// Next returns the nick to try after n refusals, counting from 1, of
+	// the preferred nick and the ones Next returned before. nicklen is the
+	// server's NICKLEN, or 0 if it isn't known yet. Next returns "" when it
+	// has no more nicks to offer.
+	Next(preferred string, n, nicklen int) string
+}
+
+// NickStrategyFunc is an adapter to allow the use of ordinary functions as
+// a NickStrategy.
+type NickStrategyFunc func(preferred string, n, nicklen int) string
+
+func (f NickStrategyFunc) Next(preferred string, n, nicklen int) string {
+	return f(preferred, n, nicklen)
+}
+
+// NickFallback is the default NickStrategy. It tries Alternatives in order,
+// then the preferred nick with a counter appended: nick1, nick2 and so on.
+// Nicks are cut down to NICKLEN where necessary, keeping the counter.
+type NickFallback struct {
+	Alternatives []string
+}
+
+func (f NickFallback) Next(preferred string, n, nicklen int) string {
+	if n <= len(f.Alternatives) {
+		return truncateNick(f.Alternatives[n-1], "", nicklen)
+	}
+	return truncateNick(preferred, strconv.Itoa(n-len(f.Alternatives)), nicklen)
+}
+
+// truncateNick returns nick+suffix, cutting nick short so that the whole is
+// no longer than nicklen, if that is non-zero.
+func truncateNick(nick, suffix string, nicklen int) string {
+	if nicklen > 0 && len(nick)+len(suffix) > nicklen && nicklen > len(suffix) {
+		nick = nick[:nicklen-len(suffix)]
+	}
+	return nick + suffix
+}
+
+// nickState tracks the client's nick on the current connection.
+type nickState struct {
+	mu         sync.Mutex
+	current    string
+	refused    int  // nicks refused while registering
+	registered bool // 001 has been received
+	monitoring bool // the preferred nick is MONITORed for regaining
+}
+
+// CurrentNick returns the nick the client has on the server. It is Nick,
+// unless the server refused that and the client is using a fallback.
+func (c *Client) CurrentNick() string {
+	c.nick.mu.Lock()
+	defer c.nick.mu.Unlock()
+	if c.nick.current == "" {
+		return c.Nick
+	}
+	return c.nick.current
+}
+
+// isMe reports whether nick is the client's current nick.
+func (c *Client) isMe(nick string) bool {
+	return strings.EqualFold(nick, c.CurrentNick())
+}
+
+// hasPreferred reports whether the client has Nick, or as much of it as
+// the server's NICKLEN allows.
+func (c *Client) hasPreferred() bool {
+	current := c.CurrentNick()
+	if strings.EqualFold(current, c.Nick) {
+		return true
+	}
+	nicklen, _ := strconv.Atoi(c.caps["NICKLEN"])
+	return nicklen > 0 && len(c.Nick) > nicklen && strings.EqualFold(current, c.Nick[:nicklen])
+}
+
+// resetNick starts a new connection off with the preferred nick.
+func (c *Client) resetNick() {
+	c.nick.mu.Lock()
+	c.nick.current = c.Nick
+	c.nick.refused = 0
+	c.nick.registered = false
+	c.nick.monitoring = false
+	c.nick.mu.Unlock()
+}
+
+// setNick records that the server now knows the client as nick. If that is
+// the preferred nick, there's nothing left to regain.
+func (c *Client) setNick(nick string) {
+	c.nick.mu.Lock()
+	c.nick.current = nick
+	stopMonitor := c.nick.monitoring && strings.EqualFold(nick, c.Nick)
+	if stopMonitor {
+		c.nick.monitoring = false
+	}
+	c.nick.mu.Unlock()
+
+	if stopMonitor && !c.watching(c.Nick) {
+		c.Command("MONITOR", []string{"-", c.Nick})
+	}
+}
+
+// nickRefused handles the server refusing a nick, with one of:
+//
+//	432 ERR_ERRONEUSNICKNAME
+//	433 ERR_NICKNAMEINUSE
+//	436 ERR_NICKCOLLISION
+//	437 ERR_UNAVAILRESOURCE
+//
+// While registering, the next nick from the NickStrategy is tried, until
+// it runs out or MaxNickAttempts have been refused, when the connection
+// fails with ErrNoNick. Once registered, the refusal can only be of an
+// attempt to regain the preferred nick, and the client keeps the one it
+// has.
+func (c *Client) nickRefused(m *Message) {
+	c.nick.mu.Lock()
+	if c.nick.registered {
+		c.nick.mu.Unlock()
+		return
+	}
+	c.nick.refused++
+	n := c.nick.refused
+	c.nick.mu.Unlock()
+
+	nicklen, _ := strconv.Atoi(c.caps["NICKLEN"])
+	strategy := c.NickStrategy
+	if strategy == nil {
+		strategy = NickFallback{}
+	}
+	var next string
+	if n <= MaxNickAttempts {
+		next = strategy.Next(c.Nick, n, nicklen)
+	}
+	if next == "" {
+		c.fail(ErrNoNick)
+		return
+	}
+
+	c.nick.mu.Lock()
+	c.nick.current = next
+	c.nick.mu.Unlock()
+	c.NICK(next)
+}
+
+// welcomed records the nick the server registered the client with, which
+// is the first param of RPL_WELCOME and may differ from what was asked for
+// if the server cut it short.
+func (c *Client) welcomed(m *Message) {
+	c.nick.mu.Lock()
+	c.nick.registered = true
+	c.nick.mu.Unlock()
+	if nick := m.Param(0); nick != "" {
+		c.setNick(nick)
+	}
+}
+
+// startRegain sets about taking back the preferred nick, if the client
+// didn't get it, once registration is complete: with services, if Reclaim
+// is set, then by MONITORing the nick and taking it as soon as it's free,
+// or failing that, by trying for it every RegainInterval.
+func (c *Client) startRegain() {
+	if c.RegainInterval < 0 || c.hasPreferred() {
+		return
+	}
+	if c.Reclaim != nil {
+		c.Reclaim(c, c.Nick)
+	}
+	if _, ok := c.caps["MONITOR"]; ok {
+		c.nick.mu.Lock()
+		c.nick.monitoring = true
+		c.nick.mu.Unlock()
+		c.Command("MONITOR", []string{"+", c.Nick})
+		return
+	}
+	c.wg.Add(1)
+	go c.regainLoop()
+}
+
+// regainMonitorFull falls back to trying for the preferred nick every
+// RegainInterval if the server had no room to MONITOR it.
+func (c *Client) regainMonitorFull(nick string) {
+	c.nick.mu.Lock()
+	full := c.nick.monitoring && strings.EqualFold(nick, c.Nick)
+	if full {
+		c.nick.monitoring = false
+	}
+	c.nick.mu.Unlock()
+	if full {
+		c.wg.Add(1)
+		go c.regainLoop()
+	}
+}
+
+// regainLoop tries for the preferred nick every RegainInterval until the
+// client has it or the connection closes.
+func (c *Client) regainLoop() {
+	defer c.wg.Done()
+
+	interval := c.RegainInterval
+	if interval == 0 {
+		interval = DefaultRegainInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.die:
+			return
+		case <-t.C:
+		}
+		if c.hasPreferred() {
+			return
+		}
+		c.regain()
+	}
+}
+
+// regain asks for the preferred nick, if the client doesn't have it.
+func (c *Client) regain() {
+	c.nick.mu.Lock()
+	registered := c.nick.registered
+	c.nick.mu.Unlock()
+	if registered && c.RegainInterval >= 0 && !c.hasPreferred() {
+		c.NICK(c.Nick)
+	}
+}
+
+// nickFreed notes that nick may have become free, because its holder
+// changed nick, quit or went offline, and regains it if it's the preferred
+// one.
+func (c *Client) nickFreed(nick string) {
+	if strings.EqualFold(nick, c.Nick) {
+		c.regain()
+	}
+}
@@ -0,0 +1,174 @@
+package irc
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNickFallback(t *testing.T) {
+	f := NickFallback{Alternatives: []string{"botty", "alternative"}}
+	table := []struct {
+		n, nicklen int
+		exp        string
+	}{
+		{1, 0, "botty"},
+		{2, 0, "alternative"},
+		{2, 9, "alternati"},
+		{3, 0, "verylongnick1"},
+		{3, 9, "verylong1"},
+		{12, 9, "verylon10"},
+	}
+	for _, test := range table {
+		if nick := f.Next("verylongnick", test.n, test.nicklen); nick != test.exp {
+			t.Errorf("Next(%d, %d): expect %q, got %q", test.n, test.nicklen, test.exp, nick)
+		}
+	}
+}
+
+func TestNickRefused(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", RegainInterval: -1}
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	io.WriteString(server, ":irc.test 433 * bot :Nickname is already in use\r\n")
+	if m := readMessage(t, r); m.String() != "NICK bot1" {
+		t.Errorf("expect NICK bot1, got %q", m)
+	}
+	io.WriteString(server, ":irc.test 432 * bot1 :Erroneous nickname\r\n")
+	if m := readMessage(t, r); m.String() != "NICK bot2" {
+		t.Errorf("expect NICK bot2, got %q", m)
+	}
+	io.WriteString(server, ":irc.test 001 bot2 :Welcome\r\n:irc.test 376 bot2 :End of /MOTD command.\r\n")
+
+	// once registered, refusals don't change the nick
+	io.WriteString(server, ":irc.test 433 bot2 bot :Nickname is already in use\r\n")
+	io.WriteString(server, "PING :sync\r\n")
+	if m := readMessage(t, r); m.Command != "PONG" {
+		t.Errorf("expect nothing before PONG, got %q", m)
+	}
+	if c.CurrentNick() != "bot2" || c.Nick != "bot" {
+		t.Errorf("expect current nick bot2 and Nick bot, got %q and %q", c.CurrentNick(), c.Nick)
+	}
+}
+
+func TestNickGiveUp(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", RegainInterval: -1, Flood: &FloodProfile{Window: time.Hour}}
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	nick := "bot"
+	for i := 1; i <= MaxNickAttempts; i++ {
+		io.WriteString(server, ":irc.test 433 * "+nick+" :Nickname is already in use\r\n")
+		m := readMessage(t, r)
+		if m.Command != "NICK" {
+			t.Fatalf("expect NICK, got %q", m)
+		}
+		nick = m.Param(0)
+	}
+	io.WriteString(server, ":irc.test 433 * "+nick+" :Nickname is already in use\r\n")
+	if err := c.Run(); !errors.Is(err, ErrNoNick) {
+		t.Errorf("expect ErrNoNick, got %v", err)
+	}
+
+	// a strategy can run out sooner
+	c = &Client{Nick: "bot", User: "bot", RegainInterval: -1}
+	c.NickStrategy = NickStrategyFunc(func(preferred string, n, nicklen int) string {
+		if n > 1 {
+			return ""
+		}
+		return "bot_"
+	})
+	server, r = connectPipe(t, c)
+	defer c.Close()
+	io.WriteString(server, ":irc.test 433 * bot :Nickname is already in use\r\n")
+	if m := readMessage(t, r); m.String() != "NICK bot_" {
+		t.Fatalf("expect NICK bot_, got %q", m)
+	}
+	io.WriteString(server, ":irc.test 433 * bot_ :Nickname is already in use\r\n")
+	if err := c.Run(); !errors.Is(err, ErrNoNick) {
+		t.Errorf("expect ErrNoNick, got %v", err)
+	}
+}
+
+func TestNickRegainMonitor(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", Flood: &FloodProfile{Window: time.Hour}}
+	reclaimed := make(chan string, 1)
+	c.Reclaim = func(c *Client, nick string) {
+		reclaimed <- nick
+	}
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	io.WriteString(server, ":irc.test 433 * bot :Nickname is already in use\r\n")
+	readMessage(t, r)
+	io.WriteString(server, ":irc.test 001 bot1 :Welcome\r\n"+
+		":irc.test 005 bot1 MONITOR=10 :are supported by this server\r\n"+
+		":irc.test 376 bot1 :End of /MOTD command.\r\n")
+	if m := readMessage(t, r); m.String() != "MONITOR + bot" {
+		t.Errorf("expect MONITOR + bot, got %q", m)
+	}
+	if nick := <-reclaimed; nick != "bot" {
+		t.Errorf("expect Reclaim of bot, got %q", nick)
+	}
+
+	io.WriteString(server, ":irc.test 731 bot1 :bot\r\n")
+	if m := readMessage(t, r); m.String() != "NICK bot" {
+		t.Errorf("expect NICK bot once it's free, got %q", m)
+	}
+	io.WriteString(server, ":bot1!bot@host NICK :bot\r\n")
+	if m := readMessage(t, r); m.String() != "MONITOR - bot" {
+		t.Errorf("expect MONITOR - bot, got %q", m)
+	}
+	if c.CurrentNick() != "bot" {
+		t.Errorf("expect current nick bot, got %q", c.CurrentNick())
+	}
+}
+
+func TestNickRegainPeriodic(t *testing.T) {
+	// no flood control, to retry quickly
+	c := &Client{Nick: "bot", User: "bot", RegainInterval: 20 * time.Millisecond, Flood: &FloodProfile{Window: time.Hour}}
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	io.WriteString(server, ":irc.test 433 * bot :Nickname is already in use\r\n")
+	readMessage(t, r)
+	io.WriteString(server, ":irc.test 001 bot1 :Welcome\r\n:irc.test 422 bot1 :MOTD File is missing\r\n")
+	for i := 0; i < 2; i++ {
+		if m := readMessage(t, r); m.String() != "NICK bot" {
+			t.Fatalf("expect NICK bot, got %q", m)
+		}
+		io.WriteString(server, ":irc.test 433 bot1 bot :Nickname is already in use\r\n")
+	}
+
+	io.WriteString(server, ":bot1!bot@host NICK bot\r\n")
+	io.WriteString(server, "PING :sync\r\n")
+	for {
+		m := readMessage(t, r)
+		if m.Command == "PONG" {
+			break
+		}
+		if m.String() != "NICK bot" {
+			t.Fatalf("expect NICK bot, got %q", m)
+		}
+	}
+	io.WriteString(server, "PING :again\r\n")
+	if m := readMessage(t, r); m.Command != "PONG" {
+		t.Errorf("expect no more attempts, got %q", m)
+	}
+}
+
+func TestNickRegainOnQuit(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", RegainInterval: time.Hour}
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	io.WriteString(server, ":irc.test 433 * bot :Nickname is already in use\r\n")
+	readMessage(t, r)
+	io.WriteString(server, ":irc.test 001 bot1 :Welcome\r\n:irc.test 376 bot1 :End of /MOTD command.\r\n")
+	io.WriteString(server, ":bot!someone@else QUIT :Ping timeout\r\n")
+	if m := readMessage(t, r); m.String() != "NICK bot" {
+		t.Errorf("expect NICK bot when its holder quits, got %q", m)
+	}
+}
@@ -0,0 +1,396 @@
+package irc
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultISONInterval is how often the client polls with ISON when
+// Client.ISONInterval is zero.
+const DefaultISONInterval = time.Minute
+
+// watched is a user whose presence is tracked.
+type watched struct {
+	nick   string // as given to Watch
+	online bool
+	known  bool      // online has been reported at least once
+	host   *Hostmask // while online, as well as the server has told us
+	ison   bool      // polled with ISON rather than watched with MONITOR
+}
+
+// presence tracks the users given to Watch. The list and what is known of
+// each user are kept across connections, so that a reconnect only reports
+// the users whose presence actually changed.
+type presence struct {
+	mu      sync.Mutex
+	users   map[string]*watched // by lower case nick
+	started bool                // watching on this connection
+	monitor int                 // MONITOR limit: -1 for none, 0 for no limit
+
+	// asked are the nicks in each of the client's own ISON lines, until
+	// they are written. queries are the ISON lines written and awaiting
+	// RPL_ISON, in order, with nil for those sent with Command or SendRaw,
+	// whose replies aren't the client's to take.
+	asked   map[*Message][]string
+	queries [][]string
+}
+
+// Watch adds nicks to the users whose presence is tracked. EventOnline and
+// EventOffline are dispatched when they come and go, and once the client
+// first learns whether each is online. The server is asked to report them
+// with MONITOR where it supports it; otherwise, or once its MONITOR list is
+// full, the client polls with ISON every ISONInterval. Watch may be called
+// before Connect, and the list is kept across reconnects.
+func (c *Client) Watch(nicks ...string) {
+	p := &c.presence
+	p.mu.Lock()
+	if p.users == nil {
+		p.users = make(map[string]*watched)
+	}
+	var added []string
+	for _, nick := range nicks {
+		key := strings.ToLower(nick)
+		if _, ok := p.users[key]; ok || nick == "" {
+			continue
+		}
+		p.users[key] = &watched{nick: nick}
+		added = append(added, nick)
+	}
+	started := p.started
+	p.mu.Unlock()
+
+	if started {
+		c.watch(added)
+	}
+}
+
+// Unwatch stops tracking the presence of nicks.
+func (c *Client) Unwatch(nicks ...string) {
+	p := &c.presence
+	p.mu.Lock()
+	var monitored []string
+	for _, nick := range nicks {
+		key := strings.ToLower(nick)
+		w, ok := p.users[key]
+		if !ok {
+			continue
+		}
+		if !w.ison {
+			monitored = append(monitored, w.nick)
+		}
+		delete(p.users, key)
+	}
+	send := p.started && p.monitor >= 0
+	p.mu.Unlock()
+
+	if send {
+		for _, line := range joinLimited(monitored, ",") {
+			c.Command("MONITOR", []string{"-", line})
+		}
+	}
+}
+
+// Online reports whether nick is known to be online, and if so its
+// hostmask. With ISON, only the nick is known.
+func (c *Client) Online(nick string) (*Hostmask, bool) {
+	p := &c.presence
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w, ok := p.users[strings.ToLower(nick)]
+	if !ok || !w.online {
+		return nil, false
+	}
+	return w.host, true
+}
+
+// watching reports whether nick is being watched with MONITOR.
+func (c *Client) watching(nick string) bool {
+	p := &c.presence
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w, ok := p.users[strings.ToLower(nick)]
+	return ok && !w.ison
+}
+
+// startPresence begins watching the users given to Watch once registration
+// is complete, with MONITOR if the server advertises it. It reports false,
+// doing nothing, if it has already been called on this connection.
+func (c *Client) startPresence() bool {
+	p := &c.presence
+	p.mu.Lock()
+	if p.started {
+		p.mu.Unlock()
+		return false
+	}
+	p.started = true
+	p.monitor = -1
+	if v, ok := c.caps["MONITOR"]; ok {
+		p.monitor, _ = strconv.Atoi(v)
+	}
+	for _, w := range p.users {
+		w.ison = false
+	}
+	nicks := p.nicks(func(*watched) bool { return true })
+	p.mu.Unlock()
+
+	c.watch(nicks)
+	c.wg.Add(1)
+	go c.isonLoop()
+	return true
+}
+
+// nicks returns the nicks of the users that match, in a stable order. p.mu
+// must be held.
+func (p *presence) nicks(match func(*watched) bool) []string {
+	keys := make([]string, 0, len(p.users))
+	for key, w := range p.users {
+		if match(w) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		keys[i] = p.users[key].nick
+	}
+	return keys
+}
+
+// resetPresence forgets the state of the last connection.
+func (c *Client) resetPresence() {
+	p := &c.presence
+	p.mu.Lock()
+	p.started = false
+	p.asked = nil
+	p.queries = nil
+	p.mu.Unlock()
+}
+
+// watch starts watching nicks on this connection: with MONITOR as far as
+// the server's limit allows, and by polling with ISON past it.
+func (c *Client) watch(nicks []string) {
+	if len(nicks) == 0 {
+		return
+	}
+	p := &c.presence
+	p.mu.Lock()
+	var monitor, ison []string
+	if p.monitor >= 0 {
+		monitored := 0
+		for _, w := range p.users {
+			if !w.ison {
+				monitored++
+			}
+		}
+		// the new nicks are already counted
+		monitored -= len(nicks)
+		for _, nick := range nicks {
+			if p.monitor == 0 || monitored < p.monitor {
+				monitor = append(monitor, nick)
+				monitored++
+			} else {
+				ison = append(ison, nick)
+			}
+		}
+	} else {
+		ison = nicks
+	}
+	for _, nick := range ison {
+		if w := p.users[strings.ToLower(nick)]; w != nil {
+			w.ison = true
+		}
+	}
+	p.mu.Unlock()
+
+	for _, line := range joinLimited(monitor, ",") {
+		c.Command("MONITOR", []string{"+", line})
+	}
+	c.ison(ison)
+}
+
+// isonLoop polls the users not watched with MONITOR until the connection
+// closes.
+func (c *Client) isonLoop() {
+	defer c.wg.Done()
+
+	interval := c.ISONInterval
+	if interval == 0 {
+		interval = DefaultISONInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.die:
+			return
+		case <-t.C:
+		}
+
+		p := &c.presence
+		p.mu.Lock()
+		nicks := p.nicks(func(w *watched) bool { return w.ison })
+		p.mu.Unlock()
+		c.ison(nicks)
+	}
+}
+
+// ison asks the server which of nicks are online.
+func (c *Client) ison(nicks []string) {
+	p := &c.presence
+	for _, line := range joinLimited(nicks, " ") {
+		m := &Message{Command: "ISON", Trailing: line, HasTrailing: true}
+		p.mu.Lock()
+		if p.asked == nil {
+			p.asked = make(map[*Message][]string)
+		}
+		p.asked[m] = strings.Fields(line)
+		p.mu.Unlock()
+		c.enqueue(m)
+	}
+}
+
+// isonSent notes m, if it is an ISON line, as awaiting its reply. It is
+// called just before m is written, since replies come in the order the
+// lines were written rather than queued.
+func (c *Client) isonSent(m *Message) {
+	if m.Command != "ISON" {
+		return
+	}
+	p := &c.presence
+	p.mu.Lock()
+	asked := p.asked[m]
+	delete(p.asked, m)
+	p.queries = append(p.queries, asked)
+	p.mu.Unlock()
+}
+
+// handleIson takes the reply to the oldest ISON query: the nicks in it that
+// are online, and by their absence, the ones that aren't. A reply to an
+// ISON the client didn't send itself is ignored.
+//
+//	:server 303 <nick> :[<nick>{ <nick>}]
+func (c *Client) handleIson(m *Message) {
+	p := &c.presence
+	p.mu.Lock()
+	if len(p.queries) == 0 {
+		p.mu.Unlock()
+		return
+	}
+	asked := p.queries[0]
+	p.queries = p.queries[1:]
+	p.mu.Unlock()
+	if asked == nil {
+		return
+	}
+
+	online := make(map[string]bool)
+	for _, nick := range strings.Fields(m.LastParam()) {
+		online[strings.ToLower(nick)] = true
+	}
+	for _, nick := range asked {
+		c.setPresence(&Hostmask{Nick: nick}, online[strings.ToLower(nick)])
+	}
+}
+
+// handleMonitor takes the server's reports on monitored users:
+//
+//	:server 730 <nick> :<target>[!<user>@<host>][,...]   RPL_MONONLINE
+//	:server 731 <nick> :<target>[,...]                   RPL_MONOFFLINE
+//	:server 734 <nick> <limit> <targets> :<reason>       ERR_MONLISTFULL
+func (c *Client) handleMonitor(m *Message) {
+	switch m.Command {
+	case "730", "731":
+		for _, target := range strings.Split(m.LastParam(), ",") {
+			h, err := ParseHostmask(target)
+			if err != nil || h.Nick == "" {
+				continue
+			}
+			c.setPresence(h, m.Command == "730")
+			if m.Command == "731" {
+				c.nickFreed(h.Nick)
+			}
+		}
+
+	case "734":
+		// the rest are polled instead
+		var full []string
+		p := &c.presence
+		p.mu.Lock()
+		nicks := strings.Split(m.Param(2), ",")
+		for _, nick := range nicks {
+			if w := p.users[strings.ToLower(nick)]; w != nil && !w.ison {
+				w.ison = true
+				full = append(full, w.nick)
+			}
+		}
+		p.mu.Unlock()
+		c.ison(full)
+		for _, nick := range nicks {
+			c.regainMonitorFull(nick)
+		}
+	}
+}
+
+// setPresence records whether the user h is online, and dispatches
+// EventOnline or EventOffline if that's news.
+func (c *Client) setPresence(h *Hostmask, online bool) {
+	p := &c.presence
+	p.mu.Lock()
+	w, ok := p.users[strings.ToLower(h.Nick)]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	changed := !w.known || w.online != online
+	w.known = true
+	w.online = online
+	if online {
+		if w.host == nil || h.User != "" || h.Address != "" {
+			w.host = h
+		}
+		h = w.host
+	} else {
+		w.host = nil
+	}
+	p.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	event := EventOffline
+	if online {
+		event = EventOnline
+	}
+	c.dispatch(&Message{
+		Time:    time.Now(),
+		From:    h,
+		Command: event,
+		Params:  []string{h.Nick},
+	})
+}
+
+// joinLimited joins items with sep into as few lines as it can while
+// keeping each under maxLineBudget bytes.
+func joinLimited(items []string, sep string) []string {
+	var (
+		lines []string
+		b     strings.Builder
+	)
+	for _, item := range items {
+		if b.Len() > 0 && b.Len()+len(sep)+len(item) > maxLineBudget {
+			lines = append(lines, b.String())
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(item)
+	}
+	if b.Len() > 0 {
+		lines = append(lines, b.String())
+	}
+	return lines
+}
@@ -0,0 +1,136 @@
+package irc
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// presenceEvents collects EventOnline and EventOffline as "online nick!user@host".
+func presenceEvents(c *Client) <-chan string {
+	events := make(chan string, 10)
+	for _, event := range []string{EventOnline, EventOffline} {
+		c.HandleFunc(event, func(c *Client, m *Message) {
+			events <- m.Command + " " + m.From.String()
+		})
+	}
+	return events
+}
+
+func expectEvent(t *testing.T, events <-chan string, exp string) {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e != exp {
+			t.Errorf("expect %s, got %s", exp, e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect %s", exp)
+	}
+}
+
+func TestPresenceMonitor(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	events := presenceEvents(c)
+	c.Watch("alice", "Bob")
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	// one fits in the MONITOR list, the other is polled
+	io.WriteString(server, ":irc.test 005 bot MONITOR=1 :are supported by this server\r\n"+
+		":irc.test 376 bot :End of /MOTD command.\r\n")
+	for _, exp := range []string{"MONITOR + alice", "ISON :Bob"} {
+		if m := readMessage(t, r); m.String() != exp {
+			t.Errorf("expect %q, got %q", exp, m)
+		}
+	}
+
+	io.WriteString(server, ":irc.test 730 bot :alice!a@example.com\r\n")
+	expectEvent(t, events, "online alice!a@example.com")
+	if h, ok := c.Online("ALICE"); !ok || h.Address != "example.com" {
+		t.Errorf("expect alice online with her hostmask, got %v", h)
+	}
+	io.WriteString(server, ":irc.test 303 bot :\r\n")
+	expectEvent(t, events, "offline Bob")
+
+	// repeats aren't news
+	io.WriteString(server, ":irc.test 730 bot :alice!a@example.com\r\n"+
+		":irc.test 731 bot :alice\r\n")
+	expectEvent(t, events, "offline alice")
+	if _, ok := c.Online("alice"); ok {
+		t.Error("expect alice offline")
+	}
+
+	c.Unwatch("alice", "bob")
+	if m := readMessage(t, r); m.String() != "MONITOR - alice" {
+		t.Errorf("expect MONITOR - alice, got %q", m)
+	}
+}
+
+func TestPresenceMonitorFull(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	c.Watch("a", "b")
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	io.WriteString(server, ":irc.test 005 bot MONITOR :are supported by this server\r\n"+
+		":irc.test 422 bot :MOTD File is missing\r\n")
+	if m := readMessage(t, r); m.String() != "MONITOR + a,b" {
+		t.Errorf("expect both monitored, got %q", m)
+	}
+	io.WriteString(server, ":irc.test 734 bot 1 b :Monitor list is full.\r\n")
+	if m := readMessage(t, r); m.String() != "ISON :b" {
+		t.Errorf("expect b polled, got %q", m)
+	}
+}
+
+func TestPresenceISON(t *testing.T) {
+	// no flood control, to poll quickly
+	c := &Client{Nick: "bot", User: "bot", ISONInterval: 20 * time.Millisecond, Flood: &FloodProfile{Window: time.Hour}}
+	events := presenceEvents(c)
+	c.Watch("alice")
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	io.WriteString(server, ":irc.test 376 bot :End of /MOTD command.\r\n")
+	for _, online := range []string{"alice", "ALICE", ""} {
+		if m := readMessage(t, r); m.String() != "ISON :alice" {
+			t.Fatalf("expect ISON :alice, got %q", m)
+		}
+		io.WriteString(server, ":irc.test 303 bot :"+online+"\r\n")
+	}
+	expectEvent(t, events, "online alice")
+	expectEvent(t, events, "offline alice")
+
+	// added later, it's asked about straight away, not at the next poll
+	c.Watch("carol")
+	for {
+		m := readMessage(t, r)
+		if m.String() == "ISON :carol" {
+			break
+		}
+		if !strings.HasPrefix(m.String(), "ISON :alice") {
+			t.Fatalf("expect ISON :carol, got %q", m)
+		}
+	}
+}
+
+func TestPresenceISONUnrequested(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot", ISONInterval: time.Hour, Flood: &FloodProfile{Window: time.Hour}}
+	events := presenceEvents(c)
+	c.Watch("alice")
+	server, r := connectPipe(t, c)
+	defer c.Close()
+
+	c.Command("ISON", nil, "bob")
+	readMessage(t, r)
+	io.WriteString(server, ":irc.test 376 bot :End of /MOTD command.\r\n")
+	if m := readMessage(t, r); m.String() != "ISON :alice" {
+		t.Fatalf("expect ISON :alice, got %q", m)
+	}
+
+	// the first reply answers the ISON sent with Command
+	io.WriteString(server, ":irc.test 303 bot :bob\r\n:irc.test 303 bot :alice\r\n")
+	expectEvent(t, events, "online alice")
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Penalty implements the flood control used by most ircds: every event adds
+// its cost to a virtual clock, which may run ahead of real time by at most
+// the window. Events wait while the clock is that far ahead, so short
+// bursts pass and sustained traffic settles to the rate the costs allow.
+type Penalty struct {
+	clock clock
+
+	mu     sync.Mutex
+	window time.Duration
+	until  time.Time // the virtual clock
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewPenalty returns a Penalty with the given window.
+func NewPenalty(window time.Duration) *Penalty {
+	return newPenalty(window, realClock{})
+}
+
+func newPenalty(window time.Duration, clk clock) *Penalty {
+	return &Penalty{
+		clock:  clk,
+		window: window,
+		stop:   make(chan struct{}),
+	}
+}
+
+// SetWindow changes how far the virtual clock may run ahead of real time.
+// Waiters pick up the new window the next time they check.
+func (p *Penalty) SetWindow(window time.Duration) {
+	p.mu.Lock()
+	p.window = window
+	p.mu.Unlock()
+}
+
+// Wait blocks until an event is allowed, then charges cost to the virtual
+// clock. It returns ctx.Err() if ctx is done first, or ErrStopped if p is
+// stopped.
+func (p *Penalty) Wait(ctx context.Context, cost time.Duration) error {
+	for {
+		ok, delay := p.take(cost)
+		if ok {
+			return nil
+		}
+		if delay < 0 {
+			return ErrStopped
+		}
+
+		c, cancel := p.clock.Timer(delay)
+		select {
+		case <-c:
+		case <-ctx.Done():
+			cancel()
+			return ctx.Err()
+		case <-p.stop:
+			cancel()
+			return ErrStopped
+		}
+	}
+}
+
+// TryAcquire charges cost and reports true if an event is allowed right
+// now. It never blocks.
+func (p *Penalty) TryAcquire(cost time.Duration) bool {
+	ok, _ := p.take(cost)
+	return ok
+}
+
+// Stop releases every pending Wait with ErrStopped and makes later calls
+// fail. It is safe to call more than once.
+func (p *Penalty) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// take charges cost if the clock is within the window. Otherwise it returns
+// how long until it will be, or a negative delay if p is stopped.
+func (p *Penalty) take(cost time.Duration) (bool, time.Duration) {
+	select {
+	case <-p.stop:
+		return false, -1
+	default:
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	if p.until.Before(now) {
+		p.until = now
+	}
+
+	// An event is let through whenever the clock is inside the window, even
+	// if its own cost takes it past; otherwise a single costly event could
+	// never be sent.
+	if ahead := p.until.Sub(now); ahead >= p.window {
+		return false, ahead - p.window + time.Nanosecond
+	}
+	p.until = p.until.Add(cost)
+	return true, 0
+}
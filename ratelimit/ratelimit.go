@@ -1,30 +1,135 @@
+// Package ratelimit provides a token bucket rate limiter.
 package ratelimit
 
-import "time"
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
 
+// ErrStopped is returned by Wait once the Limiter has been stopped.
+var ErrStopped = errors.New("ratelimit: limiter stopped")
+
+// Limiter allows bursts of up to eventsBeforeLimit events, refilling at one
+// event per rate. It holds no goroutines of its own; Stop only releases
+// waiters.
 type Limiter struct {
-	rate time.Duration
-	ch   chan struct{}
+	rate  time.Duration
+	burst int
+	clock clock
+
+	mu     sync.Mutex
+	tokens int
+	last   time.Time // time up to which tokens have been credited
+
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
+// New returns a Limiter that starts with a full bucket.
 func New(rate time.Duration, eventsBeforeLimit int) *Limiter {
-	l := &Limiter{rate, make(chan struct{}, uint(eventsBeforeLimit))}
-	go l.watch()
-	return l
+	return newLimiter(rate, eventsBeforeLimit, realClock{})
 }
 
+func newLimiter(rate time.Duration, burst int, clk clock) *Limiter {
+	return &Limiter{
+		rate:   rate,
+		burst:  burst,
+		clock:  clk,
+		tokens: burst,
+		last:   clk.Now(),
+		stop:   make(chan struct{}),
+	}
+}
+
+// GrabTicket blocks until an event is allowed or the Limiter is stopped.
+//
+// Deprecated: use Wait, which can be cancelled.
 func (l *Limiter) GrabTicket() {
-	<-l.ch
+	l.Wait(context.Background())
 }
 
-func (l *Limiter) watch() {
-	// fill queue to begin with
-	for i := 0; i < cap(l.ch); i++ {
-		l.ch <- struct{}{}
+// Wait blocks until an event is allowed. It returns ctx.Err() if ctx is done
+// first, or ErrStopped if the Limiter is stopped.
+func (l *Limiter) Wait(ctx context.Context) error {
+	for {
+		ok, delay := l.take()
+		if ok {
+			return nil
+		}
+		if delay < 0 {
+			return ErrStopped
+		}
+
+		c, cancel := l.clock.Timer(delay)
+		select {
+		case <-c:
+		case <-ctx.Done():
+			cancel()
+			return ctx.Err()
+		case <-l.stop:
+			cancel()
+			return ErrStopped
+		}
 	}
+}
 
-	for {
-		l.ch <- struct{}{}
-		time.Sleep(l.rate)
+// TryAcquire takes an event if one is allowed right now, reporting whether
+// it did. It never blocks.
+func (l *Limiter) TryAcquire() bool {
+	ok, _ := l.take()
+	return ok
+}
+
+// Stop releases every pending Wait with ErrStopped and makes later calls
+// fail. It is safe to call more than once.
+func (l *Limiter) Stop() {
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+// take consumes a token if one is available. Otherwise it returns how long
+// until the next one is credited, or a negative delay if l is stopped.
+func (l *Limiter) take() (bool, time.Duration) {
+	select {
+	case <-l.stop:
+		return false, -1
+	default:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	if n := int(now.Sub(l.last) / l.rate); n > 0 {
+		l.tokens += n
+		l.last = l.last.Add(time.Duration(n) * l.rate)
+	}
+	if l.tokens >= l.burst {
+		l.tokens = l.burst
+		l.last = now
+	}
+
+	if l.tokens > 0 {
+		l.tokens--
+		return true, 0
 	}
+	return false, l.rate - now.Sub(l.last)
+}
+
+// clock abstracts time so that tests can control it.
+type clock interface {
+	Now() time.Time
+	// Timer returns a channel that receives after d, and a function that
+	// releases it early.
+	Timer(d time.Duration) (<-chan time.Time, func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Timer(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTimer(d)
+	return t.C, func() { t.Stop() }
 }
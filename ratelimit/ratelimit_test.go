@@ -0,0 +1,223 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	when time.Time
+	c    chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1e9, 0)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Timer(d time.Duration) (<-chan time.Time, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan time.Time, 1)
+	f.timers = append(f.timers, fakeTimer{f.now.Add(d), c})
+	return c, func() {}
+}
+
+// Advance moves the clock forward, firing any timers that come due.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if !t.when.After(f.now) {
+			t.c <- f.now
+		} else {
+			pending = append(pending, t)
+		}
+	}
+	f.timers = pending
+}
+
+// waiting reports how many timers are outstanding.
+func (f *fakeClock) waiting() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+func TestTryAcquire(t *testing.T) {
+	clk := newFakeClock()
+	l := newLimiter(time.Second, 3, clk)
+
+	for i := 0; i < 3; i++ {
+		if !l.TryAcquire() {
+			t.Fatalf("burst event %d refused", i)
+		}
+	}
+	if l.TryAcquire() {
+		t.Fatal("event allowed past burst")
+	}
+
+	clk.Advance(999 * time.Millisecond)
+	if l.TryAcquire() {
+		t.Fatal("event allowed before refill")
+	}
+	clk.Advance(time.Millisecond)
+	if !l.TryAcquire() {
+		t.Fatal("event refused after refill")
+	}
+
+	// a long idle period refills no more than the burst
+	clk.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.TryAcquire() {
+			t.Fatalf("event %d after idle refused", i)
+		}
+	}
+	if l.TryAcquire() {
+		t.Fatal("idle period overfilled the bucket")
+	}
+}
+
+func TestWait(t *testing.T) {
+	clk := newFakeClock()
+	l := newLimiter(time.Second, 1, clk)
+
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- l.Wait(context.Background()) }()
+
+	for clk.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("Wait returned before refill")
+	default:
+	}
+
+	clk.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitCancel(t *testing.T) {
+	l := newLimiter(time.Second, 1, newFakeClock())
+	l.TryAcquire()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Wait(ctx); err != context.Canceled {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	clk := newFakeClock()
+	l := newLimiter(time.Second, 1, clk)
+	l.TryAcquire()
+
+	done := make(chan error)
+	go func() { done <- l.Wait(context.Background()) }()
+	for clk.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	l.Stop()
+	l.Stop()
+	if err := <-done; err != ErrStopped {
+		t.Errorf("expect ErrStopped, got %v", err)
+	}
+
+	clk.Advance(time.Hour)
+	if l.TryAcquire() {
+		t.Error("TryAcquire succeeded after Stop")
+	}
+	if err := l.Wait(context.Background()); err != ErrStopped {
+		t.Errorf("expect ErrStopped after Stop, got %v", err)
+	}
+}
+
+func TestPenalty(t *testing.T) {
+	clk := newFakeClock()
+	p := newPenalty(10*time.Second, clk)
+
+	// 2s per event with a 10s window: a burst of 5, then one per 2s
+	for i := 0; i < 5; i++ {
+		if !p.TryAcquire(2 * time.Second) {
+			t.Fatalf("burst event %d refused", i)
+		}
+	}
+	if p.TryAcquire(2 * time.Second) {
+		t.Fatal("event allowed past window")
+	}
+	clk.Advance(time.Second)
+	if !p.TryAcquire(2 * time.Second) {
+		t.Fatal("event refused once clock fell inside window")
+	}
+	if p.TryAcquire(0) {
+		t.Fatal("free event allowed while clock is outside window")
+	}
+
+	// an event costing more than the window still gets through alone
+	clk.Advance(time.Minute)
+	if !p.TryAcquire(time.Hour) {
+		t.Fatal("costly event refused on idle limiter")
+	}
+	if p.TryAcquire(time.Second) {
+		t.Fatal("event allowed after costly event")
+	}
+
+	p.SetWindow(2 * time.Hour)
+	if !p.TryAcquire(time.Second) {
+		t.Fatal("event refused after window grew")
+	}
+}
+
+func TestPenaltyWait(t *testing.T) {
+	clk := newFakeClock()
+	p := newPenalty(5*time.Second, clk)
+	p.TryAcquire(8 * time.Second)
+
+	done := make(chan error)
+	go func() { done <- p.Wait(context.Background(), time.Second) }()
+	for clk.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clk.Advance(2 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("Wait returned while clock outside window")
+	default:
+	}
+
+	clk.Advance(time.Second + time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	p.Stop()
+	if err := p.Wait(context.Background(), 0); err != ErrStopped {
+		t.Errorf("expect ErrStopped, got %v", err)
+	}
+}
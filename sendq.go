@@ -0,0 +1,231 @@
+package irc
+
+import (
+	"strings"
+	"sync"
+)
+
+// priorityCommands jump ahead of everything else in the send queue. They
+// keep the connection itself healthy and are never held up behind a long
+// reply to some channel.
+var priorityCommands = map[string]bool{
+	"PONG":         true,
+	"PING":         true,
+	"QUIT":         true,
+	"CAP":          true,
+	"AUTHENTICATE": true,
+	"PASS":         true,
+	"NICK":         true,
+	"USER":         true,
+}
+
+// QueueStats is a snapshot of the send queue.
+type QueueStats struct {
+	Queued   int            // messages waiting, in total
+	Priority int            // protocol messages waiting
+	Targets  map[string]int // user messages waiting, by target
+	Sent     uint64         // messages taken off the queue since Connect
+	Canceled uint64         // messages removed by CancelQueued
+}
+
+// sendQueue schedules outgoing messages. Protocol traffic goes first, in
+// order; everything else is queued per target and the targets are served
+// round-robin, so a flood to one channel doesn't starve the others.
+type sendQueue struct {
+	mu       sync.Mutex
+	ready    chan struct{} // receives after a push
+	priority []*outgoing
+	targets  map[string][]*outgoing
+	order    []string // targets with queued messages, in service order
+	inflight int      // popped but not yet finished
+	idle     []chan struct{}
+	sent     uint64
+	canceled uint64
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{
+		ready:   make(chan struct{}, 1),
+		targets: make(map[string][]*outgoing),
+	}
+}
+
+// queueKey returns the queue m belongs in, or "" for the priority queue.
+func queueKey(m *Message) (key string, priority bool) {
+	if priorityCommands[m.Command] {
+		return "", true
+	}
+	if len(m.Params) == 0 {
+		return "", false
+	}
+	if m.Command == "CHATHISTORY" && len(m.Params) > 1 {
+		// CHATHISTORY <subcommand> <target> ...
+		return strings.ToLower(m.Params[1]), false
+	}
+	return strings.ToLower(m.Params[0]), false
+}
+
+// push queues o. It reports false, queueing nothing, if o is a user message
+// and its target already has max messages waiting; max <= 0 means no limit.
+func (q *sendQueue) push(o *outgoing, max int) bool {
+	q.mu.Lock()
+	key, priority := queueKey(o.m)
+	if priority {
+		q.priority = append(q.priority, o)
+	} else {
+		if max > 0 && len(q.targets[key]) >= max {
+			q.mu.Unlock()
+			return false
+		}
+		if len(q.targets[key]) == 0 {
+			q.order = append(q.order, key)
+		}
+		q.targets[key] = append(q.targets[key], o)
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop returns the next message to send, or nil if there is none. The
+// caller must pass it to finish once it has been dealt with.
+func (q *sendQueue) pop() *outgoing {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var o *outgoing
+	if len(q.priority) > 0 {
+		o = q.priority[0]
+		q.priority[0] = nil
+		q.priority = q.priority[1:]
+	} else if len(q.order) > 0 {
+		key := q.order[0]
+		queue := q.targets[key]
+		o = queue[0]
+		queue[0] = nil
+		q.order = q.order[1:]
+		if len(queue) > 1 {
+			q.targets[key] = queue[1:]
+			q.order = append(q.order, key)
+		} else {
+			delete(q.targets, key)
+		}
+	} else {
+		return nil
+	}
+
+	q.inflight++
+	return o
+}
+
+// finish records that a popped message has been dealt with.
+func (q *sendQueue) finish() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inflight--
+	q.sent++
+	q.notifyIdle()
+}
+
+// cancel removes every message queued for target and returns them.
+func (q *sendQueue) cancel(target string) []*outgoing {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := strings.ToLower(target)
+	removed := q.targets[key]
+	if len(removed) == 0 {
+		return nil
+	}
+	delete(q.targets, key)
+	for i, k := range q.order {
+		if k == key {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+	q.canceled += uint64(len(removed))
+	q.notifyIdle()
+	return removed
+}
+
+// drain removes and returns everything still queued.
+func (q *sendQueue) drain() []*outgoing {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed := q.priority
+	for _, key := range q.order {
+		removed = append(removed, q.targets[key]...)
+	}
+	q.priority = nil
+	q.targets = make(map[string][]*outgoing)
+	q.order = nil
+	q.notifyIdle()
+	return removed
+}
+
+// whenIdle returns a channel that is closed once nothing is queued or
+// being written.
+func (q *sendQueue) whenIdle() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ch := make(chan struct{})
+	q.idle = append(q.idle, ch)
+	q.notifyIdle()
+	return ch
+}
+
+func (q *sendQueue) notifyIdle() {
+	if q.inflight > 0 || len(q.priority) > 0 || len(q.order) > 0 {
+		return
+	}
+	for _, ch := range q.idle {
+		close(ch)
+	}
+	q.idle = nil
+}
+
+func (q *sendQueue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s := QueueStats{
+		Priority: len(q.priority),
+		Targets:  make(map[string]int, len(q.targets)),
+		Sent:     q.sent,
+		Canceled: q.canceled,
+	}
+	s.Queued = s.Priority
+	for k, v := range q.targets {
+		s.Targets[k] = len(v)
+		s.Queued += len(v)
+	}
+	return s
+}
+
+// QueueStats returns a snapshot of the send queue.
+func (c *Client) QueueStats() QueueStats {
+	if c.send == nil {
+		return QueueStats{}
+	}
+	return c.send.stats()
+}
+
+// CancelQueued drops every message still waiting to be sent to target and
+// returns how many were dropped. Their Deliveries report ErrCanceled.
+// Protocol messages are never dropped.
+func (c *Client) CancelQueued(target string) int {
+	if c.send == nil {
+		return 0
+	}
+	removed := c.send.cancel(target)
+	for _, o := range removed {
+		o.d.complete(ErrCanceled)
+	}
+	return len(removed)
+}
@@ -0,0 +1,96 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func privmsg(target, text string) *outgoing {
+	return &outgoing{d: newDelivery(), m: &Message{Command: "PRIVMSG", Params: []string{target}, Trailing: text}}
+}
+
+func TestSendQueueOrder(t *testing.T) {
+	q := newSendQueue()
+	q.push(privmsg("#spam", "1"), 0)
+	q.push(privmsg("#spam", "2"), 0)
+	q.push(privmsg("#spam", "3"), 0)
+	q.push(privmsg("#other", "a"), 0)
+	q.push(&outgoing{d: newDelivery(), m: &Message{Command: "PONG", Params: []string{"x"}}}, 0)
+	q.push(privmsg("#OTHER", "b"), 0)
+	q.push(privmsg("nick", "c"), 0)
+
+	var got []string
+	for o := q.pop(); o != nil; o = q.pop() {
+		got = append(got, o.m.String())
+		q.finish()
+	}
+
+	expect := []string{
+		"PONG x",
+		"PRIVMSG #spam :1",
+		"PRIVMSG #other :a",
+		"PRIVMSG nick :c",
+		"PRIVMSG #spam :2",
+		"PRIVMSG #OTHER :b",
+		"PRIVMSG #spam :3",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("expect\n%q\ngot\n%q", expect, got)
+	}
+	if s := q.stats(); s.Sent != uint64(len(expect)) || s.Queued != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestSendQueueCancel(t *testing.T) {
+	q := newSendQueue()
+	q.push(privmsg("#spam", "1"), 0)
+	q.push(privmsg("#spam", "2"), 0)
+	q.push(privmsg("#other", "a"), 0)
+	q.push(&outgoing{d: newDelivery(), m: &Message{Command: "PONG", Params: []string{"x"}}}, 0)
+
+	s := q.stats()
+	if s.Queued != 4 || s.Priority != 1 || s.Targets["#spam"] != 2 || s.Targets["#other"] != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	if n := len(q.cancel("#SPAM")); n != 2 {
+		t.Errorf("expect 2 canceled, got %d", n)
+	}
+	if s := q.stats(); s.Queued != 2 || s.Canceled != 2 {
+		t.Errorf("unexpected stats after cancel %+v", s)
+	}
+
+	idle := q.whenIdle()
+	for _, expect := range []string{"PONG x", "PRIVMSG #other :a"} {
+		o := q.pop()
+		if o == nil || o.m.String() != expect {
+			t.Fatalf("expect %q, got %v", expect, o)
+		}
+		select {
+		case <-idle:
+			t.Fatal("idle before queue drained")
+		default:
+		}
+		q.finish()
+	}
+	<-idle
+}
+
+func TestSendQueueMax(t *testing.T) {
+	q := newSendQueue()
+	for i := 0; i < 2; i++ {
+		if !q.push(privmsg("#spam", "x"), 2) {
+			t.Fatalf("message %d refused under limit", i)
+		}
+	}
+	if q.push(privmsg("#spam", "x"), 2) {
+		t.Error("message accepted over limit")
+	}
+	if !q.push(privmsg("#other", "x"), 2) {
+		t.Error("limit applied across targets")
+	}
+	if !q.push(&outgoing{d: newDelivery(), m: &Message{Command: "PONG", Params: []string{"x"}}}, 2) {
+		t.Error("limit applied to protocol traffic")
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A Dialect describes how a services package words the commands the client
+// sends and the notices it replies with. Patterns are matched against the
+// text of notices with formatting stripped; a nil pattern never matches.
+type Dialect struct {
+	Name string
+
+	// Regain is the NickServ command that disconnects whoever holds a nick
+	// and changes the client's nick to it.
+	Regain string
+
+	Identified    *regexp.Regexp // IDENTIFY succeeded
+	BadPassword   *regexp.Regexp // IDENTIFY, GHOST or Regain refused
+	NotRegistered *regexp.Regexp // no such nick or channel registered
+	Info          *regexp.Regexp // the start of INFO on a registered nick
+	Ghosted       *regexp.Regexp // GHOST succeeded
+	Regained      *regexp.Regexp // Regain succeeded
+	Opped         *regexp.Regexp // ChanServ OP succeeded
+	Invited       *regexp.Regexp // ChanServ INVITE succeeded
+	Unbanned      *regexp.Regexp // ChanServ UNBAN succeeded
+	Denied        *regexp.Regexp // any command refused for lack of access
+}
+
+// Atheme is the dialect of Atheme IRC Services, run by Libera.Chat, OFTC's
+// neighbours and most charybdis and solanum networks.
+var Atheme = &Dialect{
+	Name:          "atheme",
+	Regain:        "REGAIN",
+	Identified:    regexp.MustCompile(`(?i)^You are (now identified|already logged in) `),
+	BadPassword:   regexp.MustCompile(`(?i)^Invalid password for `),
+	NotRegistered: regexp.MustCompile(`(?i) is not (a )?registered( nickname| channel)?\.$`),
+	Info:          regexp.MustCompile(`(?i)^Information on `),
+	Ghosted:       regexp.MustCompile(`(?i) has been ghosted\.$`),
+	Regained:      regexp.MustCompile(`(?i) has been regained\.$`),
+	Opped:         regexp.MustCompile(`(?i) has been opped on `),
+	Invited:       regexp.MustCompile(`(?i)^You have been invited to `),
+	Unbanned:      regexp.MustCompile(`(?i)^(Unbanned |No bans found matching )`),
+	Denied:        regexp.MustCompile(`(?i)^(You are not (authorized|logged in)|Insufficient privileges|You may not )|is not online\.$`),
+}
+
+// Anope is the dialect of Anope IRC Services 2.0.
+var Anope = &Dialect{
+	Name:          "anope",
+	Regain:        "RECOVER",
+	Identified:    regexp.MustCompile(`(?i)^(Password accepted|You are already identified)`),
+	BadPassword:   regexp.MustCompile(`(?i)^(Password incorrect|Invalid password)`),
+	NotRegistered: regexp.MustCompile(`(?i) isn't registered\.$`),
+	Info:          regexp.MustCompile(`(?i)^\s*(Time )?registered\s*:`),
+	Ghosted:       regexp.MustCompile(`(?i)^Ghost with your nick has been killed`),
+	Regained:      regexp.MustCompile(`(?i)^You have regained control of `),
+	Opped:         nil, // the MODE is the only reply
+	Invited:       regexp.MustCompile(`(?i)( has been|^You have been) invited to `),
+	Unbanned:      regexp.MustCompile(`(?i)( has been|^You have been) unbanned from `),
+	Denied:        regexp.MustCompile(`(?i)^(Access denied|Permission denied|Password authentication required|You must )|is not currently online\.$`),
+}
+
+// Dialects are the known dialects by name.
+var Dialects = map[string]*Dialect{
+	Atheme.Name: Atheme,
+	Anope.Name:  Anope,
+}
+
+func match(re *regexp.Regexp, text string) bool {
+	return re != nil && re.MatchString(text)
+}
+
+// stripFormatting removes mIRC formatting codes from s: bold, italics,
+// underline, strikethrough, monospace, reverse, reset and colours.
+func stripFormatting(s string) string {
+	if !strings.ContainsAny(s, "\x02\x03\x04\x0f\x11\x16\x1d\x1e\x1f") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\x02', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		case '\x03':
+			// \x03[fg[,bg]], each one or two digits
+			i += digits(s[i+1:], 2)
+			if i+2 < len(s) && s[i+1] == ',' && digits(s[i+2:], 1) > 0 {
+				i += 1 + digits(s[i+2:], 2)
+			}
+		case '\x04':
+			// \x04[rrggbb[,rrggbb]]
+			i += hex(s[i+1:])
+			if i+2 < len(s) && s[i+1] == ',' && hex(s[i+2:]) > 0 {
+				i += 1 + hex(s[i+2:])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// digits returns how many of the first max bytes of s are decimal digits.
+func digits(s string, max int) int {
+	n := 0
+	for n < len(s) && n < max && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// hex returns 6 if s starts with six hex digits, or 0.
+func hex(s string) int {
+	if len(s) < 6 {
+		return 0
+	}
+	for i := 0; i < 6; i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return 0
+		}
+	}
+	return 6
+}
@@ -0,0 +1,496 @@
+// Package services talks to a network's NickServ and ChanServ on behalf of
+// an irc.Client. It sends the commands common to Atheme and Anope and reads
+// the outcome from the NOTICEs they reply with, as described by a Dialect,
+// so that a client can identify, reclaim its nick, and ask for ops, invites
+// and unbans, and wait until it is identified before joining channels.
+package services
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"ktkr.us/pkg/irc"
+)
+
+// DefaultTimeout is how long the client waits for NickServ to confirm the
+// IDENTIFY sent on connecting when Services.Timeout is zero.
+const DefaultTimeout = 30 * time.Second
+
+var (
+	// ErrDenied is returned, wrapped with the services' reply, when a
+	// command is refused for lack of access.
+	ErrDenied = errors.New("services: access denied")
+
+	// ErrBadPassword is returned when NickServ refuses the password.
+	ErrBadPassword = errors.New("services: invalid password")
+
+	// ErrNotRegistered is returned when the nick or channel a command names
+	// isn't registered.
+	ErrNotRegistered = errors.New("services: not registered")
+
+	// ErrNotIdentified is passed to OnIdentified hooks when there's no
+	// Password to identify with and the client didn't log in with SASL.
+	ErrNotIdentified = errors.New("services: not identified")
+
+	// ErrNoReply is passed to OnIdentified hooks when NickServ doesn't
+	// answer IDENTIFY within the Timeout.
+	ErrNoReply = errors.New("services: no reply")
+)
+
+// Services sends commands to NickServ and ChanServ for a Client and matches
+// up their replies. Its fields must not be changed once the client has
+// connected.
+//
+// Methods that wait for a reply, which take a context, must not be called
+// from a Handler, since the reply is read by the goroutine running
+// handlers.
+type Services struct {
+	Client  *irc.Client
+	Dialect *Dialect
+
+	// NickServ and ChanServ are the nicks of the services. If empty,
+	// "NickServ" and "ChanServ" are used.
+	NickServ string
+	ChanServ string
+
+	// Account and Password are sent with IDENTIFY as soon as the client is
+	// registered. If Account is empty, NickServ identifies the client to
+	// the account of its current nick.
+	Account  string
+	Password string
+
+	// Timeout bounds how long OnIdentified hooks wait for NickServ to
+	// confirm the IDENTIFY sent on connecting. If zero, DefaultTimeout is
+	// used.
+	Timeout time.Duration
+
+	mu         sync.Mutex
+	pending    []*request
+	hooks      []func(c *irc.Client, err error)
+	registered bool // 001 has been received on this connection
+	sasl       bool // logged in before 001, with SASL
+	identified bool
+}
+
+// New returns Services for c speaking dialect d, with handlers added to c
+// to read the replies. It must be called before c connects.
+func New(c *irc.Client, d *Dialect) *Services {
+	s := &Services{Client: c, Dialect: d}
+	for _, cmd := range []string{"NOTICE", "MODE", "INVITE", "900"} {
+		c.HandleFunc(cmd, s.handle)
+	}
+	c.HandleFunc("CAP", s.handleCap)
+	c.HandleFunc("901", s.handleLoggedOut)
+	c.HandleFunc("001", s.handleWelcome)
+	return s
+}
+
+func (s *Services) nickServ() string {
+	if s.NickServ != "" {
+		return s.NickServ
+	}
+	return "NickServ"
+}
+
+func (s *Services) chanServ() string {
+	if s.ChanServ != "" {
+		return s.ChanServ
+	}
+	return "ChanServ"
+}
+
+func (s *Services) timeout() time.Duration {
+	if s.Timeout != 0 {
+		return s.Timeout
+	}
+	return DefaultTimeout
+}
+
+// Identified reports whether the client is known to be identified to an
+// account on this connection, through SASL, IDENTIFY or RPL_LOGGEDIN.
+func (s *Services) Identified() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.identified
+}
+
+// OnIdentified adds a hook to run each time the client has registered and
+// then identified with Password, or failed to. It is passed nil once
+// NickServ confirms the IDENTIFY, or at once if the client logged in with
+// SASL while registering, so it is the place to join channels that require
+// an account. Otherwise err says why not: ErrBadPassword, ErrNoReply if
+// NickServ didn't answer within the Timeout, or ErrNotIdentified if there
+// was no Password. Hooks run on the goroutine running handlers, or on one
+// of their own after a timeout.
+func (s *Services) OnIdentified(f func(c *irc.Client, err error)) {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, f)
+	s.mu.Unlock()
+}
+
+// Identify identifies the client with Account and Password, and waits for
+// NickServ to confirm it.
+func (s *Services) Identify(ctx context.Context) error {
+	req := s.identify(nil)
+	s.sendIdentify(req)
+	return s.wait(ctx, req)
+}
+
+// Ghost has NickServ disconnect whoever is using nick, which must be
+// registered to Account, and waits for it to confirm.
+func (s *Services) Ghost(ctx context.Context, nick string) error {
+	req := s.nickServRequest(s.reply(s.Dialect.Ghosted), "GHOST", nick, s.Password)
+	return s.wait(ctx, req)
+}
+
+// Regain has NickServ disconnect whoever is using nick and change the
+// client's nick to it, with Dialect.Regain, and waits for it to confirm.
+func (s *Services) Regain(ctx context.Context, nick string) error {
+	req := s.nickServRequest(s.reply(s.Dialect.Regained), s.Dialect.Regain, nick, s.Password)
+	return s.wait(ctx, req)
+}
+
+// Reclaim asks NickServ to regain nick without waiting for a reply. It can
+// be used as Client.Reclaim:
+//
+//	c.Reclaim = s.Reclaim
+func (s *Services) Reclaim(c *irc.Client, nick string) {
+	if s.Password == "" {
+		return
+	}
+	c.PRIVMSG(s.nickServ(), strings.Join([]string{s.Dialect.Regain, nick, s.Password}, " "))
+}
+
+// JoinRefused asks ChanServ to let the client into a channel that refused
+// it, without waiting for a reply: to unban it if it's banned, otherwise to
+// invite it, which gets it past a limit, +i or a key. It does nothing unless
+// the client is identified. It can be used as Client.JoinRefused:
+//
+//	c.JoinRefused = s.JoinRefused
+func (s *Services) JoinRefused(c *irc.Client, err *irc.JoinError) {
+	if !s.Identified() {
+		return
+	}
+	cmd := "INVITE"
+	if err.Code == "474" {
+		cmd = "UNBAN"
+	}
+	c.PRIVMSG(s.chanServ(), cmd+" "+err.Channel)
+}
+
+// IsRegistered asks NickServ whether nick is registered.
+func (s *Services) IsRegistered(ctx context.Context, nick string) (bool, error) {
+	var registered bool
+	info := s.reply(s.Dialect.Info)
+	req := s.nickServRequest(func(m *irc.Message, text string) (bool, error) {
+		done, err := info(m, text)
+		if errors.Is(err, ErrNotRegistered) {
+			return true, nil
+		}
+		registered = done && err == nil
+		return done, err
+	}, "INFO", nick)
+	if err := s.wait(ctx, req); err != nil {
+		return false, err
+	}
+	return registered, nil
+}
+
+// Op asks ChanServ to give nick ops on channel, and waits until it does.
+func (s *Services) Op(ctx context.Context, channel, nick string) error {
+	opped := s.reply(s.Dialect.Opped)
+	req := s.chanServRequest(func(m *irc.Message, text string) (bool, error) {
+		if m.Command == "MODE" {
+			return strings.EqualFold(m.Param(0), channel) && gives(m, 'o', nick), nil
+		}
+		return opped(m, text)
+	}, "OP", channel, nick)
+	return s.wait(ctx, req)
+}
+
+// Invite asks ChanServ to invite the client to channel, and waits until it
+// does.
+func (s *Services) Invite(ctx context.Context, channel string) error {
+	invited := s.reply(s.Dialect.Invited)
+	req := s.chanServRequest(func(m *irc.Message, text string) (bool, error) {
+		if m.Command == "INVITE" {
+			return strings.EqualFold(m.Param(1), channel), nil
+		}
+		return invited(m, text)
+	}, "INVITE", channel)
+	return s.wait(ctx, req)
+}
+
+// Unban asks ChanServ to lift the bans matching the client on channel, and
+// waits until it has.
+func (s *Services) Unban(ctx context.Context, channel string) error {
+	req := s.chanServRequest(s.reply(s.Dialect.Unbanned), "UNBAN", channel)
+	return s.wait(ctx, req)
+}
+
+// identify returns a request for IDENTIFY, which calls then with the
+// outcome if it isn't nil.
+func (s *Services) identify(then func(error)) *request {
+	identified := s.reply(s.Dialect.Identified)
+	match := func(m *irc.Message, text string) (bool, error) {
+		if m.Command == "900" {
+			return true, nil
+		}
+		return identified(m, text)
+	}
+	return newRequest(s.nickServ(), match, then)
+}
+
+// sendIdentify sends the IDENTIFY req is waiting for the reply to.
+func (s *Services) sendIdentify(req *request) {
+	args := []string{"IDENTIFY", s.Password}
+	if s.Account != "" {
+		args = []string{"IDENTIFY", s.Account, s.Password}
+	}
+	s.send(req, s.nickServ(), args)
+}
+
+func (s *Services) nickServRequest(match matcher, args ...string) *request {
+	req := newRequest(s.nickServ(), match, nil)
+	s.send(req, s.nickServ(), args)
+	return req
+}
+
+func (s *Services) chanServRequest(match matcher, args ...string) *request {
+	req := newRequest(s.chanServ(), match, nil)
+	s.send(req, s.chanServ(), args)
+	return req
+}
+
+// send starts waiting for the reply to req, then sends args to service.
+func (s *Services) send(req *request, service string, args []string) {
+	s.mu.Lock()
+	s.pending = append(s.pending, req)
+	s.mu.Unlock()
+
+	d := s.Client.PRIVMSG(service, strings.Join(args, " "))
+	go func() {
+		// one that's never sent will never be answered
+		if err := d.Err(); err != nil {
+			s.finish(req, err)
+		}
+	}()
+}
+
+// wait waits for the reply to req.
+func (s *Services) wait(ctx context.Context, req *request) error {
+	select {
+	case <-req.done:
+		return req.err
+	case <-ctx.Done():
+		// a reply that comes later is taken by the next request, if any
+		s.finish(req, ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// finish completes req with err if it is still pending.
+func (s *Services) finish(req *request, err error) {
+	s.mu.Lock()
+	for i, r := range s.pending {
+		if r == req {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	req.complete(err)
+}
+
+// handle offers m to the pending requests, oldest first, until one takes
+// it. NOTICEs are only offered to requests sent to the service they came
+// from.
+func (s *Services) handle(c *irc.Client, m *irc.Message) {
+	if m.Command == "900" {
+		s.mu.Lock()
+		s.identified = true
+		if !s.registered {
+			s.sasl = true
+		}
+		s.mu.Unlock()
+	}
+
+	var from, text string
+	if m.Command == "NOTICE" {
+		if m.From == nil || !strings.EqualFold(m.Param(0), c.CurrentNick()) {
+			return
+		}
+		from = m.From.Nick
+		text = stripFormatting(m.LastParam())
+	}
+
+	s.mu.Lock()
+	if strings.EqualFold(from, s.nickServ()) && match(s.Dialect.Identified, text) {
+		s.identified = true
+	}
+	var (
+		req *request
+		err error
+	)
+	for i, r := range s.pending {
+		if from != "" && !strings.EqualFold(from, r.service) {
+			continue
+		}
+		var done bool
+		if done, err = r.match(m, text); done {
+			req = r
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if req != nil {
+		if err != nil {
+			err = errors.Wrapf(err, "%s: %s", req.service, text)
+		}
+		req.complete(err)
+	}
+}
+
+// handleCap notes the start of a connection, which is the reply to CAP LS
+// that the client sends first. Where the server supports CAP at all, SASL
+// can log the client in before RPL_WELCOME.
+func (s *Services) handleCap(c *irc.Client, m *irc.Message) {
+	if m.Param(1) != "LS" {
+		return
+	}
+	s.mu.Lock()
+	s.registered = false
+	s.sasl = false
+	s.identified = false
+	s.mu.Unlock()
+}
+
+// handleLoggedOut handles RPL_LOGGEDOUT (901).
+func (s *Services) handleLoggedOut(c *irc.Client, m *irc.Message) {
+	s.mu.Lock()
+	s.identified = false
+	s.mu.Unlock()
+}
+
+// handleWelcome identifies the client once it has registered, and runs the
+// OnIdentified hooks with the outcome.
+func (s *Services) handleWelcome(c *irc.Client, m *irc.Message) {
+	s.mu.Lock()
+	sasl := s.sasl
+	s.registered = true
+	s.sasl = false
+	s.identified = sasl
+	hooks := slices.Clone(s.hooks)
+	s.mu.Unlock()
+
+	run := func(err error) {
+		for _, f := range hooks {
+			f(c, err)
+		}
+	}
+	switch {
+	case sasl:
+		run(nil)
+	case s.Password == "":
+		run(ErrNotIdentified)
+	default:
+		stop := make(chan struct{})
+		req := s.identify(func(err error) {
+			close(stop)
+			run(err)
+		})
+		timer := time.AfterFunc(s.timeout(), func() {
+			s.finish(req, ErrNoReply)
+		})
+		go func() {
+			<-stop
+			timer.Stop()
+		}()
+		s.sendIdentify(req)
+	}
+}
+
+// gives reports whether the MODE m sets mode on nick. Modes that take a
+// param are told apart by having one left for them, which is enough for
+// the prefix modes services set.
+func gives(m *irc.Message, mode byte, nick string) bool {
+	adding := true
+	all := m.AllParams()
+	args := all[min(2, len(all)):]
+	for _, ch := range []byte(m.Param(1)) {
+		switch ch {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		default:
+			if len(args) == 0 {
+				return false
+			}
+			if adding && ch == mode && strings.EqualFold(args[0], nick) {
+				return true
+			}
+			args = args[1:]
+		}
+	}
+	return false
+}
+
+// A matcher reports whether m is the reply to a request, and if so whether
+// it failed. text is the NOTICE text with formatting stripped, or empty
+// for other commands.
+type matcher func(m *irc.Message, text string) (done bool, err error)
+
+// reply returns a matcher for NOTICEs that succeed with ok, or fail for one
+// of the reasons every command may.
+func (s *Services) reply(ok *regexp.Regexp) matcher {
+	d := s.Dialect
+	return func(m *irc.Message, text string) (bool, error) {
+		switch {
+		case m.Command != "NOTICE":
+			return false, nil
+		case match(ok, text):
+			return true, nil
+		case match(d.BadPassword, text):
+			return true, ErrBadPassword
+		case match(d.NotRegistered, text):
+			return true, ErrNotRegistered
+		case match(d.Denied, text):
+			return true, ErrDenied
+		}
+		return false, nil
+	}
+}
+
+// A request is a command sent to services, awaiting its reply.
+type request struct {
+	service string
+	match   matcher
+	then    func(error)
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newRequest(service string, match matcher, then func(error)) *request {
+	return &request{service: service, match: match, then: then, done: make(chan struct{})}
+}
+
+func (r *request) complete(err error) {
+	r.once.Do(func() {
+		r.err = err
+		close(r.done)
+		if r.then != nil {
+			r.then(err)
+		}
+	})
+}
@@ -0,0 +1,236 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"ktkr.us/pkg/irc"
+	"ktkr.us/pkg/irc/irctest"
+)
+
+func connect(t *testing.T, c *irc.Client) *irctest.Conn {
+	t.Helper()
+	s := irctest.NewServer(t)
+	c.Dialer = s
+	c.RegainInterval = -1
+	c.Flood = &irc.FloodProfile{Window: time.Hour}
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return s.Accept()
+}
+
+func identified(t *testing.T, s *Services) <-chan error {
+	ch := make(chan error, 1)
+	s.OnIdentified(func(c *irc.Client, err error) {
+		ch <- err
+	})
+	return ch
+}
+
+func expectIdentified(t *testing.T, ch <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("OnIdentified hooks never ran")
+		return nil
+	}
+}
+
+func TestOnIdentified(t *testing.T) {
+	c := &irc.Client{Nick: "bot", User: "bot"}
+	s := New(c, Atheme)
+	s.Account, s.Password = "botacct", "hunter2"
+	ch := identified(t, s)
+
+	conn := connect(t, c)
+	conn.Register()
+	conn.ExpectLine("PRIVMSG NickServ :IDENTIFY botacct hunter2")
+	if s.Identified() {
+		t.Error("expect not identified before NickServ confirms")
+	}
+	conn.Send(":NickServ!NickServ@services. NOTICE bot :You are now identified for \x02botacct\x02.")
+	if err := expectIdentified(t, ch); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Identified() {
+		t.Error("expect identified")
+	}
+}
+
+func TestOnIdentifiedFailure(t *testing.T) {
+	c := &irc.Client{Nick: "bot", User: "bot"}
+	s := New(c, Anope)
+	s.Password = "wrong"
+	s.Timeout = 50 * time.Millisecond
+	ch := identified(t, s)
+
+	conn := connect(t, c)
+	conn.Register()
+	conn.ExpectLine("PRIVMSG NickServ :IDENTIFY wrong")
+	conn.Send(":NickServ!service@services. NOTICE bot :Password incorrect.")
+	if err := expectIdentified(t, ch); !errors.Is(err, ErrBadPassword) {
+		t.Errorf("expect ErrBadPassword, got %v", err)
+	}
+
+	// on reconnecting, NickServ doesn't answer in time
+	conn.Close()
+	c.Close()
+	conn = connect(t, c)
+	conn.Register()
+	conn.ExpectLine("PRIVMSG NickServ :IDENTIFY wrong")
+	if err := expectIdentified(t, ch); err != ErrNoReply {
+		t.Errorf("expect ErrNoReply, got %v", err)
+	}
+}
+
+func TestOnIdentifiedSASL(t *testing.T) {
+	c := &irc.Client{Nick: "bot", User: "bot"}
+	s := New(c, Atheme)
+	s.Password = "hunter2"
+	ch := identified(t, s)
+
+	conn := connect(t, c)
+	conn.ExpectEventually("USER")
+	conn.Nick, conn.User = "bot", "bot"
+	conn.Send(":irc.test CAP * LS :sasl")
+	conn.Reply("900", "bot!bot@127.0.0.1", "bot", "You are now logged in as bot")
+	conn.Welcome()
+	if err := expectIdentified(t, ch); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Identified() {
+		t.Error("expect identified")
+	}
+	for _, m := range conn.Sent() {
+		if m.Command == "PRIVMSG" {
+			t.Errorf("expect no IDENTIFY after SASL, got %q", m)
+		}
+	}
+}
+
+func TestOnIdentifiedNoPassword(t *testing.T) {
+	c := &irc.Client{Nick: "bot", User: "bot"}
+	ch := identified(t, New(c, Atheme))
+	conn := connect(t, c)
+	conn.Register()
+	if err := expectIdentified(t, ch); err != ErrNotIdentified {
+		t.Errorf("expect ErrNotIdentified, got %v", err)
+	}
+}
+
+func TestChanServ(t *testing.T) {
+	c := &irc.Client{Nick: "bot", User: "bot"}
+	s := New(c, Anope)
+	conn := connect(t, c)
+	conn.Register()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	errs := make(chan error, 1)
+
+	go func() { errs <- s.Op(ctx, "#chan", "bot") }()
+	conn.ExpectLine("PRIVMSG ChanServ :OP #chan bot")
+	conn.Send(":ChanServ!service@services. MODE #chan +vo someone bot")
+	if err := <-errs; err != nil {
+		t.Errorf("Op: %v", err)
+	}
+
+	// the nick may come as the trailing param
+	go func() { errs <- s.Op(ctx, "#other", "bot") }()
+	conn.ExpectLine("PRIVMSG ChanServ :OP #other bot")
+	conn.Send(":ChanServ!service@services. MODE #other +o :bot")
+	if err := <-errs; err != nil {
+		t.Errorf("Op with trailing nick: %v", err)
+	}
+
+	go func() { errs <- s.Invite(ctx, "#secret") }()
+	conn.ExpectLine("PRIVMSG ChanServ :INVITE #secret")
+	conn.Send(":ChanServ!service@services. INVITE bot :#secret")
+	if err := <-errs; err != nil {
+		t.Errorf("Invite: %v", err)
+	}
+
+	go func() { errs <- s.Unban(ctx, "#chan") }()
+	conn.ExpectLine("PRIVMSG ChanServ :UNBAN #chan")
+	// a notice from someone else isn't the reply
+	conn.Send(":someone!a@b NOTICE bot :Access denied.")
+	conn.Send(":ChanServ!service@services. NOTICE bot :Access denied.")
+	if err := <-errs; !errors.Is(err, ErrDenied) {
+		t.Errorf("Unban: expect ErrDenied, got %v", err)
+	}
+}
+
+func TestJoinRefused(t *testing.T) {
+	c := &irc.Client{Nick: "bot", User: "bot", JoinRetry: time.Hour}
+	s := New(c, Atheme)
+	s.Password = "hunter2"
+	c.JoinRefused = s.JoinRefused
+	c.DeferJoin = true
+	c.AddChannel("#banned", "")
+	c.AddChannel("#secret", "")
+	s.OnIdentified(func(c *irc.Client, err error) {
+		c.JoinChannels()
+	})
+
+	conn := connect(t, c)
+	conn.Register()
+	conn.ExpectLine("PRIVMSG NickServ :IDENTIFY hunter2")
+	conn.Send(":NickServ!NickServ@services. NOTICE bot :You are now identified for \x02bot\x02.")
+	conn.ExpectLine("JOIN #banned,#secret")
+	conn.Reply("474", "#banned", "Cannot join channel (+b)")
+	conn.ExpectLine("PRIVMSG ChanServ :UNBAN #banned")
+	conn.Reply("473", "#secret", "Cannot join channel (+i)")
+	conn.ExpectLine("PRIVMSG ChanServ :INVITE #secret")
+}
+
+func TestIsRegistered(t *testing.T) {
+	c := &irc.Client{Nick: "bot", User: "bot"}
+	s := New(c, Atheme)
+	conn := connect(t, c)
+	conn.Register()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	type result struct {
+		ok  bool
+		err error
+	}
+	results := make(chan result, 1)
+	for _, test := range []struct {
+		nick, reply string
+		exp         bool
+	}{
+		{"alice", "Information on \x02alice\x02 (account \x02alice\x02):", true},
+		{"nobody", "\x02nobody\x02 is not registered.", false},
+	} {
+		go func() {
+			ok, err := s.IsRegistered(ctx, test.nick)
+			results <- result{ok, err}
+		}()
+		conn.ExpectLine("PRIVMSG NickServ :INFO " + test.nick)
+		conn.Send(":NickServ!NickServ@services. NOTICE bot :" + test.reply)
+		if r := <-results; r.err != nil || r.ok != test.exp {
+			t.Errorf("IsRegistered(%s): expect %v, got %v, %v", test.nick, test.exp, r.ok, r.err)
+		}
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	for _, test := range []struct{ in, exp string }{
+		{"plain", "plain"},
+		{"\x02bold\x02 \x1ditalic\x1d\x0f", "bold italic"},
+		{"\x0304red\x03 \x034,12both\x03 \x03,not", "red both ,not"},
+		{"\x04ff0000hex\x04", "hex"},
+		{"\x0312", ""},
+	} {
+		if s := stripFormatting(test.in); s != test.exp {
+			t.Errorf("stripFormatting(%q): expect %q, got %q", test.in, test.exp, s)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package irc
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoMute is returned by ModeScheduler.Mute when the server offers no way
+// to mute a mask: neither a quiet list mode nor a mute extban.
+var ErrNoMute = errors.New("irc: server has no mute mode")
+
+// A TimedMode is a mode change to be undone at a set time.
+type TimedMode struct {
+	Channel string
+	Revert  ModeChange // the change that undoes it
+	At      time.Time
+}
+
+func (tm TimedMode) key() string {
+	return strings.ToLower(tm.Channel) + " " + tm.Revert.String()
+}
+
+// A ModeStore keeps the mode changes a ModeScheduler has yet to undo, so
+// that they are undone even if the program restarts in the meantime.
+type ModeStore interface {
+	// Load returns the changes saved last.
+	Load() ([]TimedMode, error)
+
+	// Save replaces the saved changes with pending.
+	Save(pending []TimedMode) error
+}
+
+// FileModeStore is a ModeStore that keeps the changes in a JSON file. A file
+// that doesn't exist holds none.
+type FileModeStore struct {
+	Path string
+}
+
+func (s FileModeStore) Load() ([]TimedMode, error) {
+	b, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "irc: loading timed modes")
+	}
+	var pending []TimedMode
+	if err := json.Unmarshal(b, &pending); err != nil {
+		return nil, errors.Wrap(err, "irc: loading timed modes")
+	}
+	return pending, nil
+}
+
+func (s FileModeStore) Save(pending []TimedMode) error {
+	b, err := json.MarshalIndent(pending, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "irc: saving timed modes")
+	}
+	// write and rename, so that a crash leaves the old file or the new
+	f, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "irc: saving timed modes")
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return errors.Wrap(err, "irc: saving timed modes")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "irc: saving timed modes")
+	}
+	return errors.Wrap(os.Rename(f.Name(), s.Path), "irc: saving timed modes")
+}
+
+// A ModeScheduler makes mode changes that undo themselves after a while,
+// such as timed bans. The changes still to be undone are kept in a
+// ModeStore. One that falls due while the client is disconnected, or while
+// the program isn't running, is undone once the client has registered.
+type ModeScheduler struct {
+	c     *Client
+	store ModeStore
+
+	mu      sync.Mutex
+	pending map[string]*timedMode // by TimedMode.key
+	ready   bool                  // the client has registered
+	stopped bool
+}
+
+// timedMode is a TimedMode waiting to fall due.
+type timedMode struct {
+	TimedMode
+	timer    *time.Timer
+	reverted bool // the undoing change has been sent
+}
+
+// NewModeScheduler returns a ModeScheduler making changes on c, which
+// picks up where the last one with the same store left off. It adds
+// handlers to c, so it must be called before c connects.
+func NewModeScheduler(c *Client, store ModeStore) (*ModeScheduler, error) {
+	saved, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	s := &ModeScheduler{c: c, store: store, pending: make(map[string]*timedMode)}
+	s.mu.Lock()
+	for _, tm := range saved {
+		s.schedule(tm)
+	}
+	s.mu.Unlock()
+	c.HandleFunc("376", s.handleRegistered)
+	c.HandleFunc("422", s.handleRegistered)
+	return s, nil
+}
+
+// Apply makes change on channel now, and undoes it after d. Applying a
+// change that is already pending pushes back when it's undone. The client
+// must be connected. The error is from saving to the store; the change is
+// made and scheduled regardless.
+func (s *ModeScheduler) Apply(channel string, change ModeChange, d time.Duration) error {
+	revert := change
+	revert.Add = !change.Add
+	tm := TimedMode{Channel: channel, Revert: revert, At: time.Now().Add(d)}
+
+	s.mu.Lock()
+	s.schedule(tm)
+	err := s.save()
+	s.mu.Unlock()
+
+	s.c.Modes(channel).Change(change).Send()
+	return err
+}
+
+// Ban bans mask from channel for d.
+func (s *ModeScheduler) Ban(channel, mask string, d time.Duration) error {
+	return s.Apply(channel, ModeChange{Add: true, Mode: s.c.listMode(BanList), Param: mask}, d)
+}
+
+// Mute stops mask speaking in channel for d, with the server's quiet list
+// mode if it has one, as charybdis and solanum do, or else with a mute
+// extban, as InspIRCd and UnrealIRCd do.
+func (s *ModeScheduler) Mute(channel, mask string, d time.Duration) error {
+	change, ok := s.c.muteChange(mask)
+	if !ok {
+		return ErrNoMute
+	}
+	return s.Apply(channel, change, d)
+}
+
+// Cancel forgets a pending change without undoing it, reporting whether it
+// was pending.
+func (s *ModeScheduler) Cancel(channel string, revert ModeChange) (bool, error) {
+	key := TimedMode{Channel: channel, Revert: revert}.key()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tm, ok := s.pending[key]
+	if !ok {
+		return false, nil
+	}
+	tm.timer.Stop()
+	delete(s.pending, key)
+	return true, s.save()
+}
+
+// Pending returns the changes yet to be undone, soonest first.
+func (s *ModeScheduler) Pending() []TimedMode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list()
+}
+
+// Stop stops undoing changes. Those pending stay in the store for the next
+// ModeScheduler.
+func (s *ModeScheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for _, tm := range s.pending {
+		tm.timer.Stop()
+	}
+}
+
+// schedule adds tm, replacing any pending change with the same revert.
+// s.mu must be held.
+func (s *ModeScheduler) schedule(tm TimedMode) {
+	key := tm.key()
+	if old, ok := s.pending[key]; ok {
+		old.timer.Stop()
+	}
+	t := &timedMode{TimedMode: tm}
+	t.timer = time.AfterFunc(time.Until(tm.At), func() {
+		s.revert(key, t)
+	})
+	s.pending[key] = t
+}
+
+// revert undoes t, if it's still pending, and forgets it once the undoing
+// change has been written. If it can't be, say because the client is
+// disconnected, it's tried again once the client has registered.
+func (s *ModeScheduler) revert(key string, t *timedMode) {
+	s.mu.Lock()
+	if !s.ready || s.stopped || s.pending[key] != t || t.reverted {
+		s.mu.Unlock()
+		return
+	}
+	t.reverted = true
+	s.mu.Unlock()
+
+	ds := s.c.Modes(t.Channel).Change(t.Revert).Send()
+	go func() {
+		err := ds[0].Err()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.pending[key] != t {
+			return
+		}
+		if err != nil {
+			t.reverted = false
+			return
+		}
+		delete(s.pending, key)
+		if err := s.save(); err != nil {
+			s.c.logger().Warn("irc: saving timed modes", errAttr(err))
+		}
+	}()
+}
+
+// handleRegistered undoes the changes that fell due while the client was
+// disconnected.
+func (s *ModeScheduler) handleRegistered(c *Client, m *Message) {
+	s.mu.Lock()
+	s.ready = true
+	var due []*timedMode
+	now := time.Now()
+	for _, t := range s.pending {
+		if !t.reverted && !t.At.After(now) {
+			due = append(due, t)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, t := range due {
+		s.revert(t.key(), t)
+	}
+}
+
+// list returns the pending changes, soonest first. s.mu must be held.
+func (s *ModeScheduler) list() []TimedMode {
+	pending := make([]TimedMode, 0, len(s.pending))
+	for _, t := range s.pending {
+		pending = append(pending, t.TimedMode)
+	}
+	sort.Slice(pending, func(i, k int) bool {
+		if pending[i].At.Equal(pending[k].At) {
+			return pending[i].key() < pending[k].key()
+		}
+		return pending[i].At.Before(pending[k].At)
+	})
+	return pending
+}
+
+// save stores the pending changes. s.mu must be held.
+func (s *ModeScheduler) save() error {
+	return s.store.Save(s.list())
+}
+
+// muteChange returns the change that mutes mask on this server.
+func (c *Client) muteChange(mask string) (ModeChange, bool) {
+	chanmodes, _ := c.ISupport("CHANMODES")
+	lists, _, _ := strings.Cut(chanmodes, ",")
+	prefix, _ := c.ISupport("PREFIX")
+	if modes, _, _ := strings.Cut(strings.TrimPrefix(prefix, "("), ")"); strings.Contains(lists, "q") && !strings.Contains(modes, "q") {
+		return ModeChange{Add: true, Mode: 'q', Param: mask}, true
+	}
+
+	// EXTBAN=[<prefix>],<types>
+	extban, ok := c.ISupport("EXTBAN")
+	if !ok {
+		return ModeChange{}, false
+	}
+	marker, types, _ := strings.Cut(extban, ",")
+	switch {
+	case strings.Contains(types, "q"):
+		// UnrealIRCd
+		return ModeChange{Add: true, Mode: 'b', Param: marker + "q:" + mask}, true
+	case strings.Contains(types, "m"):
+		// InspIRCd
+		return ModeChange{Add: true, Mode: 'b', Param: marker + "m:" + mask}, true
+	}
+	return ModeChange{}, false
+}
@@ -0,0 +1,142 @@
+package irc
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memModeStore is a ModeStore in memory.
+type memModeStore struct {
+	mu      sync.Mutex
+	pending []TimedMode
+}
+
+func (s *memModeStore) Load() ([]TimedMode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending, nil
+}
+
+func (s *memModeStore) Save(pending []TimedMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = pending
+	return nil
+}
+
+// waitSaved waits until the store holds n changes.
+func (s *memModeStore) waitSaved(t *testing.T, n int) []TimedMode {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; {
+		pending, _ := s.Load()
+		if len(pending) == n {
+			return pending
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d changes saved, got %+v", n, pending)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestModeScheduler(t *testing.T) {
+	c := new(Client)
+	store := new(memModeStore)
+	s, err := NewModeScheduler(c, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	server, r := registerJoins(t, c, "CHANMODES=beIq,k,l,imnt PREFIX=(ov)@+")
+	syncHandlers(t, server, r)
+
+	if err := s.Ban("#chan", "*!*@bad.example.com", 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Mute("#chan", "*!*@loud.example.com", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, exp := range []string{"MODE #chan +b *!*@bad.example.com", "MODE #chan +q *!*@loud.example.com"} {
+		if m := readMessage(t, r); m.String() != exp {
+			t.Errorf("expect %s, got %q", exp, m)
+		}
+	}
+	if pending := s.Pending(); len(pending) != 2 || pending[0].Revert.String() != "-b *!*@bad.example.com" {
+		t.Errorf("expect the ban then the mute pending, got %+v", pending)
+	}
+
+	if m := readMessage(t, r); m.String() != "MODE #chan -b *!*@bad.example.com" {
+		t.Errorf("expect ban lifted, got %q", m)
+	}
+	if saved := store.waitSaved(t, 1); saved[0].Revert.Mode != 'q' {
+		t.Errorf("expect only the mute left, got %+v", saved)
+	}
+
+	if ok, err := s.Cancel("#CHAN", ModeChange{Mode: 'q', Param: "*!*@loud.example.com"}); !ok || err != nil {
+		t.Errorf("expect mute cancelled, got %v, %v", ok, err)
+	}
+	store.waitSaved(t, 0)
+}
+
+func TestModeSchedulerRestart(t *testing.T) {
+	store := &memModeStore{pending: []TimedMode{
+		{"#chan", ModeChange{Mode: 'b', Param: "old!*@*"}, time.Now().Add(-time.Minute)},
+		{"#chan", ModeChange{Mode: 'b', Param: "new!*@*"}, time.Now().Add(time.Hour)},
+	}}
+	c := new(Client)
+	s, err := NewModeScheduler(c, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// undone once registered, not before
+	time.Sleep(10 * time.Millisecond)
+	_, r := registerJoins(t, c, "NETWORK=test")
+	if m := readMessage(t, r); m.String() != "MODE #chan -b old!*@*" {
+		t.Errorf("expect overdue ban lifted, got %q", m)
+	}
+	if saved := store.waitSaved(t, 1); saved[0].Revert.Param != "new!*@*" {
+		t.Errorf("expect the later ban still pending, got %+v", saved)
+	}
+}
+
+func TestFileModeStore(t *testing.T) {
+	store := FileModeStore{Path: filepath.Join(t.TempDir(), "modes.json")}
+	if pending, err := store.Load(); err != nil || len(pending) != 0 {
+		t.Fatalf("expect nothing from a missing file, got %v, %v", pending, err)
+	}
+	exp := []TimedMode{{"#chan", ModeChange{Mode: 'b', Param: "x!*@*"}, time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}}
+	if err := store.Save(exp); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pending, exp) {
+		t.Errorf("expect %+v, got %+v", exp, pending)
+	}
+}
+
+func TestMuteChange(t *testing.T) {
+	table := []struct {
+		caps map[string]string
+		exp  string
+	}{
+		{map[string]string{"CHANMODES": "beIq,k,l,imnt", "PREFIX": "(ov)@+"}, "+q m"},
+		{map[string]string{"CHANMODES": "beI,k,l,imnt", "PREFIX": "(qaohv)~&@%+", "EXTBAN": "~,acfjmnqrtCGOST"}, "+b ~q:m"},
+		{map[string]string{"CHANMODES": "beI,k,l,imnt", "EXTBAN": ",ABCMNOQRSTUcjmprsz"}, "+b m:m"},
+		{map[string]string{"CHANMODES": "beI,k,l,imnt", "PREFIX": "(qov)~@+"}, ""},
+	}
+	for _, test := range table {
+		c := &Client{caps: test.caps}
+		change, ok := c.muteChange("m")
+		if s := change.String(); ok != (test.exp != "") || ok && s != test.exp {
+			t.Errorf("%v: expect %q, got %q (%v)", test.caps, test.exp, s, ok)
+		}
+	}
+}
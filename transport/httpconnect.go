@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// HTTPConnect dials through an HTTP proxy using the CONNECT method.
+type HTTPConnect struct {
+	Addr string // proxy address, host:port
+
+	// User and Password, if User is set, are sent as basic
+	// Proxy-Authorization credentials.
+	User     string
+	Password string
+
+	Forward Dialer // dials the proxy itself; nil for a direct connection
+}
+
+// Dial connects to addr through the proxy.
+func (h *HTTPConnect) Dial(network, addr string) (net.Conn, error) {
+	conn, err := forward(h.Forward).Dial(network, h.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.User != "" {
+		req.SetBasicAuth(h.User, h.Password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "http connect")
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "http connect")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("http connect: proxy responded %s", resp.Status)
+	}
+
+	if r.Buffered() > 0 {
+		buf, _ := r.Peek(r.Buffered())
+		return &bufferedConn{conn, buf}, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,229 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"ktkr.us/pkg/irc"
+)
+
+// A RecordedLine is one line of a recording made by Recorder.
+type RecordedLine struct {
+	Time time.Time
+	Dir  string // "in" from the server, "out" from the client
+	Line string // without its line ending
+}
+
+// Recorder is a Dialer that copies each line crossing the connections it
+// makes to W, one per line in the form
+//
+//	2023-06-01T12:00:00.123456789Z in :nick!user@host PRIVMSG #chan :hi
+//
+// Credentials the client sends are redacted with irc.RedactLine.
+//
+// Recorder sees the bytes its Forward dialer returns, so it should be used
+// with Client.Secure unset; to record a TLS connection, let Forward do the
+// TLS, e.g. with a *tls.Dialer.
+type Recorder struct {
+	W       io.Writer
+	Forward Dialer // makes the connection to record; nil for a direct one
+
+	mu sync.Mutex // serializes writes to W
+}
+
+// Dial makes a connection with Forward and records what crosses it.
+func (r *Recorder) Dial(network, addr string) (net.Conn, error) {
+	conn, err := forward(r.Forward).Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &recordConn{Conn: conn, r: r}, nil
+}
+
+func (r *Recorder) record(dir, line string) {
+	if dir == "out" {
+		line = irc.RedactLine(line)
+	}
+	var b []byte
+	b = time.Now().UTC().AppendFormat(b, time.RFC3339Nano)
+	b = append(b, ' ')
+	b = append(b, dir...)
+	b = append(b, ' ')
+	b = append(b, line...)
+	b = append(b, '\n')
+
+	r.mu.Lock()
+	r.W.Write(b)
+	r.mu.Unlock()
+}
+
+type recordConn struct {
+	net.Conn
+	r       *Recorder
+	in, out []byte // partial lines
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in = c.split("in", c.in, p[:n])
+	return n, err
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out = c.split("out", c.out, p[:n])
+	return n, err
+}
+
+// split records each complete line in partial+p, returning what's left.
+func (c *recordConn) split(dir string, partial, p []byte) []byte {
+	partial = append(partial, p...)
+	for {
+		i := bytes.IndexByte(partial, '\n')
+		if i < 0 {
+			return partial
+		}
+		c.r.record(dir, strings.TrimRight(string(partial[:i]), "\r"))
+		partial = partial[:copy(partial, partial[i+1:])]
+	}
+}
+
+// ReadRecording reads a recording made by Recorder.
+func ReadRecording(r io.Reader) ([]RecordedLine, error) {
+	var (
+		lines []RecordedLine
+		sc    = bufio.NewScanner(r)
+		n     = 0
+	)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		n++
+		fields := strings.SplitN(sc.Text(), " ", 3)
+		if len(fields) < 3 || (fields[1] != "in" && fields[1] != "out") {
+			return nil, errors.Errorf("recording: malformed line %d", n)
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "recording: line %d", n)
+		}
+		lines = append(lines, RecordedLine{t, fields[1], fields[2]})
+	}
+	return lines, sc.Err()
+}
+
+// Replay is a Dialer that plays back the lines a server sent in a recording
+// made by Recorder, so that a client's handlers can be run against captured
+// traffic. The connection is closed once the recording runs out. A Replay
+// can be dialed only once.
+type Replay struct {
+	R io.Reader // the recording
+
+	// Speed scales the gaps between lines: 1 plays back in real time, 60
+	// plays an hour in a minute. If zero, lines are sent as fast as the
+	// client reads them.
+	Speed float64
+
+	// W, if non-nil, receives the raw lines the client writes, so that its
+	// responses can be compared between runs.
+	W io.Writer
+
+	// Linger is how long the connection stays open after the last line,
+	// played back at Speed, for the client to respond to it. If zero, the
+	// connection closes as soon as the last line from the server is sent.
+	Linger time.Duration
+
+	dialed bool
+	done   chan struct{}
+}
+
+// Dial starts playing back the recording, whatever addr is.
+func (p *Replay) Dial(network, addr string) (net.Conn, error) {
+	if p.dialed {
+		return nil, errors.New("replay: recording already played")
+	}
+	p.dialed = true
+
+	lines, err := ReadRecording(p.R)
+	if err != nil {
+		return nil, err
+	}
+
+	client, server := net.Pipe()
+	p.done = make(chan struct{})
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		w := p.W
+		if w == nil {
+			w = io.Discard
+		}
+		io.Copy(w, server)
+	}()
+	go func() {
+		p.play(server, lines, copied)
+		<-copied
+		close(p.done)
+	}()
+	return client, nil
+}
+
+// Done returns a channel that is closed once playback has ended and
+// everything the client wrote has been copied to W. It is nil until the
+// Replay has been dialed.
+func (p *Replay) Done() <-chan struct{} {
+	return p.done
+}
+
+// play writes the inbound lines to conn, paced by their timestamps, until
+// they run out or the client hangs up.
+func (p *Replay) play(conn net.Conn, lines []RecordedLine, done <-chan struct{}) {
+	defer conn.Close()
+
+	var (
+		start = time.Now()
+		first time.Time
+		last  time.Time
+	)
+	wait := func(d time.Duration) bool {
+		select {
+		case <-time.After(d):
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	for _, l := range lines {
+		if first.IsZero() {
+			first = l.Time
+		}
+		last = l.Time
+		if l.Dir != "in" {
+			continue
+		}
+		if p.Speed > 0 && !wait(time.Until(start.Add(p.scale(l.Time.Sub(first))))) {
+			return
+		}
+		if _, err := io.WriteString(conn, l.Line+"\r\n"); err != nil {
+			return
+		}
+	}
+
+	// give the client until the end of the recording, then Linger
+	end := start.Add(p.Linger)
+	if p.Speed > 0 {
+		end = end.Add(p.scale(last.Sub(first)))
+	}
+	wait(time.Until(end))
+}
+
+func (p *Replay) scale(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / p.Speed)
+}
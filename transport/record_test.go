@@ -0,0 +1,104 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"ktkr.us/pkg/irc"
+)
+
+func TestRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	d := &Recorder{W: &buf, Forward: &pipeDialer{t: t, serve: func(t *testing.T, conn net.Conn) {
+		conn.Write([]byte(":irc.test NOTICE * :hi\r\n:irc.test PI"))
+		conn.Write([]byte("NG :x\r\n"))
+		r := bufio.NewReader(conn)
+		expectLine(t, r, "PASS hunter2\r\n")
+		expectLine(t, r, "NICK bot\r\n")
+	}}}
+
+	conn, err := d.Dial("tcp", "irc.test:6667")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	expectLine(t, r, ":irc.test NOTICE * :hi\r\n")
+	expectLine(t, r, ":irc.test PING :x\r\n")
+	io.WriteString(conn, "PASS hunter2\r\nNICK ")
+	io.WriteString(conn, "bot\r\n")
+	conn.Close()
+
+	lines, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"in :irc.test NOTICE * :hi",
+		"in :irc.test PING :x",
+		"out PASS <redacted>",
+		"out NICK bot",
+	}
+	if len(lines) != len(expect) {
+		t.Fatalf("expect %d lines, got %+v", len(expect), lines)
+	}
+	for i, l := range lines {
+		if s := l.Dir + " " + l.Line; s != expect[i] {
+			t.Errorf("expect %q, got %q", expect[i], s)
+		}
+		if time.Since(l.Time) > time.Minute {
+			t.Errorf("bad timestamp %v", l.Time)
+		}
+	}
+}
+
+func TestReadRecordingMalformed(t *testing.T) {
+	for _, s := range []string{
+		"2023-06-01T12:00:00Z sideways PING :x\n",
+		"yesterday in PING :x\n",
+		"2023-06-01T12:00:00Z in\n",
+	} {
+		if _, err := ReadRecording(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: expect error", s)
+		}
+	}
+}
+
+const recording = `2023-06-01T12:00:00Z in :irc.test NOTICE * :hello
+2023-06-01T12:00:00.5Z out NICK bot
+2023-06-01T12:00:01Z in :irc.test 001 bot :Welcome
+2023-06-01T12:00:02Z in :alice!a@host PRIVMSG #chan :ping bot
+2023-06-01T12:00:03Z out PRIVMSG #chan :pong alice
+`
+
+func TestReplay(t *testing.T) {
+	var out bytes.Buffer
+	p := &Replay{R: strings.NewReader(recording), Speed: 100, W: &out, Linger: 20 * time.Millisecond}
+	c := &irc.Client{Nick: "bot", User: "bot", Dialer: p}
+	c.HandleFunc("PRIVMSG", func(c *irc.Client, m *irc.Message) {
+		if strings.HasPrefix(m.LastParam(), "ping ") {
+			c.PRIVMSG(m.Param(0), "pong "+m.From.Nick)
+		}
+	})
+
+	start := time.Now()
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	c.Run()
+	<-p.Done()
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("3s of recording at 100x took only %v", d)
+	}
+
+	if s := out.String(); !strings.Contains(s, "PRIVMSG #chan :pong alice\r\n") {
+		t.Errorf("client output %q", s)
+	}
+	if _, err := p.Dial("tcp", ""); err == nil {
+		t.Error("expect error dialing a Replay twice")
+	}
+}
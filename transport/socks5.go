@@ -0,0 +1,156 @@
+package transport
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// SOCKS5 dials through a SOCKS5 proxy (RFC 1928). Hostnames are resolved by
+// the proxy.
+type SOCKS5 struct {
+	Addr string // proxy address, host:port
+
+	// User and Password, if User is set, are offered to the proxy with
+	// username/password authentication (RFC 1929).
+	User     string
+	Password string
+
+	Forward Dialer // dials the proxy itself; nil for a direct connection
+}
+
+const (
+	socks5Version     = 5
+	socks5AuthNone    = 0
+	socks5AuthPass    = 2
+	socks5AuthNoMatch = 0xff
+	socks5Connect     = 1
+	socks5IPv4        = 1
+	socks5Domain      = 3
+	socks5IPv6        = 4
+)
+
+var socks5Errors = []string{
+	"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// Dial connects to addr through the proxy.
+func (s *SOCKS5) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := forward(s.Forward).Dial(network, s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.handshake(conn, host, port); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "socks5")
+	}
+	return conn, nil
+}
+
+func (s *SOCKS5) handshake(conn net.Conn, host string, port uint16) error {
+	method := byte(socks5AuthNone)
+	if s.User != "" {
+		method = socks5AuthPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return errors.Errorf("unexpected protocol version %d", reply[0])
+	}
+	switch reply[1] {
+	case method:
+	case socks5AuthNoMatch:
+		return errors.New("proxy rejected authentication methods")
+	default:
+		return errors.Errorf("proxy chose unoffered method %d", reply[1])
+	}
+
+	if method == socks5AuthPass {
+		if len(s.User) > 255 || len(s.Password) > 255 {
+			return errors.New("username or password too long")
+		}
+		b := []byte{1, byte(len(s.User))}
+		b = append(b, s.User...)
+		b = append(b, byte(len(s.Password)))
+		b = append(b, s.Password...)
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("hostname too long")
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		if int(head[1]) < len(socks5Errors) {
+			return errors.New(socks5Errors[head[1]])
+		}
+		return errors.Errorf("unknown error %d", head[1])
+	}
+
+	// discard the bound address
+	var skip int
+	switch head[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return errors.Errorf("unknown address type %d", head[3])
+	}
+	_, err := io.CopyN(io.Discard, conn, int64(skip)+2)
+	return err
+}
@@ -0,0 +1,52 @@
+// Package transport provides Dialers for reaching IRC servers through
+// proxies and WebSocket gateways. Each of them satisfies irc.Dialer.
+package transport
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// A Dialer makes a connection to addr. It mirrors irc.Dialer so that
+// dialers can be chained, e.g. a WebSocket reached through a SOCKS5 proxy.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+func forward(d Dialer) Dialer {
+	if d != nil {
+		return d
+	}
+	return &net.Dialer{}
+}
+
+// splitHostPort splits addr into a host and a numeric port.
+func splitHostPort(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, errors.Errorf("transport: bad port in %q", addr)
+	}
+	return host, uint16(port), nil
+}
+
+// bufferedConn is a net.Conn whose first reads are served from data that
+// was read ahead while setting up the connection.
+type bufferedConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(p, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,243 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// pipeDialer hands out the client end of a net.Pipe and runs serve on the
+// other end.
+type pipeDialer struct {
+	t     *testing.T
+	serve func(t *testing.T, conn net.Conn)
+	addr  string
+}
+
+func (d *pipeDialer) Dial(network, addr string) (net.Conn, error) {
+	d.addr = addr
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		d.serve(d.t, server)
+	}()
+	return client, nil
+}
+
+func expectLine(t *testing.T, r *bufio.Reader, expect string) {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != expect {
+		t.Errorf("expect %q, got %q", expect, line)
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	d := &SOCKS5{
+		Addr:     "proxy:1080",
+		User:     "bot",
+		Password: "hunter2",
+		Forward: &pipeDialer{t: t, serve: func(t *testing.T, conn net.Conn) {
+			buf := make([]byte, 64)
+			io.ReadFull(conn, buf[:3])
+			if !bytes.Equal(buf[:3], []byte{5, 1, 2}) {
+				t.Errorf("greeting: got %v", buf[:3])
+			}
+			conn.Write([]byte{5, 2})
+
+			io.ReadFull(conn, buf[:2])
+			user := make([]byte, buf[1])
+			io.ReadFull(conn, user)
+			io.ReadFull(conn, buf[:1])
+			pass := make([]byte, buf[0])
+			io.ReadFull(conn, pass)
+			if string(user) != "bot" || string(pass) != "hunter2" {
+				t.Errorf("auth: got %q %q", user, pass)
+			}
+			conn.Write([]byte{1, 0})
+
+			io.ReadFull(conn, buf[:5])
+			if buf[3] != socks5Domain {
+				t.Errorf("expected domain address type, got %d", buf[3])
+			}
+			host := make([]byte, buf[4])
+			io.ReadFull(conn, host)
+			io.ReadFull(conn, buf[:2])
+			if string(host) != "irc.example.net" || binary.BigEndian.Uint16(buf) != 6697 {
+				t.Errorf("connect: got %s:%d", host, binary.BigEndian.Uint16(buf))
+			}
+			conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0x1a, 0x29})
+
+			conn.Write([]byte("hello\r\n"))
+		}},
+	}
+
+	conn, err := d.Dial("tcp", "irc.example.net:6697")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectLine(t, bufio.NewReader(conn), "hello\r\n")
+}
+
+func TestSOCKS5Refused(t *testing.T) {
+	d := &SOCKS5{
+		Addr: "proxy:1080",
+		Forward: &pipeDialer{t: t, serve: func(t *testing.T, conn net.Conn) {
+			buf := make([]byte, 64)
+			io.ReadFull(conn, buf[:3])
+			conn.Write([]byte{5, 0})
+			conn.Read(buf)
+			conn.Write([]byte{5, 5, 0, 1})
+		}},
+	}
+
+	if _, err := d.Dial("tcp", "10.0.0.1:6667"); err == nil {
+		t.Error("expected error from refused connection")
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	d := &HTTPConnect{
+		Addr: "proxy:3128",
+		User: "bot",
+		Forward: &pipeDialer{t: t, serve: func(t *testing.T, conn net.Conn) {
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if req.Method != http.MethodConnect || req.Host != "irc.example.net:6667" {
+				t.Errorf("got %s %s", req.Method, req.Host)
+			}
+			if req.Header.Get("Proxy-Authorization") == "" {
+				t.Error("missing Proxy-Authorization")
+			}
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n:server NOTICE * :hi\r\n"))
+		}},
+	}
+
+	conn, err := d.Dial("tcp", "irc.example.net:6667")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectLine(t, bufio.NewReader(conn), ":server NOTICE * :hi\r\n")
+}
+
+func TestWebSocket(t *testing.T) {
+	pd := &pipeDialer{t: t, serve: func(t *testing.T, conn net.Conn) {
+		r := bufio.NewReader(conn)
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if req.URL.Path != "/webirc" || req.Header.Get("Sec-WebSocket-Protocol") != wsSubprotocol {
+			t.Errorf("bad handshake request %v %v", req.URL, req.Header)
+		}
+		resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + wsAccept(req.Header.Get("Sec-WebSocket-Key")) + "\r\n" +
+			"Sec-WebSocket-Protocol: " + wsSubprotocol + "\r\n\r\n"
+		conn.Write([]byte(resp))
+
+		// one frame per line from the client, masked
+		for _, expect := range []string{"NICK bot", "USER bot 0 * :bot"} {
+			c := &wsConn{Conn: conn, r: r}
+			_, op, payload, err := c.readFrame()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if op != wsText || string(payload) != expect {
+				t.Errorf("expect text frame %q, got %d %q", expect, op, payload)
+			}
+		}
+
+		// unmasked server frames: a ping, an empty line, then a line split
+		// across fragments
+		conn.Write([]byte{0x80 | wsPing, 2, 'h', 'i'})
+		c := &wsConn{Conn: conn, r: r}
+		if _, op, payload, _ := c.readFrame(); op != wsPong || string(payload) != "hi" {
+			t.Errorf("expect pong, got %d %q", op, payload)
+		}
+		conn.Write([]byte{0x80 | wsText, 0})
+		conn.Write(append([]byte{wsText, 4}, "PING"...))
+		conn.Write(append([]byte{0x80 | wsContinuation, 4}, " :x1"...))
+		conn.Write([]byte{0x80 | wsClose, 0})
+		c.readFrame()
+	}}
+
+	d := &WebSocket{URL: "ws://gateway.example.net/webirc", Forward: pd}
+	conn, err := d.Dial("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if pd.addr != "gateway.example.net:80" {
+		t.Errorf("dialed %q", pd.addr)
+	}
+
+	io.WriteString(conn, "NICK bot\r\nUSER bot 0 ")
+	io.WriteString(conn, "* :bot\r\n")
+
+	r := bufio.NewReader(conn)
+	expectLine(t, r, "PING :x1\r\n")
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Errorf("expect EOF after close frame, got %v", err)
+	}
+}
+
+func TestWebSocketBadFrames(t *testing.T) {
+	table := []struct {
+		name  string
+		frame []byte
+	}{
+		{"binary", append([]byte{0x80 | wsBinary, 2}, "hi"...)},
+		{"bare continuation", append([]byte{0x80 | wsContinuation, 2}, "hi"...)},
+		{"fragmented ping", append([]byte{wsPing, 2}, "hi"...)},
+		{"oversized ping", append([]byte{0x80 | wsPing, 126, 0, 126}, make([]byte, 126)...)},
+	}
+
+	for _, test := range table {
+		client, server := net.Pipe()
+		frame := test.frame
+		go func() {
+			server.Write(frame)
+			server.Close()
+		}()
+		c := &wsConn{Conn: client, r: bufio.NewReader(client)}
+		if _, err := c.Read(make([]byte, 64)); err == nil || err == io.EOF {
+			t.Errorf("%s: expect error, got %v", test.name, err)
+		}
+		client.Close()
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	if _, err := (&WebSocket{}).Dial("tcp", ""); err == nil {
+		t.Error("expect error dialing with no URL or address")
+	}
+
+	d := &WebSocket{URL: "ws://gateway.example.net/", Forward: &pipeDialer{t: t, serve: func(t *testing.T, conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + wsAccept(req.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"))
+	}}}
+	if _, err := d.Dial("tcp", ""); err == nil {
+		t.Error("expect error when gateway does not agree to subprotocol")
+	}
+}
@@ -0,0 +1,369 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// WebSocket dials an IRC-over-WebSocket gateway as described by the IRCv3
+// WebSocket specification. Each IRC line travels as one text frame; the
+// returned connection turns frames back into CRLF-terminated lines so the
+// client can treat it like any other stream.
+type WebSocket struct {
+	// URL of the gateway, ws:// or wss://. If empty, ws://addr/ is used
+	// with the address passed to Dial.
+	URL string
+
+	Origin    string      // sent as the Origin header if non-empty
+	Header    http.Header // extra handshake headers
+	TLSConfig *tls.Config // used for wss:// URLs
+
+	Forward Dialer // dials the gateway itself; nil for a direct connection
+}
+
+const (
+	wsGUID        = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsSubprotocol = "text.ircv3.net"
+
+	// a generous bound on a single message; IRC lines are far shorter
+	wsMaxPayload = 1 << 16
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// Dial connects and performs the WebSocket handshake. The network argument
+// is passed through to the forward Dialer.
+func (w *WebSocket) Dial(network, addr string) (net.Conn, error) {
+	raw := w.URL
+	if raw == "" {
+		if addr == "" {
+			return nil, errors.New("websocket: no URL or address to dial")
+		}
+		raw = "ws://" + addr + "/"
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "websocket")
+	}
+
+	hostport := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			hostport = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			hostport = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, errors.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+
+	conn, err := forward(w.Forward).Dial(network, hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "wss" {
+		conf := w.TLSConfig.Clone()
+		if conf == nil {
+			conf = &tls.Config{}
+		}
+		if conf.ServerName == "" {
+			conf.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, conf)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "websocket")
+		}
+		conn = tlsConn
+	}
+
+	ws, err := w.handshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "websocket")
+	}
+	return ws, nil
+}
+
+func (w *WebSocket) handshake(conn net.Conn, u *url.URL) (*wsConn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:   u.Host,
+		Header: make(http.Header),
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	for k, v := range w.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", wsSubprotocol)
+	if w.Origin != "" {
+		req.Header.Set("Origin", w.Origin)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.Errorf("gateway responded %s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("gateway did not upgrade to websocket")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, errors.New("bad Sec-WebSocket-Accept")
+	}
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != wsSubprotocol {
+		return nil, errors.Errorf("gateway chose subprotocol %q, want %q", p, wsSubprotocol)
+	}
+
+	return &wsConn{Conn: conn, r: r}, nil
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsConn adapts a WebSocket to a line-oriented byte stream.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	rbuf    []byte // decoded data not yet returned by Read
+	msg     []byte // fragments of the message being reassembled
+	partial bool   // a fragmented message is in progress
+
+	wmu    sync.Mutex
+	wbuf   []byte // bytes written since the last newline
+	closed bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		if err := c.readMessage(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// readMessage reads frames until a complete, non-empty line is available
+// in c.rbuf, answering control frames along the way.
+func (c *wsConn) readMessage() error {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+
+		if op >= wsClose && (!fin || len(payload) > 125) {
+			return errors.New("websocket: fragmented or oversized control frame")
+		}
+
+		switch op {
+		case wsPing:
+			// Answer without blocking the reader; the peer may itself be
+			// blocked writing to us.
+			go c.writeFrame(wsPong, payload)
+		case wsPong:
+		case wsClose:
+			go c.writeFrame(wsClose, payload)
+			return io.EOF
+		case wsText:
+			if c.partial {
+				return errors.New("websocket: new message inside fragmented message")
+			}
+			c.msg = append(c.msg[:0], payload...)
+			c.partial = !fin
+		case wsContinuation:
+			if !c.partial {
+				return errors.New("websocket: continuation frame without a message")
+			}
+			c.msg = append(c.msg, payload...)
+			c.partial = !fin
+		case wsBinary:
+			return errors.Errorf("websocket: binary frame on %s connection", wsSubprotocol)
+		default:
+			return errors.Errorf("websocket: unknown opcode %d", op)
+		}
+
+		if op != wsText && op != wsContinuation || c.partial {
+			if len(c.msg) > wsMaxPayload {
+				return errors.New("websocket: message too large")
+			}
+			continue
+		}
+
+		line := bytes.TrimRight(c.msg, "\r\n")
+		c.msg = c.msg[:0]
+		if len(line) == 0 {
+			continue
+		}
+		c.rbuf = append(append(c.rbuf[:0], line...), '\r', '\n')
+		return nil
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxPayload {
+		err = errors.New("websocket: frame too large")
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// Write sends each complete line in p as its own text frame. A trailing
+// partial line is held until the rest of it is written.
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.wbuf = append(c.wbuf, p...)
+	for {
+		i := bytes.IndexByte(c.wbuf, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimRight(c.wbuf[:i], "\r")
+		if len(line) > 0 {
+			if !utf8.Valid(line) {
+				line = bytes.ToValidUTF8(line, []byte("�"))
+			}
+			if err := c.writeFrameLocked(wsText, line); err != nil {
+				return 0, err
+			}
+		}
+		c.wbuf = c.wbuf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeFrameLocked(op, payload)
+}
+
+// writeFrameLocked writes a single masked frame. Clients must mask every
+// frame they send.
+func (c *wsConn) writeFrameLocked(op byte, payload []byte) error {
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	if op == wsClose {
+		c.closed = true
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends a normal closure frame and closes the underlying connection.
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, []byte{0x03, 0xe8})
+	return c.Conn.Close()
+}
@@ -0,0 +1,103 @@
+package irc
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MaxParams is the most parameters, trailing included, a message may carry.
+const MaxParams = 15
+
+// maxLineBudget bounds the variable part of a line the client builds up
+// itself, the channels of a JOIN, the targets of a MONITOR or ISON, or the
+// modes and params of a MODE, leaving room under the 512 byte limit for
+// the command, the prefix the server adds when relaying it, and tags.
+const maxLineBudget = 400
+
+// ErrInvalidMessage is reported for a message that can't be written to the
+// wire as it stands. The error returned by Validate wraps it with the reason.
+var ErrInvalidMessage = errors.New("irc: invalid message")
+
+// Validate reports whether m can be written without changing its meaning:
+// the command is letters or three digits, no field contains NUL, CR or LF,
+// every param but the trailing one is non-empty with no spaces and no
+// leading colon, and there are at most MaxParams of them.
+//
+// Validate doesn't modify m. The client does move a last param that needs
+// it into the trailing position before validating what it sends, so
+// Command(cmd, []string{target, "some text"}) works as expected.
+func (m *Message) Validate() error {
+	if err := validateCommand(m.Command); err != nil {
+		return err
+	}
+
+	if n := m.NumParams(); n > MaxParams {
+		return errors.Wrapf(ErrInvalidMessage, "%d params, limit is %d", n, MaxParams)
+	}
+
+	for i, p := range m.Params {
+		switch {
+		case p == "":
+			return errors.Wrapf(ErrInvalidMessage, "param %d is empty", i)
+		case p[0] == ':':
+			return errors.Wrapf(ErrInvalidMessage, "param %d begins with a colon", i)
+		case strings.IndexByte(p, ' ') >= 0:
+			return errors.Wrapf(ErrInvalidMessage, "param %d contains a space", i)
+		case hasIllegalByte(p):
+			return errors.Wrapf(ErrInvalidMessage, "param %d contains NUL, CR or LF", i)
+		}
+	}
+	if hasIllegalByte(m.Trailing) {
+		return errors.Wrap(ErrInvalidMessage, "trailing param contains NUL, CR or LF")
+	}
+
+	for k := range m.Tags {
+		if k == "" || strings.ContainsAny(k, " ;=\x00\r\n") {
+			return errors.Wrapf(ErrInvalidMessage, "bad tag key %q", k)
+		}
+	}
+	return nil
+}
+
+func validateCommand(cmd string) error {
+	if cmd == "" {
+		return errors.Wrap(ErrInvalidMessage, "empty command")
+	}
+
+	digits := 0
+	for i := 0; i < len(cmd); i++ {
+		switch b := cmd[i]; {
+		case b >= '0' && b <= '9':
+			digits++
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z':
+		default:
+			return errors.Wrapf(ErrInvalidMessage, "bad command %q", cmd)
+		}
+	}
+	if digits > 0 && (digits != 3 || len(cmd) != 3) {
+		return errors.Wrapf(ErrInvalidMessage, "bad command %q", cmd)
+	}
+	return nil
+}
+
+func hasIllegalByte(s string) bool {
+	return strings.ContainsAny(s, "\x00\r\n")
+}
+
+// normalize moves the last param into the trailing position if it can only
+// be sent there: when it's empty, has a space or begins with a colon. The
+// params slice itself is left alone, since it may belong to the caller.
+func (m *Message) normalize() {
+	n := len(m.Params)
+	if m.hasTrailing() || n == 0 {
+		return
+	}
+	last := m.Params[n-1]
+	if last != "" && last[0] != ':' && strings.IndexByte(last, ' ') < 0 {
+		return
+	}
+	m.Params = m.Params[: n-1 : n-1]
+	m.Trailing = last
+	m.HasTrailing = true
+}
@@ -0,0 +1,90 @@
+package irc
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	table := []struct {
+		m     Message
+		valid bool
+	}{
+		{Message{Command: "PRIVMSG", Params: []string{"#chan"}, Trailing: "hi: there\x01"}, true},
+		{Message{Command: "001", Params: []string{"bot"}, Trailing: ":)"}, true},
+		{Message{Command: "PING", Tags: map[string]string{"+draft/x": "a b;c"}}, true},
+		{Message{Command: ""}, false},
+		{Message{Command: "PRIV MSG"}, false},
+		{Message{Command: "PRIVMSG\r\nQUIT"}, false},
+		{Message{Command: "01"}, false},
+		{Message{Command: "A01"}, false},
+		{Message{Command: "PRIVMSG", Params: []string{"#chan"}, Trailing: "hi\r\nQUIT :pwned"}, false},
+		{Message{Command: "PRIVMSG", Params: []string{"#chan"}, Trailing: "a\x00b"}, false},
+		{Message{Command: "PRIVMSG", Params: []string{"#chan\n"}}, false},
+		{Message{Command: "PRIVMSG", Params: []string{"#a b", "x"}}, false},
+		{Message{Command: "PRIVMSG", Params: []string{":#a", "x"}}, false},
+		{Message{Command: "PRIVMSG", Params: []string{"", "x"}}, false},
+		{Message{Command: "PING", Tags: map[string]string{"a=b": ""}}, false},
+		{Message{Command: "MODE", Params: strings.Fields(strings.Repeat("x ", 15))}, true},
+		{Message{Command: "MODE", Params: strings.Fields(strings.Repeat("x ", 15)), Trailing: "y"}, false},
+	}
+
+	for _, test := range table {
+		err := test.m.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%q: expect valid, got %v", test.m.String(), err)
+		} else if !test.valid && !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%q: expect ErrInvalidMessage, got %v", test.m.String(), err)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	table := []struct {
+		params   []string
+		trailing string
+		expect   []string
+		expTrail string
+	}{
+		{[]string{"#chan", "hello there"}, "", []string{"#chan"}, "hello there"},
+		{[]string{"#chan", ":)"}, "", []string{"#chan"}, ":)"},
+		{[]string{"#chan", "hi"}, "", []string{"#chan", "hi"}, ""},
+		{[]string{"#chan", ""}, "", []string{"#chan"}, ""},
+		{[]string{"#a b"}, "x", []string{"#a b"}, "x"},
+	}
+
+	for _, test := range table {
+		params := append([]string(nil), test.params...)
+		m := &Message{Command: "PRIVMSG", Params: params, Trailing: test.trailing}
+		m.normalize()
+		if !reflect.DeepEqual(m.Params, test.expect) || m.Trailing != test.expTrail {
+			t.Errorf("%q %q: expect %q %q, got %q %q", test.params, test.trailing, test.expect, test.expTrail, m.Params, m.Trailing)
+		}
+		if !reflect.DeepEqual(params, test.params) {
+			t.Errorf("%q: caller's params modified to %q", test.params, params)
+		}
+	}
+}
+
+func TestSendInvalid(t *testing.T) {
+	c := &Client{Nick: "bot", User: "bot"}
+	_, r := connectPipe(t, c)
+	defer c.Close()
+
+	for _, d := range []*Delivery{
+		c.PRIVMSG("#chan", "hi\r\nQUIT :pwned"),
+		c.JOIN("#chan\nPART #other"),
+		c.SendRaw("PRIVMSG #chan :a\x00b"),
+	} {
+		if err := d.Err(); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("expect ErrInvalidMessage, got %v", err)
+		}
+	}
+
+	c.Command("PRIVMSG", []string{"#chan", "spaces and all"})
+	if m := readMessage(t, r); m.String() != "PRIVMSG #chan :spaces and all" {
+		t.Errorf("expect params moved to trailing, got %q", m.String())
+	}
+}